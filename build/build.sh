@@ -26,8 +26,10 @@ OUTPUT_DIR=${OUTPUT_DIR:-"/outputs"}
 
 # Git configuration
 GIT_BRANCH=${GIT_BRANCH:-"main"}
+GIT_COMMIT=${GIT_COMMIT:-""}
 GIT_USERNAME=${GIT_USERNAME:-""}
 GIT_PASSWORD=${GIT_PASSWORD:-""}
+GIT_TOKEN=${GIT_TOKEN:-""}
 
 # Keystore configuration for Android signing
 KEYSTORE_PATH=${KEYSTORE_PATH:-""}
@@ -39,6 +41,9 @@ ENV_FILES_DIR=${ENV_FILES_DIR:-"/env-files"}
 echo -e "${YELLOW}Build Configuration:${NC}"
 echo "  Git Repository: $GIT_REPO"
 echo "  Git Branch: $GIT_BRANCH"
+if [ -n "$GIT_COMMIT" ]; then
+    echo "  Git Commit: $GIT_COMMIT"
+fi
 echo "  Build Folder: ${BUILD_FOLDER:-'(root)'}"
 echo "  Flutter Channel: $FLUTTER_CHANNEL"
 echo "  Platform: $PLATFORM"
@@ -48,10 +53,23 @@ echo ""
 
 # Step 1: Clone repository
 echo -e "${GREEN}[1/7] Cloning repository...${NC}"
+# Credentials are read from the environment by a credential helper, so they
+# never appear in the remote URL nor in .git/config
+if [ -n "$GIT_TOKEN" ]; then
+    # GitHub App installation token
+    GIT_USERNAME="x-access-token"
+    GIT_PASSWORD="$GIT_TOKEN"
+fi
 if [ -n "$GIT_USERNAME" ] && [ -n "$GIT_PASSWORD" ]; then
-    # Clone with authentication
-    GIT_URL_WITH_AUTH=$(echo "$GIT_REPO" | sed "s|https://|https://${GIT_USERNAME}:${GIT_PASSWORD}@|")
-    git clone --depth 1 --branch "$GIT_BRANCH" "$GIT_URL_WITH_AUTH" /workspace/repo
+    export GIT_USERNAME GIT_PASSWORD
+    git config --global credential.helper '!f() { test "$1" = get && echo "username=${GIT_USERNAME}" && echo "password=${GIT_PASSWORD}"; }; f'
+fi
+if [ -n "$GIT_COMMIT" ]; then
+    # Exact commit of a push or pull request, which the branch may have moved past
+    git init -q /workspace/repo
+    git -C /workspace/repo remote add origin "$GIT_REPO"
+    git -C /workspace/repo fetch --depth 1 origin "$GIT_COMMIT"
+    git -C /workspace/repo checkout -q FETCH_HEAD
 else
     git clone --depth 1 --branch "$GIT_BRANCH" "$GIT_REPO" /workspace/repo
 fi
@@ -201,6 +219,11 @@ if [ -d "$ENV_FILES_DIR" ] && [ "$(ls -A $ENV_FILES_DIR)" ]; then
             if [[ $filename == *"::"* ]]; then
                 dest_path="${filename#*::}"
                 dest_path="${dest_path//__/\/}"  # Replace __ with /
+                # Stay inside the project
+                if [[ $dest_path == /* || "/$dest_path/" == */../* ]]; then
+                    echo -e "${RED}    ✗ $filename: path outside the project, skipped${NC}"
+                    continue
+                fi
                 mkdir -p "$(dirname "$dest_path")"
                 cp "$file" "$dest_path"
                 echo "    ✓ $filename -> $dest_path"
@@ -248,11 +271,18 @@ flutter pub get
 # Step 6: Build the application
 echo -e "${GREEN}[6/7] Building Flutter application...${NC}"
 
+# Release builds split Dart debug symbols out of the binaries
+DEBUG_SYMBOLS_DIR="build/debug-symbols"
+DEBUG_INFO_ARGS=""
+if [ "$BUILD_MODE" = "release" ] && [ "$PLATFORM" != "web" ]; then
+    DEBUG_INFO_ARGS="--split-debug-info=$DEBUG_SYMBOLS_DIR"
+fi
+
 case "$PLATFORM" in
     android)
         if [ "$BUILD_TARGET" = "appbundle" ] || [ "$BUILD_TARGET" = "aab" ]; then
             echo "  Building Android App Bundle (.aab)..."
-            flutter build appbundle --$BUILD_MODE
+            flutter build appbundle --$BUILD_MODE $DEBUG_INFO_ARGS
 
             # Find and copy the AAB file
             AAB_FILE=$(find build/app/outputs/bundle -name "*.aab" | head -n 1)
@@ -267,7 +297,7 @@ case "$PLATFORM" in
             fi
         else
             echo "  Building Android APK..."
-            flutter build apk --$BUILD_MODE
+            flutter build apk --$BUILD_MODE $DEBUG_INFO_ARGS
 
             # Find and copy the APK file
             APK_FILE=$(find build/app/outputs/flutter-apk -name "*.apk" | head -n 1)
@@ -285,7 +315,7 @@ case "$PLATFORM" in
 
     ios)
         echo "  Building iOS application..."
-        flutter build ios --$BUILD_MODE --no-codesign
+        flutter build ios --$BUILD_MODE --no-codesign $DEBUG_INFO_ARGS
 
         # Copy iOS build artifacts
         mkdir -p "$OUTPUT_DIR"
@@ -315,8 +345,39 @@ case "$PLATFORM" in
         ;;
 esac
 
+if [ -d "$DEBUG_SYMBOLS_DIR" ] && [ -n "$(ls -A "$DEBUG_SYMBOLS_DIR")" ]; then
+    tar -czf "$OUTPUT_DIR/debug-symbols-${BUILD_ID}.tar.gz" -C "$DEBUG_SYMBOLS_DIR" .
+    echo "  ✓ Debug symbols: $OUTPUT_DIR/debug-symbols-${BUILD_ID}.tar.gz"
+fi
+
 # Step 7: Generate build info
 echo -e "${GREEN}[7/7] Generating build information...${NC}"
+
+# Kind of an output file, as recorded by the API
+artifact_kind() {
+    case "$1" in
+        *.apk) echo "apk" ;;
+        *.aab) echo "aab" ;;
+        *.ipa) echo "ipa" ;;
+        debug-symbols-*) echo "debug_symbols" ;;
+        web-build-*) echo "web" ;;
+        ios-build-*) echo "ios_app" ;;
+        *) echo "other" ;;
+    esac
+}
+
+ARTIFACTS_JSON=""
+for file in "$OUTPUT_DIR"/*; do
+    name=$(basename "$file")
+    if [ ! -f "$file" ] || [ "$name" = "build-info.json" ]; then
+        continue
+    fi
+    size=$(stat -c %s "$file")
+    sha256=$(sha256sum "$file" | cut -d ' ' -f 1)
+    entry="{\"name\": \"$name\", \"kind\": \"$(artifact_kind "$name")\", \"size\": $size, \"sha256\": \"$sha256\"}"
+    ARTIFACTS_JSON="${ARTIFACTS_JSON:+$ARTIFACTS_JSON, }$entry"
+done
+
 cat > "$OUTPUT_DIR/build-info.json" << EOF
 {
   "build_id": "${BUILD_ID}",
@@ -326,9 +387,11 @@ cat > "$OUTPUT_DIR/build-info.json" << EOF
   "flutter_channel": "${FLUTTER_CHANNEL}",
   "git_repo": "${GIT_REPO}",
   "git_branch": "${GIT_BRANCH}",
+  "git_commit": "$(git -C /workspace/repo rev-parse HEAD)",
   "build_folder": "${BUILD_FOLDER}",
   "timestamp": "$(date -u +%Y-%m-%dT%H:%M:%SZ)",
-  "flutter_version": "$(flutter --version | head -n 1)"
+  "flutter_version": "$(flutter --version | head -n 1)",
+  "artifacts": [${ARTIFACTS_JSON}]
 }
 EOF
 
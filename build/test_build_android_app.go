@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
 	"github.com/flotio-dev/api/pkg/kubernetes"
 	"github.com/joho/godotenv"
 )
@@ -37,7 +39,7 @@ func main() {
 	}
 
 	// Configure the build
-	buildConfig := kubernetes.BuildConfig{
+	buildConfig := executor.BuildConfig{
 		BuildID:        testBuildID,
 		Project:        testProject,
 		Platform:       "android",
@@ -60,9 +62,14 @@ func main() {
 	log.Printf("  Flutter Channel: %s\n", buildConfig.FlutterChannel)
 	log.Println()
 
+	buildExecutor, err := kubernetes.NewExecutor()
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes executor: %v", err)
+	}
+
 	// Create the Kubernetes pod
 	log.Println("Creating Kubernetes build pod...")
-	if err := kubernetes.CreateBuildPod(buildConfig); err != nil {
+	if err := buildExecutor.Start(context.Background(), buildConfig); err != nil {
 		log.Fatalf("Failed to create build pod: %v", err)
 	}
 	log.Printf("✓ Build pod created successfully: build-%d\n", testBuildID)
@@ -73,10 +80,10 @@ func main() {
 	log.Println("Press Ctrl+C to stop monitoring (build will continue in background)")
 	log.Println()
 
-	monitorPodStatus(testBuildID)
+	monitorPodStatus(buildExecutor, testBuildID)
 }
 
-func monitorPodStatus(buildID uint) {
+func monitorPodStatus(buildExecutor *kubernetes.Executor, buildID uint) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -86,11 +93,12 @@ func monitorPodStatus(buildID uint) {
 	for {
 		select {
 		case <-ticker.C:
-			status, err := kubernetes.GetPodStatus(buildID)
+			state, err := buildExecutor.Status(context.Background(), buildID)
 			if err != nil {
 				log.Printf("Error getting pod status: %v\n", err)
 				continue
 			}
+			status := state.Status
 
 			if status != lastStatus {
 				elapsed := time.Since(startTime).Round(time.Second)
@@ -98,18 +106,18 @@ func monitorPodStatus(buildID uint) {
 				lastStatus = status
 
 				// If pod completed or failed, show logs and exit
-				if status == "Succeeded" {
+				if status == db.BuildStatusSuccess {
 					log.Println()
 					log.Println("✓ Build completed successfully!")
 					log.Println()
-					showPodLogs(buildID)
-					showArtifacts(buildID)
+					showPodLogs(buildExecutor, buildID)
+					showArtifacts(buildExecutor, buildID)
 					return
-				} else if status == "Failed" {
+				} else if status == db.BuildStatusFailed {
 					log.Println()
 					log.Println("✗ Build failed!")
 					log.Println()
-					showPodLogs(buildID)
+					showPodLogs(buildExecutor, buildID)
 					os.Exit(1)
 				}
 			}
@@ -117,35 +125,35 @@ func monitorPodStatus(buildID uint) {
 	}
 }
 
-func showPodLogs(buildID uint) {
+func showPodLogs(buildExecutor *kubernetes.Executor, buildID uint) {
 	log.Println("Fetching pod logs...")
 	log.Println("-------------------------------------------")
 
-	logs, err := kubernetes.GetPodLogs(buildID)
+	logs, err := buildExecutor.Logs(context.Background(), buildID)
 	if err != nil {
 		log.Printf("Warning: Failed to get pod logs: %v\n", err)
 		return
 	}
 
 	for _, logLine := range logs {
-		fmt.Print(logLine)
+		fmt.Println(logLine.Content)
 	}
 
 	log.Println()
 	log.Println("-------------------------------------------")
 }
 
-func showArtifacts(buildID uint) {
+func showArtifacts(buildExecutor *kubernetes.Executor, buildID uint) {
 	log.Println("Build artifacts information:")
 
-	artifacts, err := kubernetes.GetBuildArtifacts(buildID)
+	artifacts, err := buildExecutor.Artifacts(context.Background(), buildID)
 	if err != nil {
 		log.Printf("Warning: Failed to get artifacts: %v\n", err)
 		return
 	}
 
-	for key, value := range artifacts {
-		log.Printf("  %s: %s\n", key, value)
+	for _, artifact := range artifacts {
+		log.Printf("  %s: %d bytes\n", artifact.Name, artifact.Size)
 	}
 	log.Println()
 }
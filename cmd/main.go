@@ -1,22 +1,108 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 
 	router "github.com/flotio-dev/api/pkg/api/v1/router"
+	"github.com/flotio-dev/api/pkg/artifacts"
+	"github.com/flotio-dev/api/pkg/checks"
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/events"
+	"github.com/flotio-dev/api/pkg/executor"
+	"github.com/flotio-dev/api/pkg/executor/fake"
+	"github.com/flotio-dev/api/pkg/executor/local"
+	"github.com/flotio-dev/api/pkg/kubernetes"
+	"github.com/flotio-dev/api/pkg/logs"
+	"github.com/flotio-dev/api/pkg/queue"
+	"github.com/flotio-dev/api/pkg/secrets"
+	"github.com/flotio-dev/api/pkg/storage"
+	"github.com/flotio-dev/api/pkg/webhooks"
 )
 
 func main() {
 	godotenv.Load()
 
+	// Secrets are never stored in plaintext
+	if err := secrets.Init(); err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+
 	db.InitDB()
 
+	// "server rotate-keys" re-wraps the stored secrets with the current key and exits
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		updated, err := db.RotateEncryptionKeys()
+		if err != nil {
+			log.Fatalf("Key rotation failed after %d values: %v", updated, err)
+		}
+		log.Printf("Key rotation complete, %d values updated", updated)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	buildExecutor, err := newBuildExecutor()
+	if err != nil {
+		log.Fatalf("Failed to create build executor: %v", err)
+	}
+	executor.SetDefault(buildExecutor)
+
+	// Background loop keeping build statuses in sync with the executor
+	if watcher, ok := buildExecutor.(executor.Watcher); ok {
+		go watcher.Watch(ctx)
+	}
+
+	// Background worker starting queued builds within the concurrency limits
+	go queue.InitDispatcher().Run(ctx)
+
+	// Background worker storing the output of every build
+	go logs.NewCollector(buildExecutor).Run(ctx)
+
+	// Background worker recording the artifacts of successful builds and
+	// copying them to object storage when configured
+	store, err := storage.Init(ctx)
+	if err == storage.ErrNotConfigured {
+		log.Println("Object storage not configured, artifacts are only available while build resources exist")
+	} else if err != nil {
+		log.Fatalf("Failed to initialize object storage: %v", err)
+	}
+	collector := artifacts.NewCollector(buildExecutor, store)
+	executor.OnFinished(func(buildID uint, status string) {
+		if status == db.BuildStatusSuccess {
+			collector.Notify()
+		}
+	})
+	go collector.Run(ctx)
+
+	// Background worker reporting the builds of commits to GitHub as Check Runs
+	reporter := checks.NewReporter()
+	executor.OnFinished(func(buildID uint, status string) {
+		reporter.Notify()
+	})
+	go reporter.Run(ctx)
+
+	// Background worker deleting expired build events
+	go events.Run(ctx)
+
+	// Background worker deleting expired webhook deliveries
+	go webhooks.Run(ctx)
+
+	// Finished builds free a slot for queued ones
+	executor.OnFinished(func(buildID uint, status string) {
+		queue.Notify()
+	})
+
 	log.Println("Starting Flotio API server")
 	r := router.Router()
 	log.Println("Router configured")
@@ -24,7 +110,7 @@ func main() {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "Last-Event-ID"},
 		AllowCredentials: true,
 	})
 
@@ -41,8 +127,30 @@ func main() {
 		Handler: handler,
 	}
 
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
 	log.Printf("Listening on %s", srv.Addr)
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("server failed: %v", err)
 	}
 }
+
+// newBuildExecutor creates the executor selected by BUILD_EXECUTOR
+// (kubernetes, local or fake; defaults to kubernetes)
+func newBuildExecutor() (executor.BuildExecutor, error) {
+	switch backend := os.Getenv("BUILD_EXECUTOR"); backend {
+	case "", "kubernetes":
+		return kubernetes.NewExecutor()
+	case "local":
+		return local.NewExecutor()
+	case "fake":
+		e := fake.NewExecutor()
+		e.AutoComplete = 10 * time.Second
+		return e, nil
+	default:
+		return nil, fmt.Errorf("unknown build executor %q", backend)
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/flotio-dev/api/pkg/artifacts"
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"github.com/flotio-dev/api/pkg/storage"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// BuildArtifactsHandler lists the files produced by a build
+func BuildArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	buildID, err := strconv.Atoi(vars["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	var build db.Build
+	if err := db.DB.Joins("JOIN projects ON builds.project_id = projects.id").Where("builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", buildID, projectID, *userInfo.Keycloak.Sub).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+
+	var list []db.BuildArtifact
+	if err := db.DB.Where("build_id = ?", build.ID).Order("id").Find(&list).Error; err != nil {
+		http.Error(w, "Failed to fetch artifacts", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{
+		"artifacts":        list,
+		"artifacts_status": build.ArtifactsStatus,
+	})
+}
+
+// BuildArtifactDownloadHandler serves one file produced by a build, like
+// BuildDownloadHandler does for the primary artifact
+func BuildArtifactDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	buildID, err := strconv.Atoi(vars["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+	artifactID, err := strconv.Atoi(vars["artifactId"])
+	if err != nil {
+		http.Error(w, "Invalid artifact ID", http.StatusBadRequest)
+		return
+	}
+
+	var artifact db.BuildArtifact
+	if err := db.DB.Joins("JOIN builds ON build_artifacts.build_id = builds.id").Joins("JOIN projects ON builds.project_id = projects.id").Where("build_artifacts.id = ? AND builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", artifactID, buildID, projectID, *userInfo.Keycloak.Sub).First(&artifact).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch artifact", http.StatusInternalServerError)
+		return
+	}
+
+	if artifact.StorageKey != "" {
+		serveStoredArtifact(w, r, artifact.StorageKey, artifact.Name)
+		return
+	}
+
+	serveExecutorArtifact(w, r, artifact.BuildID, artifact.Name, artifact.Size)
+}
+
+// serveStoredArtifact redirects to a short-lived presigned URL of an object,
+// or streams it through the API with ?mode=stream
+func serveStoredArtifact(w http.ResponseWriter, r *http.Request, key, name string) {
+	store := storage.Default()
+	if store == nil {
+		http.Error(w, "Object storage not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Query().Get("mode") == "stream" {
+		object, err := store.Open(r.Context(), key)
+		if err != nil {
+			http.Error(w, "Failed to open artifact", http.StatusInternalServerError)
+			return
+		}
+		defer object.Close()
+
+		writeArtifactHeaders(w, name, object.Size)
+		io.Copy(w, object)
+		return
+	}
+
+	url, err := store.PresignedURL(r.Context(), key, name)
+	if err != nil {
+		http.Error(w, "Failed to create download URL", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, url.String(), http.StatusFound)
+}
+
+// serveExecutorArtifact streams a file from the executor, available while
+// the build resources exist
+func serveExecutorArtifact(w http.ResponseWriter, r *http.Request, buildID uint, name string, size int64) {
+	reader, err := executor.Default().OpenArtifact(r.Context(), buildID, name)
+	if err != nil {
+		if err == executor.ErrNotFound || err == executor.ErrArtifactsUnavailable {
+			http.Error(w, "Artifact not available", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to open artifact", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	writeArtifactHeaders(w, name, size)
+	io.Copy(w, reader)
+}
+
+func writeArtifactHeaders(w http.ResponseWriter, name string, size int64) {
+	w.Header().Set("Content-Type", artifacts.ContentType(name))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+}
@@ -9,12 +9,14 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
 	"github.com/flotio-dev/api/pkg/db"
 	utils "github.com/flotio-dev/api/pkg/utils"
+	"gorm.io/gorm"
 )
 
 func getAdminToken(ctx context.Context, client *gocloak.GoCloak) (*gocloak.JWT, error) {
@@ -339,12 +341,22 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		user.GithubAccessToken = tokenResp.AccessToken
-		user.GithubRefreshToken = tokenResp.RefreshToken
+		user.GithubAccessToken = db.EncryptedString(tokenResp.AccessToken)
+		user.GithubRefreshToken = db.EncryptedString(tokenResp.RefreshToken)
+		// Links the installations of the GitHub account to the user
+		githubID, err := githubAccountID(tokenResp.AccessToken)
+		if err != nil {
+			fmt.Printf("Failed to fetch GitHub account: %v\n", err)
+		} else {
+			user.GithubID = &githubID
+		}
 		if err := db.DB.Save(&user).Error; err != nil {
 			http.Error(w, "Failed to save tokens", http.StatusInternalServerError)
 			return
 		}
+		if user.GithubID != nil {
+			linkUserInstallation(*user.GithubID)
+		}
 
 		utils.WriteJSON(w, map[string]string{"status": "connected"})
 
@@ -367,7 +379,7 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to create request", http.StatusInternalServerError)
 			return
 		}
-		req.Header.Set("Authorization", "token "+user.GithubAccessToken)
+		req.Header.Set("Authorization", "token "+string(user.GithubAccessToken))
 		req.Header.Set("Accept", "application/vnd.github.v3+json")
 
 		client := &http.Client{}
@@ -412,7 +424,7 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to create request", http.StatusInternalServerError)
 			return
 		}
-		req.Header.Set("Authorization", "token "+user.GithubAccessToken)
+		req.Header.Set("Authorization", "token "+string(user.GithubAccessToken))
 		req.Header.Set("Accept", "application/vnd.github.v3+json")
 
 		client := &http.Client{}
@@ -445,3 +457,50 @@ func GithubHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid action", http.StatusBadRequest)
 	}
 }
+
+// githubAccountID returns the ID of the GitHub account an OAuth token belongs to
+func githubAccountID(accessToken string) (string, error) {
+	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "token "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+
+	var account struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(account.ID, 10), nil
+}
+
+// linkUserInstallation links the installation of a GitHub user account,
+// recorded from the webhooks before the account was connected, to the user
+func linkUserInstallation(githubID string) {
+	var installation db.GithubInstallation
+	err := db.DB.Where("account_type = ? AND target_id = ? AND user_id IS NULL", "User", githubID).First(&installation).Error
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			fmt.Printf("Failed to fetch GitHub installation of account %s: %v\n", githubID, err)
+		}
+		return
+	}
+	if err := linkInstallationOwner(&installation); err != nil {
+		fmt.Printf("Failed to link installation %d: %v\n", installation.InstallationID, err)
+		return
+	}
+	if _, _, err := syncInstallationProjects(installation); err != nil {
+		fmt.Printf("Failed to update projects of installation %d: %v\n", installation.InstallationID, err)
+	}
+}
@@ -1,10 +1,18 @@
 package controller
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/dotenv"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 
@@ -12,7 +20,8 @@ import (
 	utils "github.com/flotio-dev/api/pkg/utils"
 )
 
-// Env handlers
+// EnvGetHandler lists the envs of a project, only those of one environment
+// with ?environment= ("" for the shared envs)
 func EnvGetHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := middleware.GetUserFromContext(r.Context())
 	if userInfo == nil {
@@ -27,14 +36,27 @@ func EnvGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	query := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub)
+	if values, ok := r.URL.Query()["environment"]; ok {
+		query = query.Where("envs.environment = ?", values[0])
+	}
+
 	var envs []db.Env
-	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).Find(&envs).Error; err != nil {
+	if err := query.Find(&envs).Error; err != nil {
 		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
 		return
 	}
 
 	utils.WriteJSON(w, map[string]interface{}{"envs": envs})
 }
+
+// EnvPostHandler creates a variable or a file. Variables and text files are
+// sent as JSON with "key", "value", "type", "path", "is_base64", "secret"
+// and "environment"; binary files as base64 in "value" with is_base64, or as
+// multipart/form-data with the content in "file". Files are written at
+// "path" in the project before the build. An env with an environment
+// overrides the shared env of the same key in the builds of that
+// environment.
 func EnvPostHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := middleware.GetUserFromContext(r.Context())
 	if userInfo == nil {
@@ -49,12 +71,8 @@ func EnvPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-	}
-	if err := utils.ReadJSON(r, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	req, ok := readEnvRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -71,11 +89,25 @@ func EnvPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	env := db.Env{
 		ProjectID: project.ID,
-		Key:       req.Key,
-		Value:     req.Value,
+		Type:      "env",
+	}
+	req.apply(&env)
+	if !validateEnv(w, &env) {
+		return
 	}
 
-	if err := db.DB.Create(&env).Error; err != nil {
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// Records the envs as they were before the first change
+		if _, err := db.CurrentEnvRevision(tx, env.ProjectID); err != nil {
+			return err
+		}
+		if err := tx.Create(&env).Error; err != nil {
+			return err
+		}
+		_, err := db.RecordEnvRevision(tx, env.ProjectID, userInfo.DB, db.EnvRevisionCreated, envSummary(env))
+		return err
+	})
+	if err != nil {
 		http.Error(w, "Failed to create env", http.StatusInternalServerError)
 		return
 	}
@@ -83,6 +115,41 @@ func EnvPostHandler(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, map[string]interface{}{"env": env})
 }
 
+// EnvironmentsGetHandler lists the environments the envs of a project are
+// scoped to
+func EnvironmentsGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var project db.Project
+	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	environments, err := projectEnvironments(project.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"environments": environments})
+}
+
 func EnvGetByIdHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := middleware.GetUserFromContext(r.Context())
 	if userInfo == nil {
@@ -116,6 +183,8 @@ func EnvGetByIdHandler(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, map[string]interface{}{"env": env})
 }
 
+// EnvPutByIdHandler updates the fields sent, as JSON or multipart/form-data
+// like EnvPostHandler
 func EnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := middleware.GetUserFromContext(r.Context())
 	if userInfo == nil {
@@ -136,12 +205,8 @@ func EnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-	}
-	if err := utils.ReadJSON(r, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	req, ok := readEnvRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -155,10 +220,22 @@ func EnvPutByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	env.Key = req.Key
-	env.Value = req.Value
+	req.apply(&env)
+	if !validateEnv(w, &env) {
+		return
+	}
 
-	if err := db.DB.Save(&env).Error; err != nil {
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := db.CurrentEnvRevision(tx, env.ProjectID); err != nil {
+			return err
+		}
+		if err := tx.Save(&env).Error; err != nil {
+			return err
+		}
+		_, err := db.RecordEnvRevision(tx, env.ProjectID, userInfo.DB, db.EnvRevisionUpdated, envSummary(env))
+		return err
+	})
+	if err != nil {
 		http.Error(w, "Failed to update env", http.StatusInternalServerError)
 		return
 	}
@@ -186,10 +263,874 @@ func EnvDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("envs.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", envID, projectID, *userInfo.Keycloak.Sub).Delete(&db.Env{}).Error; err != nil {
+	var env db.Env
+	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("envs.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", envID, projectID, *userInfo.Keycloak.Sub).First(&env).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Env not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch env", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := db.CurrentEnvRevision(tx, env.ProjectID); err != nil {
+			return err
+		}
+		if err := tx.Delete(&env).Error; err != nil {
+			return err
+		}
+		_, err := db.RecordEnvRevision(tx, env.ProjectID, userInfo.DB, db.EnvRevisionDeleted, envSummary(env))
+		return err
+	})
+	if err != nil {
 		http.Error(w, "Failed to delete env", http.StatusInternalServerError)
 		return
 	}
 
 	utils.WriteJSON(w, map[string]string{"status": "deleted"})
 }
+
+// EnvImportHandler imports variables and files in bulk into one environment
+// (?environment=, the shared envs by default), from a .env file
+// (?format=dotenv, variables only) or a JSON document {"envs": [...]} with
+// the fields of EnvPostHandler (?format=json, the default for a JSON body).
+// In "merge" mode (the default) existing envs are updated and the others
+// kept; in "replace" mode the envs of the environment missing from the
+// document are deleted, only the variables for a .env file. Envs keep their
+// secret flag unless the document sets it. With ?dry_run=true the changes
+// are returned without being applied.
+func EnvImportHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "dotenv"
+		if strings.Contains(r.Header.Get("Content-Type"), "json") {
+			format = "json"
+		}
+	}
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, `mode must be "merge" or "replace"`, http.StatusBadRequest)
+		return
+	}
+	environment := query.Get("environment")
+	if environment != "" && !environmentPattern.MatchString(environment) {
+		http.Error(w, "Invalid environment", http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if raw := query.Get("dry_run"); raw != "" {
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Verify project ownership
+	var project db.Project
+	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	entries, ok := readEnvDocument(w, r, format)
+	if !ok {
+		return
+	}
+
+	var existing []db.Env
+	if err := db.DB.Where("project_id = ? AND environment = ?", project.ID, environment).Order("id").Find(&existing).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	current := make(map[string]*db.Env)
+	for i := range existing {
+		current[existing[i].Type+":"+existing[i].Key] = &existing[i]
+	}
+
+	var created, updated, deleted []db.Env
+	var unchanged []envChange
+	imported := make(map[string]bool)
+	importedTypes := make(map[string]bool)
+	for _, entry := range entries {
+		env := db.Env{
+			ProjectID:   project.ID,
+			Key:         entry.Key,
+			Value:       db.EncryptedString(entry.Value),
+			Type:        entry.Type,
+			Path:        entry.Path,
+			IsBase64:    entry.IsBase64,
+			Environment: environment,
+		}
+		if env.Type == "" {
+			env.Type = "env"
+		}
+		if err := checkEnv(&env); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := env.Type + ":" + env.Key
+		if imported[id] {
+			http.Error(w, "Duplicate key "+env.Key, http.StatusBadRequest)
+			return
+		}
+		imported[id] = true
+		importedTypes[env.Type] = true
+
+		old, found := current[id]
+		if !found {
+			env.Secret = entry.Secret != nil && *entry.Secret
+			created = append(created, env)
+			continue
+		}
+		next := *old
+		next.Value, next.Path, next.IsBase64 = env.Value, env.Path, env.IsBase64
+		if entry.Secret != nil {
+			next.Secret = *entry.Secret
+		}
+		if next.Value == old.Value && next.Path == old.Path && next.IsBase64 == old.IsBase64 && next.Secret == old.Secret {
+			unchanged = append(unchanged, envChange{Key: env.Key, Type: env.Type})
+			continue
+		}
+		updated = append(updated, next)
+	}
+
+	// A .env file only holds variables, replacing with it keeps the files
+	if mode == "replace" {
+		for i := range existing {
+			env := existing[i]
+			if !imported[env.Type+":"+env.Key] && (format == "json" || env.Type == "env") {
+				deleted = append(deleted, env)
+			}
+		}
+	}
+
+	// The files of the other environments and those of this one once imported
+	var files []db.Env
+	if err := db.DB.Where("project_id = ? AND type = ? AND environment <> ?", project.ID, "file", environment).Find(&files).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+	replaced := make(map[uint]*db.Env) // nil when deleted
+	for i := range updated {
+		replaced[updated[i].ID] = &updated[i]
+	}
+	for _, env := range deleted {
+		replaced[env.ID] = nil
+	}
+	for _, env := range append(existing, created...) {
+		if replacement, found := replaced[env.ID]; found && env.ID != 0 {
+			if replacement == nil {
+				continue
+			}
+			env = *replacement
+		}
+		if env.Type == "file" {
+			files = append(files, env)
+		}
+	}
+	if !checkEnvFilesSize(w, files) {
+		return
+	}
+
+	if !dryRun && len(created)+len(updated)+len(deleted) > 0 {
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			if _, err := db.CurrentEnvRevision(tx, project.ID); err != nil {
+				return err
+			}
+			for i := range created {
+				if err := tx.Create(&created[i]).Error; err != nil {
+					return err
+				}
+			}
+			for i := range updated {
+				if err := tx.Save(&updated[i]).Error; err != nil {
+					return err
+				}
+			}
+			for _, env := range deleted {
+				if err := tx.Delete(&db.Env{}, env.ID).Error; err != nil {
+					return err
+				}
+			}
+			summary := fmt.Sprintf("%d created, %d updated, %d deleted", len(created), len(updated), len(deleted))
+			if environment != "" {
+				summary += " (" + environment + ")"
+			}
+			_, err := db.RecordEnvRevision(tx, project.ID, userInfo.DB, db.EnvRevisionImported, summary)
+			return err
+		})
+		if err != nil {
+			http.Error(w, "Failed to import envs", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{
+		"dry_run":     dryRun,
+		"mode":        mode,
+		"environment": environment,
+		"created":     envChanges(created),
+		"updated":     envChanges(updated),
+		"deleted":     envChanges(deleted),
+		"unchanged":   append([]envChange{}, unchanged...),
+	})
+}
+
+// EnvExportHandler exports the envs of one environment (?environment=, the
+// shared envs by default) as a .env file (?format=dotenv, variables only) or
+// as the JSON document EnvImportHandler reads (?format=json, the default).
+// Secrets are left out with ?omit_secrets=true.
+func EnvExportHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "dotenv" {
+		http.Error(w, `format must be "dotenv" or "json"`, http.StatusBadRequest)
+		return
+	}
+	omitSecrets := false
+	if raw := query.Get("omit_secrets"); raw != "" {
+		if omitSecrets, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "Invalid omit_secrets value", http.StatusBadRequest)
+			return
+		}
+	}
+	environment := query.Get("environment")
+
+	var envs []db.Env
+	if err := db.DB.Joins("JOIN projects ON envs.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?) AND envs.environment = ?", projectID, *userInfo.Keycloak.Sub, environment).Order("envs.key").Find(&envs).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return
+	}
+
+	name := "env"
+	if environment != "" {
+		name = environment
+	}
+
+	if format == "json" {
+		entries := []envDocumentEntry{}
+		for _, env := range envs {
+			if env.Secret && omitSecrets {
+				continue
+			}
+			secret := env.Secret
+			entries = append(entries, envDocumentEntry{
+				Key:      env.Key,
+				Value:    string(env.Value),
+				Type:     env.Type,
+				Path:     env.Path,
+				IsBase64: env.IsBase64,
+				Secret:   &secret,
+			})
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+		utils.WriteJSON(w, map[string]interface{}{"envs": entries})
+		return
+	}
+
+	var variables []dotenv.Var
+	var omitted []string
+	for _, env := range envs {
+		if env.Type != "env" {
+			continue
+		}
+		if !dotenv.ValidKey(env.Key) {
+			http.Error(w, fmt.Sprintf("%s cannot be written in a .env file, export as JSON", env.Key), http.StatusBadRequest)
+			return
+		}
+		if env.Secret && omitSecrets {
+			omitted = append(omitted, env.Key)
+			continue
+		}
+		variables = append(variables, dotenv.Var{Key: env.Key, Value: string(env.Value)})
+	}
+
+	var body strings.Builder
+	if err := dotenv.Write(&body, variables); err != nil {
+		http.Error(w, "Failed to export envs", http.StatusInternalServerError)
+		return
+	}
+	for _, key := range omitted {
+		fmt.Fprintf(&body, "# %s: secret omitted\n", key)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".env"))
+	io.WriteString(w, body.String())
+}
+
+// EnvRevisionsGetHandler lists the env revisions of a project, latest first
+func EnvRevisionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var revisions []db.EnvRevision
+	if err := db.DB.Joins("JOIN projects ON env_revisions.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).Order("env_revisions.number DESC").Find(&revisions).Error; err != nil {
+		http.Error(w, "Failed to fetch env revisions", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"revisions": revisions})
+}
+
+// EnvRevisionGetHandler returns a revision, the envs it recorded and what
+// changed since the previous revision, or since the revision in ?compare=
+// (e.g. the env_revision of another build)
+func EnvRevisionGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	revision, ok := findEnvRevision(w, r, userInfo)
+	if !ok {
+		return
+	}
+	envs, err := revision.Envs()
+	if err != nil {
+		http.Error(w, "Failed to read env revision", http.StatusInternalServerError)
+		return
+	}
+
+	compare := revision.Number - 1
+	if raw := r.URL.Query().Get("compare"); raw != "" {
+		if compare, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, "Invalid compare revision", http.StatusBadRequest)
+			return
+		}
+	}
+	var previous []db.Env
+	if compare > 0 {
+		if previous, err = db.RevisionEnvs(revision.ProjectID, compare); err != nil {
+			http.Error(w, "Compared revision not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{
+		"revision": revision,
+		"envs":     envs,
+		"compare":  compare,
+		"changes":  diffEnvs(previous, envs),
+	})
+}
+
+// EnvRevisionRestoreHandler restores the envs of a project as they were in a
+// revision. The restore is itself recorded as a new revision.
+func EnvRevisionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	revision, ok := findEnvRevision(w, r, userInfo)
+	if !ok {
+		return
+	}
+	envs, err := revision.Envs()
+	if err != nil {
+		http.Error(w, "Failed to read env revision", http.StatusInternalServerError)
+		return
+	}
+
+	var restored *db.EnvRevision
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var current []db.Env
+		if err := tx.Where("project_id = ?", revision.ProjectID).Find(&current).Error; err != nil {
+			return err
+		}
+		currentByIdentity := make(map[string]db.Env)
+		for _, env := range current {
+			currentByIdentity[envIdentity(env)] = env
+		}
+
+		kept := make(map[uint]bool)
+		for _, env := range envs {
+			existing, found := currentByIdentity[envIdentity(env)]
+			if !found {
+				env.ID = 0
+				if err := tx.Create(&env).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			kept[existing.ID] = true
+			if sameEnv(existing, env) {
+				continue
+			}
+			existing.Value, existing.Path, existing.IsBase64, existing.Secret = env.Value, env.Path, env.IsBase64, env.Secret
+			if err := tx.Save(&existing).Error; err != nil {
+				return err
+			}
+		}
+		for _, env := range current {
+			if !kept[env.ID] {
+				if err := tx.Delete(&env).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		var err error
+		restored, err = db.RecordEnvRevision(tx, revision.ProjectID, userInfo.DB, db.EnvRevisionRestored, fmt.Sprintf("revision %d", revision.Number))
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Failed to restore env revision", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"revision": restored})
+}
+
+// maxEnvRequestSize bounds env requests, leaving room for the base64
+// encoding of the files and the multipart framing
+const maxEnvRequestSize = 2 * db.MaxEnvFilesSize
+
+// environmentPattern restricts environment names to slugs
+var environmentPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// envFileKeyPattern restricts file keys to names build.sh can copy as is
+var envFileKeyPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// envDocumentEntry is an env of the JSON documents of EnvImportHandler and
+// EnvExportHandler
+type envDocumentEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Type     string `json:"type,omitempty"`
+	Path     string `json:"path,omitempty"`
+	IsBase64 bool   `json:"is_base64,omitempty"`
+	Secret   *bool  `json:"secret,omitempty"`
+}
+
+// envChange identifies an env in an import result, without its value
+type envChange struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+func envChanges(envs []db.Env) []envChange {
+	changes := make([]envChange, len(envs))
+	for i, env := range envs {
+		changes[i] = envChange{Key: env.Key, Type: env.Type}
+	}
+	return changes
+}
+
+// readEnvDocument reads the envs of an import body
+func readEnvDocument(w http.ResponseWriter, r *http.Request, format string) ([]envDocumentEntry, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxEnvRequestSize)
+
+	var entries []envDocumentEntry
+	var err error
+	switch format {
+	case "json":
+		var document struct {
+			Envs []envDocumentEntry `json:"envs"`
+		}
+		err = utils.ReadJSON(r, &document)
+		entries = document.Envs
+	case "dotenv":
+		var variables []dotenv.Var
+		variables, err = dotenv.Parse(r.Body)
+		for _, variable := range variables {
+			entries = append(entries, envDocumentEntry{Key: variable.Key, Value: variable.Value, Type: "env"})
+		}
+	default:
+		http.Error(w, `format must be "dotenv" or "json"`, http.StatusBadRequest)
+		return nil, false
+	}
+
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, "Invalid document: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return entries, true
+}
+
+// envRequest holds the fields of an env request, nil when not sent
+type envRequest struct {
+	Key         *string `json:"key"`
+	Value       *string `json:"value"`
+	Type        *string `json:"type"`
+	Path        *string `json:"path"`
+	IsBase64    *bool   `json:"is_base64"`
+	Secret      *bool   `json:"secret"`
+	Environment *string `json:"environment"`
+}
+
+// readEnvRequest reads a JSON or multipart env request. An uploaded "file"
+// makes a file env, stored as base64, named after the file unless a key is
+// sent.
+func readEnvRequest(w http.ResponseWriter, r *http.Request) (*envRequest, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxEnvRequestSize)
+
+	var req envRequest
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := utils.ReadJSON(r, &req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+				return nil, false
+			}
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return nil, false
+		}
+		return &req, true
+	}
+
+	if err := r.ParseMultipartForm(db.MaxEnvFilesSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return nil, false
+	}
+
+	for field, dest := range map[string]**string{"key": &req.Key, "value": &req.Value, "type": &req.Type, "path": &req.Path, "environment": &req.Environment} {
+		if value, set := formValue(r, field); set {
+			*dest = &value
+		}
+	}
+	for field, dest := range map[string]**bool{"is_base64": &req.IsBase64, "secret": &req.Secret} {
+		value, set, err := formBool(r, field)
+		if err != nil {
+			http.Error(w, "Invalid "+field+" value", http.StatusBadRequest)
+			return nil, false
+		}
+		if set {
+			*dest = &value
+		}
+	}
+
+	file, header, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		return &req, true
+	}
+	if err != nil {
+		http.Error(w, "Invalid file", http.StatusBadRequest)
+		return nil, false
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, db.MaxEnvFilesSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(content) > db.MaxEnvFilesSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	value := base64.StdEncoding.EncodeToString(content)
+	fileType := "file"
+	isBase64 := true
+	req.Value, req.Type, req.IsBase64 = &value, &fileType, &isBase64
+	if req.Key == nil {
+		name := filepath.Base(header.Filename)
+		req.Key = &name
+	}
+	return &req, true
+}
+
+// apply copies the fields sent to env. Turning a file back into a variable
+// drops its path.
+func (req *envRequest) apply(env *db.Env) {
+	if req.Type != nil && *req.Type != env.Type {
+		env.Type = *req.Type
+		if env.Type == "env" {
+			env.Path = ""
+			env.IsBase64 = false
+		}
+	}
+	if req.Key != nil {
+		env.Key = *req.Key
+	}
+	if req.Value != nil {
+		env.Value = db.EncryptedString(*req.Value)
+	}
+	if req.Path != nil {
+		env.Path = *req.Path
+	}
+	if req.IsBase64 != nil {
+		env.IsBase64 = *req.IsBase64
+	}
+	if req.Secret != nil {
+		env.Secret = *req.Secret
+	}
+	if req.Environment != nil {
+		env.Environment = *req.Environment
+	}
+}
+
+// validateEnv checks an env before it is saved: its fields, that its key is
+// unique per type and environment, and that files fit with the other files
+// of their builds in the build ConfigMap
+func validateEnv(w http.ResponseWriter, env *db.Env) bool {
+	if err := checkEnv(env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	var duplicates int64
+	if err := db.DB.Model(&db.Env{}).Where("project_id = ? AND type = ? AND key = ? AND environment = ? AND id <> ?", env.ProjectID, env.Type, env.Key, env.Environment, env.ID).Count(&duplicates).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return false
+	}
+	if duplicates > 0 {
+		http.Error(w, "An env with this key already exists in this environment", http.StatusConflict)
+		return false
+	}
+
+	if env.Type == "env" {
+		return true
+	}
+
+	var files []db.Env
+	if err := db.DB.Where("project_id = ? AND type = ? AND id <> ?", env.ProjectID, "file", env.ID).Find(&files).Error; err != nil {
+		http.Error(w, "Failed to fetch envs", http.StatusInternalServerError)
+		return false
+	}
+	return checkEnvFilesSize(w, append(files, *env))
+}
+
+// checkEnv checks the fields of an env: files must have a key build.sh can
+// use as a file name and a path inside the project
+func checkEnv(env *db.Env) error {
+	if env.Key == "" {
+		return errors.New("key is required")
+	}
+	if env.Environment != "" && !environmentPattern.MatchString(env.Environment) {
+		return errors.New("environment names may only contain lowercase letters, digits, '_' and '-'")
+	}
+
+	switch env.Type {
+	case "env":
+		if env.Path != "" || env.IsBase64 {
+			return errors.New("path and is_base64 only apply to file envs")
+		}
+		return nil
+	case "file":
+	default:
+		return errors.New(`type must be "env" or "file"`)
+	}
+
+	if !envFileKeyPattern.MatchString(env.Key) || env.Key == "." || env.Key == ".." {
+		return errors.New("file keys may only contain letters, digits, '.', '_' and '-'")
+	}
+	if err := validateEnvFilePath(env.Path); err != nil {
+		return fmt.Errorf("invalid path for %s: %v", env.Key, err)
+	}
+	if _, err := env.FileContent(); err != nil {
+		return fmt.Errorf("invalid base64 content for %s", env.Key)
+	}
+	return nil
+}
+
+// checkEnvFilesSize checks that the files of a project fit in the build
+// ConfigMap, adding the shared files to those of each environment (overridden
+// shared files count too)
+func checkEnvFilesSize(w http.ResponseWriter, files []db.Env) bool {
+	sizes := map[string]int{"": 0}
+	for _, file := range files {
+		content, err := file.FileContent()
+		if err != nil {
+			http.Error(w, "Failed to read envs", http.StatusInternalServerError)
+			return false
+		}
+		sizes[file.Environment] += len(content)
+	}
+
+	size := 0
+	for environment, environmentSize := range sizes {
+		if environment != "" {
+			environmentSize += sizes[""]
+		}
+		size = max(size, environmentSize)
+	}
+	if size > db.MaxEnvFilesSize {
+		http.Error(w, fmt.Sprintf("The files of a project cannot exceed %d bytes in total", db.MaxEnvFilesSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// validateEnvFilePath checks the target path of a file, relative to the
+// project root. An empty path places the file at the root under its key.
+func validateEnvFilePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	if strings.HasPrefix(p, "/") {
+		return errors.New("must be relative to the project")
+	}
+	for _, c := range p {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return errors.New("contains a control character or a backslash")
+		}
+	}
+	for _, part := range strings.Split(p, "/") {
+		switch part {
+		case "", ".":
+			return errors.New("must be clean, without empty or '.' segments")
+		case "..":
+			return errors.New("must stay inside the project")
+		}
+	}
+	// build.sh decodes "__" as a directory separator
+	if strings.Contains(p, "__") {
+		return errors.New(`cannot contain "__"`)
+	}
+	return nil
+}
+
+// findEnvRevision returns the revision of the request path, or writes the
+// error response when it is not accessible
+func findEnvRevision(w http.ResponseWriter, r *http.Request, userInfo *middleware.UserContext) (db.EnvRevision, bool) {
+	var revision db.EnvRevision
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return revision, false
+	}
+
+	number, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return revision, false
+	}
+
+	if err := db.DB.Joins("JOIN projects ON env_revisions.project_id = projects.id").Where("env_revisions.number = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", number, projectID, *userInfo.Keycloak.Sub).First(&revision).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Env revision not found", http.StatusNotFound)
+			return revision, false
+		}
+		http.Error(w, "Failed to fetch env revision", http.StatusInternalServerError)
+		return revision, false
+	}
+	return revision, true
+}
+
+// envIdentity identifies an env across revisions: keys are unique per type
+// and environment
+func envIdentity(env db.Env) string {
+	return env.Type + ":" + env.Environment + ":" + env.Key
+}
+
+// sameEnv reports whether two versions of an env are identical
+func sameEnv(a, b db.Env) bool {
+	return a.Value == b.Value && a.Path == b.Path && a.IsBase64 == b.IsBase64 && a.Secret == b.Secret
+}
+
+// envRevisionChange is a difference between two revisions, without values
+type envRevisionChange struct {
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Environment string `json:"environment"`
+	Change      string `json:"change"` // added, changed, removed
+}
+
+// diffEnvs lists the envs added, changed and removed from before to after
+func diffEnvs(before, after []db.Env) []envRevisionChange {
+	changes := []envRevisionChange{}
+	previous := make(map[string]db.Env)
+	for _, env := range before {
+		previous[envIdentity(env)] = env
+	}
+
+	for _, env := range after {
+		old, found := previous[envIdentity(env)]
+		delete(previous, envIdentity(env))
+		change := "added"
+		if found {
+			if sameEnv(old, env) {
+				continue
+			}
+			change = "changed"
+		}
+		changes = append(changes, envRevisionChange{Key: env.Key, Type: env.Type, Environment: env.Environment, Change: change})
+	}
+	for _, env := range before {
+		if _, removed := previous[envIdentity(env)]; removed {
+			changes = append(changes, envRevisionChange{Key: env.Key, Type: env.Type, Environment: env.Environment, Change: "removed"})
+		}
+	}
+	return changes
+}
+
+// envSummary describes an env in revisions, e.g. "API_URL (production)"
+func envSummary(env db.Env) string {
+	if env.Environment == "" {
+		return env.Key
+	}
+	return env.Key + " (" + env.Environment + ")"
+}
+
+// projectEnvironments returns the names of the environments of a project
+func projectEnvironments(projectID uint) ([]string, error) {
+	environments := []string{}
+	err := db.DB.Model(&db.Env{}).Where("project_id = ? AND environment <> ?", projectID, "").Distinct().Order("environment").Pluck("environment", &environments).Error
+	return environments, err
+}
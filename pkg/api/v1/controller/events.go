@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/events"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+)
+
+const (
+	// eventsPollInterval is how often a stream looks for events recorded by another API replica
+	eventsPollInterval = 2 * time.Second
+
+	// eventsHeartbeat keeps idle streams open through proxies
+	eventsHeartbeat = 15 * time.Second
+
+	// eventsBatchSize bounds how many events are read at once
+	eventsBatchSize = 500
+)
+
+// ProjectEventsHandler streams the build lifecycle events of a project as
+// Server-Sent Events
+func ProjectEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var project db.Project
+	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	streamEvents(w, r, "project_id = ?", project.ID)
+}
+
+// UserEventsHandler streams the build lifecycle events of every project of
+// the user as Server-Sent Events
+func UserEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	streamEvents(w, r, "user_id = ?", userInfo.DB.ID)
+}
+
+// streamEvents sends the events matching filter until the client goes away.
+// Clients resume after the ID in the Last-Event-ID header, which browsers
+// send when reconnecting, or the last_event_id query parameter; otherwise
+// only new events are sent.
+func streamEvents(w http.ResponseWriter, r *http.Request, filter string, value interface{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastID uint
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID = uint(id)
+	} else {
+		id, err := events.LastID()
+		if err != nil {
+			http.Error(w, "Failed to fetch events", http.StatusInternalServerError)
+			return
+		}
+		lastID = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // disable nginx buffering
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	poll := time.NewTicker(eventsPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		// Wait on the channel taken before reading, so no event is missed
+		changed := events.Changed()
+
+		for {
+			list, err := events.Since(lastID, filter, value, eventsBatchSize)
+			if err != nil {
+				fmt.Printf("Failed to fetch build events: %v\n", err)
+				return
+			}
+
+			for _, event := range list {
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+				lastID = event.ID
+			}
+			if len(list) > 0 {
+				flusher.Flush()
+			}
+			if len(list) < eventsBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-poll.C:
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
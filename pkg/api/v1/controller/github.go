@@ -7,15 +7,20 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/google/go-github/v76/github"
 	"golang.org/x/oauth2"
 	githubOAuth "golang.org/x/oauth2/github"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 
 	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	"github.com/flotio-dev/api/pkg/checks"
 	db "github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/githubapp"
+	utils "github.com/flotio-dev/api/pkg/utils"
+	"github.com/flotio-dev/api/pkg/webhooks"
 
 	"context"
 
@@ -40,13 +45,10 @@ func NewGithubController(secret []byte) *GithubController {
 	}
 }
 
+// HandleWebhook records a GitHub webhook delivery and processes it. A
+// redelivery of a processed delivery is acknowledged without processing it
+// again; a failed one is processed again.
 func (c *GithubController) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	// userInfo := middleware.GetUserFromContext(r.Context())
-	// if userInfo == nil {
-	// 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	// 	return
-	// }
-
 	payload, err := github.ValidatePayload(r, c.webhookSecretKey)
 	if err != nil {
 		http.Error(w, "invalid payload", http.StatusBadRequest)
@@ -54,61 +56,234 @@ func (c *GithubController) HandleWebhook(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	deliveryID := github.DeliveryID(r)
+	if deliveryID == "" {
+		http.Error(w, "missing delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	delivery, claimed, err := webhooks.Record(deliveryID, github.WebHookType(r), payload)
 	if err != nil {
-		http.Error(w, "cannot parse webhook", http.StatusBadRequest)
-		fmt.Println("cannot parse webhook")
+		fmt.Printf("Failed to record webhook delivery %s: %v\n", deliveryID, err)
+		http.Error(w, "Failed to record delivery", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		fmt.Printf("Webhook delivery %s already %s\n", deliveryID, delivery.Status)
+		utils.WriteJSON(w, map[string]string{"status": delivery.Status})
 		return
 	}
 
-	fmt.Printf("Webhook type: %s\n", github.WebHookType(r))
-	fmt.Printf("Event type (Go): %T\n", event)
+	processDelivery(&delivery)
+	if delivery.Status == db.WebhookDeliveryFailed {
+		http.Error(w, "Failed to process delivery", http.StatusInternalServerError)
+		return
+	}
+	utils.WriteJSON(w, map[string]string{"status": delivery.Status, "result": delivery.Result})
+}
+
+// processDelivery processes a claimed delivery and records its outcome
+func processDelivery(delivery *db.WebhookDelivery) {
+	result, err := processWebhook(delivery)
+	if err != nil {
+		fmt.Printf("Webhook delivery %s (%s): %v\n", delivery.DeliveryID, delivery.Event, err)
+	}
+	webhooks.Finish(delivery, result, err)
+}
+
+// processWebhook applies a webhook event, returning what it did
+func processWebhook(delivery *db.WebhookDelivery) (string, error) {
+	event, err := github.ParseWebHook(delivery.Event, []byte(delivery.Payload))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse webhook: %v", err)
+	}
 
 	switch e := event.(type) {
 	case *github.InstallationEvent:
-		handleInstallation(
-			e.GetAction(),
-			e.GetInstallation().GetID(),
-			e.GetInstallation().GetTargetID(),
-			e.GetInstallation().GetAccount().GetLogin(),
-			e.GetInstallation().GetAccount().GetType(),
-		)
+		return handleInstallation(e)
 	case *github.InstallationRepositoriesEvent:
-		handleInstallation(
-			e.GetAction(),
-			e.GetInstallation().GetID(),
-			e.GetInstallation().GetTargetID(),
-			e.GetInstallation().GetAccount().GetLogin(),
-			e.GetInstallation().GetAccount().GetType(),
-		)
+		return handleInstallationRepositories(e)
+	case *github.PushEvent:
+		return handlePush(delivery.DeliveryID, e)
+	case *github.PullRequestEvent:
+		return handlePullRequest(delivery.DeliveryID, e)
+	case *github.CheckRunEvent:
+		return handleCheckRun(delivery.DeliveryID, e)
 	default:
-		fmt.Println("Unhandled event")
+		return "unhandled event", nil
 	}
 }
 
-func handleInstallation(action string, installationID, targetID int64, accountLogin, accountType string) {
-	fmt.Printf("Installation: ID=%d, Account=%s, Type=%s, TargetID=%d, Action=%s\n",
-		installationID, accountLogin, accountType, targetID, action)
+// maxPushCommits is the number of commits GitHub lists at most in a push
+// event, the changed files of larger pushes are unknown
+const maxPushCommits = 2048
 
-	switch action {
-	case "created", "added", "removed":
+// maxPullRequestFiles is the number of files GitHub lists at most for a pull
+// request
+const maxPullRequestFiles = 3000
 
-		installation := db.GithubInstallation{
-			InstallationID: installationID,
-			AccountLogin:   accountLogin,
-			AccountType:    accountType,
-			TargetID:       targetID,
-		}
+// handlePush triggers the builds of a branch or tag push. Branch deletions
+// build nothing.
+func handlePush(deliveryID string, e *github.PushEvent) (string, error) {
+	if e.GetDeleted() {
+		return "branch deleted", nil
+	}
 
-		if err := db.DB.Clauses(clause.OnConflict{
-			Columns:   []clause.Column{{Name: "installation_id"}},
-			UpdateAll: true,
-		}).Create(&installation).Error; err != nil {
-			fmt.Printf("DB insertion error GithubInstallation: %v\n", err)
+	change := repoChange{Delivery: deliveryID, CommitSHA: e.GetAfter()}
+	ref := e.GetRef()
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		change.Event = db.TriggerEventPush
+		change.Ref = strings.TrimPrefix(ref, "refs/heads/")
+		change.Files = func() ([]string, bool) {
+			if len(e.Commits) == 0 || len(e.Commits) >= maxPushCommits {
+				return nil, false
+			}
+			var files []string
+			for _, commit := range e.Commits {
+				files = append(files, commit.Added...)
+				files = append(files, commit.Removed...)
+				files = append(files, commit.Modified...)
+			}
+			return files, true
 		}
+	case strings.HasPrefix(ref, "refs/tags/"):
+		change.Event = db.TriggerEventTag
+		change.Ref = strings.TrimPrefix(ref, "refs/tags/")
+	default:
+		return "unhandled ref " + ref, nil
+	}
+	change.Branch = change.Ref
 
+	return triggerBuilds(e.GetInstallation().GetID(), e.GetRepo().GetFullName(), change)
+}
+
+// handlePullRequest triggers the builds of a pull request. Pull requests
+// from forks build nothing: their code must not run with the project
+// secrets.
+func handlePullRequest(deliveryID string, e *github.PullRequestEvent) (string, error) {
+	pr := e.GetPullRequest()
+	base, head := pr.GetBase().GetRepo(), pr.GetHead().GetRepo()
+	if !strings.EqualFold(head.GetFullName(), base.GetFullName()) {
+		return fmt.Sprintf("pull request from fork %s ignored", head.GetFullName()), nil
+	}
+
+	installationID := e.GetInstallation().GetID()
+	change := repoChange{
+		Delivery:    deliveryID,
+		Event:       db.TriggerEventPullRequest,
+		Ref:         pr.GetBase().GetRef(),
+		Action:      e.GetAction(),
+		Branch:      pr.GetHead().GetRef(),
+		CommitSHA:   pr.GetHead().GetSHA(),
+		PullRequest: pr.GetNumber(),
+		Files: sync.OnceValues(func() ([]string, bool) {
+			files, err := pullRequestFiles(installationID, base.GetOwner().GetLogin(), base.GetName(), pr.GetNumber())
+			if err != nil {
+				fmt.Printf("Failed to list files of pull request %s#%d: %v\n", base.GetFullName(), pr.GetNumber(), err)
+				return nil, false
+			}
+			return files, len(files) < maxPullRequestFiles
+		}),
+	}
+
+	return triggerBuilds(installationID, base.GetFullName(), change)
+}
+
+// handleCheckRun builds the commit of a Check Run again when its Re-run
+// button, or the re-run link of GitHub, is used
+func handleCheckRun(deliveryID string, e *github.CheckRunEvent) (string, error) {
+	switch e.GetAction() {
+	case "rerequested":
+	case "requested_action":
+		if e.RequestedAction == nil || e.RequestedAction.Identifier != checks.RerunAction {
+			return "unhandled requested action", nil
+		}
 	default:
-		fmt.Println("Unhandled event action")
+		return "unhandled action " + e.GetAction(), nil
+	}
+
+	run := e.GetCheckRun()
+	buildID, err := strconv.ParseUint(run.GetExternalID(), 10, 64)
+	if err != nil {
+		return fmt.Sprintf("check run %d has no build ID, re-run ignored", run.GetID()), nil
+	}
+
+	var build db.Build
+	if err := db.DB.Preload("Project").Where("id = ? AND check_run_id = ?", buildID, run.GetID()).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fmt.Sprintf("build %d of check run %d not found, re-run ignored", buildID, run.GetID()), nil
+		}
+		return "", err
+	}
+
+	if !build.Project.Buildable() {
+		return fmt.Sprintf("project %d is disabled, re-run ignored", build.ProjectID), nil
+	}
+
+	// Only the installation of the project owner may start its builds
+	installation, err := db.ProjectInstallation(build.Project)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return "", err
+	}
+	if installation == nil || installation.InstallationID != e.GetInstallation().GetID() {
+		return fmt.Sprintf("build %d is not accessible to installation %d, re-run ignored", build.ID, e.GetInstallation().GetID()), nil
+	}
+
+	// A replayed delivery may have queued the build already
+	var retry db.Build
+	err = db.DB.Where("webhook_delivery = ?", deliveryID).First(&retry).Error
+	if err == nil {
+		return fmt.Sprintf("build %d already queued", retry.ID), nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return "", err
+	}
+
+	retry = db.Build{
+		ProjectID:       build.ProjectID,
+		Platform:        build.Platform,
+		BuildMode:       build.BuildMode,
+		BuildTarget:     build.BuildTarget,
+		FlutterChannel:  build.FlutterChannel,
+		GitBranch:       build.GitBranch,
+		CommitSHA:       build.CommitSHA,
+		PullRequest:     build.PullRequest,
+		TriggerID:       build.TriggerID,
+		WebhookDelivery: deliveryID,
+		Environment:     build.Environment,
+	}
+	if err := enqueueBuild(&retry); err != nil {
+		return "", fmt.Errorf("failed to create build: %v", err)
+	}
+	return fmt.Sprintf("queued build %d to re-run build %d", retry.ID, build.ID), nil
+}
+
+// pullRequestFiles lists the files a pull request changes, with the former
+// name of renamed files
+func pullRequestFiles(installationID int64, owner, repo string, number int) ([]string, error) {
+	client, err := githubapp.InstallationClient(installationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.PullRequests.ListFiles(context.Background(), owner, repo, number, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range page {
+			files = append(files, file.GetFilename())
+			if file.GetPreviousFilename() != "" {
+				files = append(files, file.GetPreviousFilename())
+			}
+		}
+		if resp.NextPage == 0 {
+			return files, nil
+		}
+		opts.Page = resp.NextPage
 	}
 }
 
@@ -139,19 +314,75 @@ func (c *GithubController) HandleGithubPostInstallation(w http.ResponseWriter, r
 		return
 	}
 
-	installation := db.GithubInstallation{
-		InstallationID: payload.InstallationID,
-		UserID:         &userInfo.DB.ID,
+	// Only an installation of the caller's own GitHub account may be linked
+	inst, accountID, err := accessibleInstallation(r.Context(), userInfo.DB, payload.InstallationID)
+	if errors.Is(err, errGithubNotConnected) {
+		http.Error(w, "GitHub not connected", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errInstallationNotAccessible) {
+		http.Error(w, "Installation not accessible to your GitHub account", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to verify installation %d: %v\n", payload.InstallationID, err)
+		http.Error(w, "Failed to verify installation", http.StatusBadGateway)
+		return
 	}
 
-	if err := db.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "installation_id"}},
-		UpdateAll: true,
-	}).Create(&installation).Error; err != nil {
+	// Installations on an organization are linked to a Flotio organization
+	// by an administrator
+	if inst.GetAccount().GetType() == "Organization" {
+		if _, err := recordInstallation(inst); err != nil {
+			http.Error(w, fmt.Sprintf("DB error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJSON(w, map[string]string{
+			"status":          "awaiting_organization",
+			"installation_id": strconv.FormatInt(payload.InstallationID, 10),
+		})
+		return
+	}
+	if inst.GetAccount().GetID() != accountID {
+		http.Error(w, "Installation not accessible to your GitHub account", http.StatusForbidden)
+		return
+	}
+
+	var other int64
+	if err := db.DB.Model(&db.GithubInstallation{}).Where("user_id = ? AND installation_id <> ?", userInfo.DB.ID, payload.InstallationID).Count(&other).Error; err != nil {
+		http.Error(w, fmt.Sprintf("DB error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if other > 0 {
+		http.Error(w, "Another GitHub installation is linked to your account", http.StatusConflict)
+		return
+	}
+
+	installation, err := recordInstallation(inst)
+	if err != nil {
 		http.Error(w, fmt.Sprintf("DB error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// An installation linked to another user is kept by them
+	result := db.DB.Model(&db.GithubInstallation{}).
+		Where("id = ? AND (user_id IS NULL OR user_id = ?)", installation.ID, userInfo.DB.ID).
+		Update("user_id", userInfo.DB.ID)
+	if result.Error != nil {
+		http.Error(w, fmt.Sprintf("DB error: %v", result.Error), http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Installation already linked to another user", http.StatusConflict)
+		return
+	}
+	installation.UserID = &userInfo.DB.ID
+
+	// Projects disabled by a former installation of the account build again
+	if _, _, err := syncInstallationProjects(installation); err != nil {
+		fmt.Printf("Failed to update projects of installation %d: %v\n", payload.InstallationID, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"status":          "ok",
@@ -0,0 +1,449 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v76/github"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	db "github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/githubapp"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+var (
+	// errGithubNotConnected is returned when a user has not connected their
+	// GitHub account
+	errGithubNotConnected = errors.New("GitHub not connected")
+
+	// errInstallationNotAccessible is returned when the GitHub account of a
+	// user cannot access an installation
+	errInstallationNotAccessible = errors.New("installation not accessible")
+)
+
+// handleInstallation records the lifecycle of a GitHub App installation.
+// Suspending or deleting it disables the projects building with it: they
+// start no build, from the API or their triggers, until it is unsuspended or
+// installed again.
+func handleInstallation(e *github.InstallationEvent) (string, error) {
+	inst := e.GetInstallation()
+	fmt.Printf("Installation: ID=%d, Account=%s, Type=%s, TargetID=%d, Action=%s\n",
+		inst.GetID(), inst.GetAccount().GetLogin(), inst.GetAccount().GetType(), inst.GetTargetID(), e.GetAction())
+
+	switch e.GetAction() {
+	case "created", "new_permissions_accepted", "suspend", "unsuspend":
+		installation, err := recordInstallation(inst)
+		if err != nil {
+			return "", err
+		}
+		disabled, enabled, err := syncInstallationProjects(installation)
+		if err != nil {
+			return "", fmt.Errorf("failed to update projects of installation %d: %v", inst.GetID(), err)
+		}
+		return fmt.Sprintf("installation %d %s, %d project(s) disabled, %d enabled", inst.GetID(), e.GetAction(), disabled, enabled), nil
+
+	case "deleted":
+		return deleteInstallation(inst.GetID())
+
+	default:
+		return "unhandled installation action " + e.GetAction(), nil
+	}
+}
+
+// handleInstallationRepositories flags the projects whose repository was
+// removed from an installation, and clears the flag of those added back
+func handleInstallationRepositories(e *github.InstallationRepositoriesEvent) (string, error) {
+	installation, err := recordInstallation(e.GetInstallation())
+	if err != nil {
+		return "", err
+	}
+
+	projects, err := installationDependents(installation)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch projects of installation %d: %v", installation.InstallationID, err)
+	}
+
+	removed := map[string]bool{}
+	for _, repo := range e.RepositoriesRemoved {
+		removed[strings.ToLower(repo.GetFullName())] = true
+	}
+	added := map[string]bool{}
+	for _, repo := range e.RepositoriesAdded {
+		added[strings.ToLower(repo.GetFullName())] = true
+	}
+	// Switching to all repositories lists none of them
+	all := e.GetRepositorySelection() == "all"
+
+	var flagged, cleared []uint
+	for _, project := range projects {
+		repo := repoName(project)
+		switch {
+		case removed[repo] && !project.RepoRemoved:
+			flagged = append(flagged, project.ID)
+		case (added[repo] || all) && project.RepoRemoved:
+			cleared = append(cleared, project.ID)
+		}
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if len(flagged) > 0 {
+			if err := tx.Model(&db.Project{}).Where("id IN ?", flagged).Update("repo_removed", true).Error; err != nil {
+				return err
+			}
+		}
+		if len(cleared) > 0 {
+			if err := tx.Model(&db.Project{}).Where("id IN ?", cleared).Update("repo_removed", false).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update projects of installation %d: %v", installation.InstallationID, err)
+	}
+	return fmt.Sprintf("repositories %s on installation %d, %d project(s) flagged, %d cleared", e.GetAction(), installation.InstallationID, len(flagged), len(cleared)), nil
+}
+
+// recordInstallation stores the account and suspension of an installation,
+// keeping the user or organization it is linked to, then links it to its
+// owner if it is not yet
+func recordInstallation(inst *github.Installation) (db.GithubInstallation, error) {
+	installation := db.GithubInstallation{
+		InstallationID: inst.GetID(),
+		AccountLogin:   inst.GetAccount().GetLogin(),
+		AccountType:    inst.GetAccount().GetType(),
+		TargetID:       inst.GetTargetID(),
+	}
+	if inst.SuspendedAt != nil {
+		suspendedAt := inst.GetSuspendedAt().Time
+		installation.SuspendedAt = &suspendedAt
+	}
+
+	if err := db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "installation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"account_login", "account_type", "target_id", "suspended_at", "updated_at"}),
+	}).Create(&installation).Error; err != nil {
+		return installation, fmt.Errorf("DB insertion error GithubInstallation: %v", err)
+	}
+	if err := db.DB.Where("installation_id = ?", inst.GetID()).First(&installation).Error; err != nil {
+		return installation, err
+	}
+
+	if err := linkInstallationOwner(&installation); err != nil {
+		return installation, fmt.Errorf("failed to link installation %d to its owner: %v", installation.InstallationID, err)
+	}
+	return installation, nil
+}
+
+// linkInstallationOwner links an installation on a user account to the user
+// who connected that GitHub account. A user keeps the installation it is
+// already linked to. Installations on an organization account are linked to
+// a Flotio organization by an administrator.
+func linkInstallationOwner(installation *db.GithubInstallation) error {
+	if installation.AccountType != "User" || installation.UserID != nil {
+		return nil
+	}
+	var user db.User
+	err := db.DB.Where("github_id = ?", strconv.FormatInt(installation.TargetID, 10)).Order("id").First(&user).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	result := db.DB.Model(&db.GithubInstallation{}).
+		Where("id = ? AND user_id IS NULL", installation.ID).
+		Where("NOT EXISTS (SELECT 1 FROM github_installations WHERE user_id = ?)", user.ID).
+		Update("user_id", user.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		installation.UserID = &user.ID
+	}
+	return nil
+}
+
+// syncInstallationProjects disables the projects building with a suspended
+// installation, and enables again those it disabled once it is active. It
+// returns how many projects were disabled and enabled.
+func syncInstallationProjects(installation db.GithubInstallation) (int64, int64, error) {
+	projects, err := installationDependents(installation)
+	if err != nil || len(projects) == 0 {
+		return 0, 0, err
+	}
+	ids := make([]uint, len(projects))
+	for i, project := range projects {
+		ids[i] = project.ID
+	}
+
+	if installation.SuspendedAt != nil {
+		result := db.DB.Model(&db.Project{}).
+			Where("id IN ? AND disabled_reason <> ?", ids, db.ProjectDisabledInstallationSuspended).
+			Update("disabled_reason", db.ProjectDisabledInstallationSuspended)
+		return result.RowsAffected, 0, result.Error
+	}
+	result := db.DB.Model(&db.Project{}).
+		Where("id IN ? AND disabled_reason IN ?", ids, []string{db.ProjectDisabledInstallationSuspended, db.ProjectDisabledInstallationDeleted}).
+		Update("disabled_reason", "")
+	return 0, result.RowsAffected, result.Error
+}
+
+// deleteInstallation disables the projects building with an uninstalled
+// installation, and forgets it so its owner can install the App again
+func deleteInstallation(installationID int64) (string, error) {
+	var installation db.GithubInstallation
+	err := db.DB.Where("installation_id = ?", installationID).First(&installation).Error
+	if err == gorm.ErrRecordNotFound {
+		return fmt.Sprintf("installation %d unknown", installationID), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	projects, err := installationDependents(installation)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch projects of installation %d: %v", installationID, err)
+	}
+	ids := make([]uint, len(projects))
+	for i, project := range projects {
+		ids[i] = project.ID
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if len(ids) > 0 {
+			if err := tx.Model(&db.Project{}).Where("id IN ?", ids).Update("disabled_reason", db.ProjectDisabledInstallationDeleted).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(&installation).Error
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to delete installation %d: %v", installationID, err)
+	}
+	return fmt.Sprintf("installation %d deleted, %d project(s) disabled", installationID, len(ids)), nil
+}
+
+// installationDependents returns the projects building with an
+// installation whose repository belongs to its account: those of its
+// organization, and the personal projects of its user
+func installationDependents(installation db.GithubInstallation) ([]db.Project, error) {
+	if installation.AccountLogin == "" {
+		return nil, nil
+	}
+	var projects []db.Project
+	if installation.OrganizationID != nil {
+		if err := db.DB.Where("organization_id = ?", *installation.OrganizationID).Order("id").Find(&projects).Error; err != nil {
+			return nil, err
+		}
+	}
+	if installation.UserID != nil {
+		var personal []db.Project
+		if err := db.DB.Where("user_id = ? AND organization_id IS NULL", *installation.UserID).Order("id").Find(&personal).Error; err != nil {
+			return nil, err
+		}
+		projects = append(projects, personal...)
+	}
+
+	var dependents []db.Project
+	for _, project := range projects {
+		owner, _, ok := githubapp.ParseRepo(project.GitRepo)
+		if ok && strings.EqualFold(owner, installation.AccountLogin) {
+			dependents = append(dependents, project)
+		}
+	}
+	return dependents, nil
+}
+
+// installationState sets whether a project whose repository or organization
+// changed is disabled by the installation it builds with. The repository is
+// assumed to be granted until GitHub reports otherwise.
+func installationState(project *db.Project) error {
+	project.DisabledReason = ""
+	project.RepoRemoved = false
+
+	installation, err := db.ProjectInstallation(*project)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner, _, ok := githubapp.ParseRepo(project.GitRepo)
+	if ok && strings.EqualFold(owner, installation.AccountLogin) && installation.SuspendedAt != nil {
+		project.DisabledReason = db.ProjectDisabledInstallationSuspended
+	}
+	return nil
+}
+
+// repoName returns the lowercase owner/name of the GitHub repository of a
+// project, empty for other repositories
+func repoName(project db.Project) string {
+	owner, name, ok := githubapp.ParseRepo(project.GitRepo)
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(owner + "/" + name)
+}
+
+// accessibleInstallation returns an installation of the App that the GitHub
+// account connected by user can access, as GitHub reports it to the user
+// token, along with the ID of that account
+func accessibleInstallation(ctx context.Context, user *db.User, installationID int64) (*github.Installation, int64, error) {
+	if user.GithubAccessToken == "" {
+		return nil, 0, errGithubNotConnected
+	}
+	client := github.NewClient(nil).WithAuthToken(string(user.GithubAccessToken))
+
+	account, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch GitHub account: %v", err)
+	}
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Apps.ListUserInstallations(ctx, opts)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list installations: %v", err)
+		}
+		for _, inst := range page {
+			if inst.GetID() == installationID {
+				return inst, account.GetID(), nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil, 0, errInstallationNotAccessible
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// validateProjectOrganization checks that user may build the projects of an
+// organization: its GitHub App installation must be accessible to the GitHub
+// account the user connected, i.e. they are a member of the GitHub
+// organization. It writes the error response otherwise.
+func validateProjectOrganization(w http.ResponseWriter, r *http.Request, user *db.User, organizationID uint) bool {
+	var installation db.GithubInstallation
+	if err := db.DB.Where("organization_id = ?", organizationID).First(&installation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Organization has no GitHub installation", http.StatusBadRequest)
+			return false
+		}
+		http.Error(w, "Failed to fetch GitHub installation", http.StatusInternalServerError)
+		return false
+	}
+
+	_, _, err := accessibleInstallation(r.Context(), user, installation.InstallationID)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errGithubNotConnected):
+		http.Error(w, "GitHub not connected", http.StatusForbidden)
+	case errors.Is(err, errInstallationNotAccessible):
+		http.Error(w, "Organization installation not accessible to your GitHub account", http.StatusForbidden)
+	default:
+		fmt.Printf("Failed to verify installation %d: %v\n", installation.InstallationID, err)
+		http.Error(w, "Failed to verify installation", http.StatusBadGateway)
+	}
+	return false
+}
+
+// InstallationOrganizationHandler links a GitHub App installation on an
+// organization account to a Flotio organization, for administrators.
+// {"organization_id": null} unlinks it.
+func InstallationOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !middleware.IsAdmin(userInfo) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	installationID, err := strconv.ParseInt(mux.Vars(r)["installationId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid installation ID", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		OrganizationID *uint `json:"organization_id"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var installation db.GithubInstallation
+	if err := db.DB.Where("installation_id = ?", installationID).First(&installation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Installation not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch installation", http.StatusInternalServerError)
+		return
+	}
+
+	if req.OrganizationID != nil {
+		if installation.AccountType != "Organization" {
+			http.Error(w, "Installation is not on an organization account", http.StatusBadRequest)
+			return
+		}
+		if err := db.DB.First(&db.Organization{}, *req.OrganizationID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				http.Error(w, "Organization not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to fetch organization", http.StatusInternalServerError)
+			return
+		}
+		var other int64
+		if err := db.DB.Model(&db.GithubInstallation{}).Where("organization_id = ? AND id <> ?", *req.OrganizationID, installation.ID).Count(&other).Error; err != nil {
+			http.Error(w, "Failed to fetch installations", http.StatusInternalServerError)
+			return
+		}
+		if other > 0 {
+			http.Error(w, "Another GitHub installation is linked to the organization", http.StatusConflict)
+			return
+		}
+	}
+
+	before, err := installationDependents(installation)
+	if err != nil {
+		http.Error(w, "Failed to fetch projects", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DB.Model(&installation).Update("organization_id", req.OrganizationID).Error; err != nil {
+		http.Error(w, "Failed to link installation", http.StatusInternalServerError)
+		return
+	}
+	installation.OrganizationID = req.OrganizationID
+	after, err := installationDependents(installation)
+	if err != nil {
+		http.Error(w, "Failed to fetch projects", http.StatusInternalServerError)
+		return
+	}
+
+	// The projects that changed installation follow the state of the new one
+	for _, project := range append(before, after...) {
+		if err := installationState(&project); err != nil {
+			http.Error(w, "Failed to update projects", http.StatusInternalServerError)
+			return
+		}
+		if err := db.DB.Model(&project).Select("disabled_reason", "repo_removed").Updates(&project).Error; err != nil {
+			http.Error(w, "Failed to update projects", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"installation": installation})
+}
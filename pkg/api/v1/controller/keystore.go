@@ -0,0 +1,561 @@
+package controller
+
+import (
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/signing"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// maxKeystoreSize bounds uploaded keystore files, real ones are a few KiB
+const maxKeystoreSize = 1 << 20
+
+// KeystoresGetHandler lists the keystores of a project
+func KeystoresGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var keystores []db.Keystore
+	if err := db.DB.Joins("JOIN projects ON keystores.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).Order("keystores.id").Find(&keystores).Error; err != nil {
+		http.Error(w, "Failed to fetch keystores", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"keystores": keystores})
+}
+
+// KeystorePostHandler uploads a keystore as multipart/form-data: the file in
+// "keystore", and the "name", "store_password", "key_alias", "key_password"
+// and "is_active" fields. The key password defaults to the store password,
+// the alias to the only key of the keystore, and the first keystore of a
+// project is activated unless is_active is false. Keystores whose
+// credentials do not open the key are rejected.
+func KeystorePostHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	// Verify project ownership
+	var project db.Project
+	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	if !parseKeystoreForm(w, r) {
+		return
+	}
+
+	content, fileName, ok := readKeystoreFile(w, r)
+	if !ok {
+		return
+	}
+	if content == nil {
+		http.Error(w, "Missing keystore file", http.StatusBadRequest)
+		return
+	}
+
+	keystore := db.Keystore{
+		ProjectID:     project.ID,
+		Name:          r.PostFormValue("name"),
+		FileName:      fileName,
+		KeystoreFile:  db.EncryptedString(base64.StdEncoding.EncodeToString(content)),
+		StorePassword: db.EncryptedString(r.PostFormValue("store_password")),
+		KeyAlias:      r.PostFormValue("key_alias"),
+		KeyPassword:   db.EncryptedString(r.PostFormValue("key_password")),
+	}
+	if keystore.Name == "" {
+		keystore.Name = fileName
+	}
+	if keystore.KeyPassword == "" {
+		keystore.KeyPassword = keystore.StorePassword
+	}
+	if keystore.StorePassword == "" {
+		http.Error(w, "store_password is required", http.StatusBadRequest)
+		return
+	}
+	if !inspectKeystore(w, &keystore, content) {
+		return
+	}
+
+	activate, set, err := formBool(r, "is_active")
+	if err != nil {
+		http.Error(w, "Invalid is_active value", http.StatusBadRequest)
+		return
+	}
+	if !set {
+		var active int64
+		if err := db.DB.Model(&db.Keystore{}).Where("project_id = ? AND is_active = ?", project.ID, true).Count(&active).Error; err != nil {
+			http.Error(w, "Failed to fetch keystores", http.StatusInternalServerError)
+			return
+		}
+		activate = active == 0
+	}
+	keystore.IsActive = activate
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if keystore.IsActive {
+			if err := deactivateKeystores(tx, project.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&keystore).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to create keystore", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"keystore": keystore})
+}
+
+// KeystoreGenerateHandler generates an upload key and its self-signed
+// certificate, stored as a new keystore protected by random passwords. The
+// file and passwords can then be downloaded once, with
+// KeystoreBackupHandler.
+func KeystoreGenerateHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name               string `json:"name"`
+		Type               string `json:"type"` // pkcs12 (default) or jks
+		Alias              string `json:"key_alias"`
+		CommonName         string `json:"common_name"`
+		OrganizationalUnit string `json:"organizational_unit"`
+		Organization       string `json:"organization"`
+		Locality           string `json:"locality"`
+		State              string `json:"state"`
+		Country            string `json:"country"` // two-letter code
+		ValidityYears      int    `json:"validity_years"`
+		KeySize            int    `json:"key_size"`
+		IsActive           *bool  `json:"is_active"`
+	}
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Country != "" && len(req.Country) != 2 {
+		http.Error(w, "country must be a two-letter code", http.StatusBadRequest)
+		return
+	}
+
+	// Verify project ownership
+	var project db.Project
+	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	subject := pkix.Name{CommonName: req.CommonName}
+	for _, field := range []struct {
+		value  string
+		target *[]string
+	}{
+		{req.OrganizationalUnit, &subject.OrganizationalUnit},
+		{req.Organization, &subject.Organization},
+		{req.Locality, &subject.Locality},
+		{req.State, &subject.Province},
+		{strings.ToUpper(req.Country), &subject.Country},
+	} {
+		if field.value != "" {
+			*field.target = []string{field.value}
+		}
+	}
+
+	generated, err := signing.Generate(signing.GenerateOptions{
+		Type:          req.Type,
+		Alias:         req.Alias,
+		Subject:       subject,
+		ValidityYears: req.ValidityYears,
+		KeySize:       req.KeySize,
+	})
+	if err != nil {
+		http.Error(w, "Failed to generate keystore: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileName := "upload-keystore.p12"
+	if generated.Info.Type == signing.TypeJKS {
+		fileName = "upload-keystore.jks"
+	}
+
+	keystore := db.Keystore{
+		ProjectID:       project.ID,
+		Name:            req.Name,
+		FileName:        fileName,
+		KeystoreFile:    db.EncryptedString(base64.StdEncoding.EncodeToString(generated.Data)),
+		StorePassword:   db.EncryptedString(generated.StorePassword),
+		KeyPassword:     db.EncryptedString(generated.KeyPassword),
+		BackupAvailable: true,
+	}
+	if keystore.Name == "" {
+		keystore.Name = generated.Info.Subject
+	}
+	if !inspectKeystore(w, &keystore, generated.Data) {
+		return
+	}
+
+	if req.IsActive != nil {
+		keystore.IsActive = *req.IsActive
+	} else {
+		var active int64
+		if err := db.DB.Model(&db.Keystore{}).Where("project_id = ? AND is_active = ?", project.ID, true).Count(&active).Error; err != nil {
+			http.Error(w, "Failed to fetch keystores", http.StatusInternalServerError)
+			return
+		}
+		keystore.IsActive = active == 0
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if keystore.IsActive {
+			if err := deactivateKeystores(tx, project.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&keystore).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to create keystore", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"keystore": keystore})
+}
+
+// KeystoreBackupHandler returns the file and passwords of a generated
+// keystore. It succeeds only once, later calls get 410 Gone.
+func KeystoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keystore, ok := findKeystore(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	// Claim the backup atomically, so concurrent requests cannot both get it
+	result := db.DB.Model(&db.Keystore{}).Where("id = ? AND backup_available = ?", keystore.ID, true).Update("backup_available", false)
+	if result.Error != nil {
+		http.Error(w, "Failed to fetch keystore", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Keystore backup not available", http.StatusGone)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{
+		"file_name":      keystore.FileName,
+		"type":           keystore.Type,
+		"keystore":       string(keystore.KeystoreFile), // base64
+		"store_password": string(keystore.StorePassword),
+		"key_alias":      keystore.KeyAlias,
+		"key_password":   string(keystore.KeyPassword),
+	})
+}
+
+// KeystoreGetByIdHandler returns a keystore, without its file nor passwords
+func KeystoreGetByIdHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keystore, ok := findKeystore(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"keystore": keystore})
+}
+
+// KeystorePutByIdHandler updates the fields of a keystore sent as
+// multipart/form-data (or URL-encoded without the file). Omitted fields are
+// kept, and a new file or new credentials are checked like on upload.
+// Setting is_active to true deactivates the other keystores of the project.
+func KeystorePutByIdHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keystore, ok := findKeystore(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	if !parseKeystoreForm(w, r) {
+		return
+	}
+
+	content, fileName, ok := readKeystoreFile(w, r)
+	if !ok {
+		return
+	}
+	changed := content != nil
+	if content != nil {
+		keystore.KeystoreFile = db.EncryptedString(base64.StdEncoding.EncodeToString(content))
+		keystore.FileName = fileName
+		keystore.BackupAvailable = false
+	}
+
+	if name, set := formValue(r, "name"); set && name != "" {
+		keystore.Name = name
+	}
+	if alias, set := formValue(r, "key_alias"); set && alias != "" {
+		keystore.KeyAlias = alias
+		changed = true
+	}
+	if password, set := formValue(r, "store_password"); set && password != "" {
+		keystore.StorePassword = db.EncryptedString(password)
+		changed = true
+	}
+	if password, set := formValue(r, "key_password"); set && password != "" {
+		keystore.KeyPassword = db.EncryptedString(password)
+		changed = true
+	}
+
+	if changed {
+		if content == nil {
+			var err error
+			if content, err = base64.StdEncoding.DecodeString(string(keystore.KeystoreFile)); err != nil {
+				http.Error(w, "Failed to decode keystore file", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !inspectKeystore(w, &keystore, content) {
+			return
+		}
+	}
+
+	activate, set, err := formBool(r, "is_active")
+	if err != nil {
+		http.Error(w, "Invalid is_active value", http.StatusBadRequest)
+		return
+	}
+	if set {
+		keystore.IsActive = activate
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if keystore.IsActive {
+			if err := deactivateKeystores(tx, keystore.ProjectID, keystore.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Save(&keystore).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to update keystore", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"keystore": keystore})
+}
+
+// KeystoreDeleteByIdHandler deletes a keystore. Once the active keystore is
+// deleted, release builds are no longer signed until another one is
+// activated.
+func KeystoreDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keystore, ok := findKeystore(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	if err := db.DB.Delete(&keystore).Error; err != nil {
+		http.Error(w, "Failed to delete keystore", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "deleted"})
+}
+
+// findKeystore loads the keystore of the request path, writing the error
+// response when it is not accessible
+func findKeystore(w http.ResponseWriter, r *http.Request, userInfo *middleware.UserContext) (db.Keystore, bool) {
+	var keystore db.Keystore
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return keystore, false
+	}
+
+	keystoreID, err := strconv.Atoi(vars["keystoreId"])
+	if err != nil {
+		http.Error(w, "Invalid keystore ID", http.StatusBadRequest)
+		return keystore, false
+	}
+
+	if err := db.DB.Joins("JOIN projects ON keystores.project_id = projects.id").Where("keystores.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", keystoreID, projectID, *userInfo.Keycloak.Sub).First(&keystore).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Keystore not found", http.StatusNotFound)
+			return keystore, false
+		}
+		http.Error(w, "Failed to fetch keystore", http.StatusInternalServerError)
+		return keystore, false
+	}
+
+	return keystore, true
+}
+
+// inspectKeystore checks that the credentials of keystore open the key of
+// the file and records its certificate, writing the error response when they
+// do not
+func inspectKeystore(w http.ResponseWriter, keystore *db.Keystore, content []byte) bool {
+	info, err := signing.Inspect(content, string(keystore.StorePassword), keystore.KeyAlias, string(keystore.KeyPassword))
+	if err != nil {
+		// Every inspection error comes from the file or the credentials sent
+		http.Error(w, "Keystore rejected: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if keystore.KeyAlias == "" {
+		keystore.KeyAlias = info.Alias
+	}
+	keystore.Type = info.Type
+	keystore.CertSubject = info.Subject
+	keystore.CertIssuer = info.Issuer
+	keystore.CertNotBefore = &info.NotBefore
+	keystore.CertNotAfter = &info.NotAfter
+	keystore.SHA1Fingerprint = info.SHA1Fingerprint
+	keystore.SHA256Fingerprint = info.SHA256Fingerprint
+	return true
+}
+
+// deactivateKeystores deactivates the keystores of a project, except the
+// given ones
+func deactivateKeystores(tx *gorm.DB, projectID uint, except ...uint) error {
+	query := tx.Model(&db.Keystore{}).Where("project_id = ? AND is_active = ?", projectID, true)
+	if len(except) > 0 {
+		query = query.Where("id NOT IN ?", except)
+	}
+	return query.Update("is_active", false).Error
+}
+
+// parseKeystoreForm parses a multipart or URL-encoded body, writing the
+// error response when it is invalid or too large
+func parseKeystoreForm(w http.ResponseWriter, r *http.Request) bool {
+	// Leave room for the other fields and the multipart framing
+	r.Body = http.MaxBytesReader(w, r.Body, maxKeystoreSize+64<<10)
+
+	if err := r.ParseMultipartForm(maxKeystoreSize); err != nil && err != http.ErrNotMultipart {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Keystore too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// readKeystoreFile returns the uploaded "keystore" file, nil when absent
+func readKeystoreFile(w http.ResponseWriter, r *http.Request) ([]byte, string, bool) {
+	file, header, err := r.FormFile("keystore")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, "", true
+	}
+	if err != nil {
+		http.Error(w, "Invalid keystore file", http.StatusBadRequest)
+		return nil, "", false
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, maxKeystoreSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read keystore file", http.StatusBadRequest)
+		return nil, "", false
+	}
+	if len(content) > maxKeystoreSize {
+		http.Error(w, "Keystore too large", http.StatusRequestEntityTooLarge)
+		return nil, "", false
+	}
+	if len(content) == 0 {
+		http.Error(w, "Empty keystore file", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	return content, header.Filename, true
+}
+
+// formValue returns a field of the request body and whether it was sent
+func formValue(r *http.Request, key string) (string, bool) {
+	values, ok := r.PostForm[key]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// formBool parses an optional boolean field of the request body
+func formBool(r *http.Request, key string) (value bool, set bool, err error) {
+	raw, set := formValue(r, key)
+	if !set || raw == "" {
+		return false, false, nil
+	}
+	value, err = strconv.ParseBool(raw)
+	return value, true, err
+}
@@ -1,15 +1,18 @@
 package controller
 
 import (
-	"context"
 	"fmt"
 	"net/http"
-	"os"
+	"slices"
 	"strconv"
 	"time"
 
+	"github.com/flotio-dev/api/pkg/artifacts"
 	"github.com/flotio-dev/api/pkg/db"
-	"github.com/flotio-dev/api/pkg/kubernetes"
+	"github.com/flotio-dev/api/pkg/events"
+	"github.com/flotio-dev/api/pkg/executor"
+	"github.com/flotio-dev/api/pkg/logs"
+	"github.com/flotio-dev/api/pkg/queue"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"gorm.io/gorm"
@@ -18,6 +21,17 @@ import (
 	utils "github.com/flotio-dev/api/pkg/utils"
 )
 
+const (
+	// defaultLogsLimit and maxLogsLimit bound how many log lines are returned at once
+	defaultLogsLimit = 1000
+	maxLogsLimit     = 5000
+
+	// WebSocket keepalive: pings every wsPingPeriod, the client must answer within wsPongWait
+	wsPingPeriod = 30 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsWriteWait  = 10 * time.Second
+)
+
 // Projects
 func ProjectsGetHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := middleware.GetUserFromContext(r.Context())
@@ -66,19 +80,36 @@ func ProjectCreateHandler(w http.ResponseWriter, r *http.Request) {
 		GitRepo        string `json:"git_repo"`
 		BuildFolder    string `json:"build_folder,omitempty"`
 		FlutterVersion string `json:"flutter_version,omitempty"`
+		BuildTimeout   int    `json:"build_timeout,omitempty"`   // seconds
+		OrganizationID uint   `json:"organization_id,omitempty"` // builds with the GitHub App installation of the organization
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.BuildTimeout < 0 {
+		http.Error(w, "Invalid build timeout", http.StatusBadRequest)
+		return
+	}
+	if req.OrganizationID != 0 && !validateProjectOrganization(w, r, &user, req.OrganizationID) {
+		return
+	}
 
 	project := db.Project{
 		Name:           req.Name,
 		GitRepo:        req.GitRepo,
 		BuildFolder:    req.BuildFolder,
 		FlutterVersion: req.FlutterVersion,
+		BuildTimeout:   req.BuildTimeout,
 		UserID:         user.ID,
 	}
+	if req.OrganizationID != 0 {
+		project.OrganizationID = &req.OrganizationID
+	}
+	if err := installationState(&project); err != nil {
+		http.Error(w, "Failed to fetch GitHub installation", http.StatusInternalServerError)
+		return
+	}
 
 	if err := db.DB.Create(&project).Error; err != nil {
 		http.Error(w, "Failed to create project", http.StatusInternalServerError)
@@ -132,11 +163,17 @@ func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
 		GitRepo        string `json:"git_repo,omitempty"`
 		BuildFolder    string `json:"build_folder,omitempty"`
 		FlutterVersion string `json:"flutter_version,omitempty"`
+		BuildTimeout   *int   `json:"build_timeout,omitempty"`   // seconds, 0 restores the default
+		OrganizationID *uint  `json:"organization_id,omitempty"` // 0 makes the project personal again
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.BuildTimeout != nil && *req.BuildTimeout < 0 {
+		http.Error(w, "Invalid build timeout", http.StatusBadRequest)
+		return
+	}
 
 	var project db.Project
 	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
@@ -151,8 +188,29 @@ func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
 	if req.Name != "" {
 		project.Name = req.Name
 	}
-	if req.GitRepo != "" {
+	installationChanged := false
+	if req.GitRepo != "" && req.GitRepo != project.GitRepo {
 		project.GitRepo = req.GitRepo
+		installationChanged = true
+	}
+	if req.OrganizationID != nil {
+		switch {
+		case *req.OrganizationID == 0:
+			installationChanged = installationChanged || project.OrganizationID != nil
+			project.OrganizationID = nil
+		case project.OrganizationID == nil || *project.OrganizationID != *req.OrganizationID:
+			if !validateProjectOrganization(w, r, userInfo.DB, *req.OrganizationID) {
+				return
+			}
+			project.OrganizationID = req.OrganizationID
+			installationChanged = true
+		}
+	}
+	if installationChanged {
+		if err := installationState(&project); err != nil {
+			http.Error(w, "Failed to fetch GitHub installation", http.StatusInternalServerError)
+			return
+		}
 	}
 	if req.BuildFolder != "" {
 		project.BuildFolder = req.BuildFolder
@@ -160,6 +218,9 @@ func ProjectPutHandler(w http.ResponseWriter, r *http.Request) {
 	if req.FlutterVersion != "" {
 		project.FlutterVersion = req.FlutterVersion
 	}
+	if req.BuildTimeout != nil {
+		project.BuildTimeout = *req.BuildTimeout
+	}
 
 	if err := db.DB.Save(&project).Error; err != nil {
 		http.Error(w, "Failed to update project", http.StatusInternalServerError)
@@ -209,8 +270,9 @@ func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
 		BuildTarget    string `json:"build_target,omitempty"`    // apk, aab, ios, web
 		FlutterChannel string `json:"flutter_channel,omitempty"` // stable, beta, dev
 		GitBranch      string `json:"git_branch,omitempty"`      // branch to build
-		GitUsername    string `json:"git_username,omitempty"`    // for private repos
-		GitPassword    string `json:"git_password,omitempty"`    // for private repos
+		GitUsername    string `json:"git_username,omitempty"`    // private repos outside the GitHub App
+		GitPassword    string `json:"git_password,omitempty"`    // private repos outside the GitHub App
+		Environment    string `json:"environment,omitempty"`     // env scope, e.g. production
 	}
 	if err := utils.ReadJSON(r, &req); err != nil {
 		// If no body, use defaults
@@ -222,22 +284,7 @@ func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set defaults for empty fields
-	if req.Platform == "" {
-		req.Platform = "android"
-	}
-	if req.BuildMode == "" {
-		req.BuildMode = "release"
-	}
-	if req.BuildTarget == "" {
-		if req.Platform == "android" {
-			req.BuildTarget = "apk"
-		} else {
-			req.BuildTarget = req.Platform
-		}
-	}
-	if req.FlutterChannel == "" {
-		req.FlutterChannel = "stable"
-	}
+	buildDefaults(&req.Platform, &req.BuildMode, &req.BuildTarget, &req.FlutterChannel)
 	if req.GitBranch == "" {
 		req.GitBranch = "main"
 	}
@@ -252,43 +299,103 @@ func ProjectBuildHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	build := db.Build{
-		ProjectID: project.ID,
-		Status:    "pending",
-		Platform:  req.Platform,
+	if project.DisabledReason != "" {
+		http.Error(w, "Project is disabled: "+project.DisabledReason, http.StatusConflict)
+		return
+	}
+	if project.RepoRemoved {
+		http.Error(w, "Repository removed from the GitHub App installation", http.StatusConflict)
+		return
 	}
 
-	if err := db.DB.Create(&build).Error; err != nil {
-		http.Error(w, "Failed to create build", http.StatusInternalServerError)
+	if !validateBuildEnvironment(w, project.ID, req.Environment) {
 		return
 	}
 
-	// Start the build process by creating a Kubernetes pod
-	buildConfig := kubernetes.BuildConfig{
-		BuildID:        build.ID,
-		Project:        project,
+	build := db.Build{
+		ProjectID:      project.ID,
 		Platform:       req.Platform,
 		BuildMode:      req.BuildMode,
 		BuildTarget:    req.BuildTarget,
 		FlutterChannel: req.FlutterChannel,
 		GitBranch:      req.GitBranch,
-		GitUsername:    req.GitUsername,
-		GitPassword:    req.GitPassword,
+		GitUsername:    db.EncryptedString(req.GitUsername),
+		GitPassword:    db.EncryptedString(req.GitPassword),
+		Environment:    req.Environment,
 	}
-
-	if err := kubernetes.CreateBuildPod(buildConfig); err != nil {
-		// If pod creation fails, update build status to failed
-		build.Status = "failed"
-		db.DB.Save(&build)
-		http.Error(w, "Failed to start build process", http.StatusInternalServerError)
+	if err := enqueueBuild(&build); err != nil {
+		http.Error(w, "Failed to create build", http.StatusInternalServerError)
 		return
 	}
 
-	// Update build status to running
-	build.Status = "running"
-	db.DB.Save(&build)
+	builds := []db.Build{build}
+	if err := queue.Annotate(builds); err != nil {
+		fmt.Printf("Failed to estimate queue position for build %d: %v\n", build.ID, err)
+	}
 
-	utils.WriteJSON(w, map[string]interface{}{"build": build})
+	utils.WriteJSON(w, map[string]interface{}{"build": builds[0]})
+}
+
+// buildDefaults fills the build settings left empty with their defaults
+func buildDefaults(platform, buildMode, buildTarget, flutterChannel *string) {
+	if *platform == "" {
+		*platform = "android"
+	}
+	if *buildMode == "" {
+		*buildMode = "release"
+	}
+	if *buildTarget == "" {
+		if *platform == "android" {
+			*buildTarget = "apk"
+		} else {
+			*buildTarget = *platform
+		}
+	}
+	if *flutterChannel == "" {
+		*flutterChannel = "stable"
+	}
+}
+
+// validateBuildEnvironment checks that builds can use environment, writing
+// the error response when they cannot. Only environments with envs exist,
+// typos are rejected rather than building with the shared envs alone.
+func validateBuildEnvironment(w http.ResponseWriter, projectID uint, environment string) bool {
+	if environment == "" {
+		return true
+	}
+	environments, err := projectEnvironments(projectID)
+	if err != nil {
+		http.Error(w, "Failed to fetch environments", http.StatusInternalServerError)
+		return false
+	}
+	if !slices.Contains(environments, environment) {
+		http.Error(w, "Unknown environment", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// enqueueBuild pins the envs a build will use and queues it. The dispatcher
+// starts the build once the concurrency limits allow it, then the build
+// reconciler follows the pod to its final status.
+func enqueueBuild(build *db.Build) error {
+	// The revision lookup locks the project until the build is created, so
+	// concurrent first builds record a single initial revision
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		envRevision, err := db.CurrentEnvRevision(tx, build.ProjectID)
+		if err != nil {
+			return err
+		}
+		build.EnvRevision = envRevision
+		build.Status = db.BuildStatusQueued
+		return tx.Create(build).Error
+	})
+	if err != nil {
+		return err
+	}
+	events.BuildStatusChanged(build.ID, "", db.BuildStatusQueued)
+	queue.Notify()
+	return nil
 }
 
 func BuildCancelHandler(w http.ResponseWriter, r *http.Request) {
@@ -320,11 +427,47 @@ func BuildCancelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	build.Status = "cancelled"
-	if err := db.DB.Save(&build).Error; err != nil {
+	if build.IsFinished() {
+		http.Error(w, fmt.Sprintf("Build already finished with status %s", build.Status), http.StatusConflict)
+		return
+	}
+
+	// Mark the build cancelled before tearing down the pod so the reconciler
+	// does not report the pod deletion as a failure. The status guard protects
+	// against the build finishing or being dispatched between the read above
+	// and this update.
+	now := time.Now()
+	result := db.DB.Model(&db.Build{}).
+		Where("id = ? AND status = ?", build.ID, build.Status).
+		Updates(map[string]interface{}{
+			"status":          db.BuildStatusCancelled,
+			"cancelled_at":    now,
+			"cancelled_by_id": userInfo.DB.ID,
+			"finished_at":     now,
+		})
+	if result.Error != nil {
 		http.Error(w, "Failed to cancel build", http.StatusInternalServerError)
 		return
 	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Build status changed, please retry", http.StatusConflict)
+		return
+	}
+	events.BuildStatusChanged(build.ID, build.Status, db.BuildStatusCancelled)
+
+	// Queued builds have no Kubernetes resources yet
+	if build.Status != db.BuildStatusQueued {
+		if err := executor.Default().Cancel(r.Context(), build.ID); err != nil {
+			fmt.Printf("Failed to tear down resources for build %d: %v\n", build.ID, err)
+			http.Error(w, "Build cancelled but failed to stop its resources", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := db.DB.First(&build, build.ID).Error; err != nil {
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
 
 	utils.WriteJSON(w, map[string]interface{}{"build": build})
 }
@@ -349,9 +492,50 @@ func BuildsListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := queue.Annotate(builds); err != nil {
+		fmt.Printf("Failed to estimate queue positions: %v\n", err)
+	}
+
 	utils.WriteJSON(w, map[string]interface{}{"builds": builds})
 }
 
+func BuildGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	buildID, err := strconv.Atoi(vars["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	var build db.Build
+	if err := db.DB.Preload("Artifacts").Joins("JOIN projects ON builds.project_id = projects.id").Where("builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", buildID, projectID, *userInfo.Keycloak.Sub).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+
+	builds := []db.Build{build}
+	if err := queue.Annotate(builds); err != nil {
+		fmt.Printf("Failed to estimate queue position for build %d: %v\n", build.ID, err)
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"build": builds[0]})
+}
+
 func BuildLogsHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := middleware.GetUserFromContext(r.Context())
 	if userInfo == nil {
@@ -382,97 +566,255 @@ func BuildLogsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get logs from the Kubernetes pod
-	logs, err := kubernetes.GetPodLogs(uint(buildID))
+	sinceLine := 0
+	if value := r.URL.Query().Get("since_line"); value != "" {
+		sinceLine, err = strconv.Atoi(value)
+		if err != nil || sinceLine < 0 {
+			http.Error(w, "Invalid since_line", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultLogsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxLogsLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxLogsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get logs stored by the log collector
+	lines, err := logs.Lines(build.ID, sinceLine, limit)
 	if err != nil {
 		http.Error(w, "Failed to fetch logs", http.StatusInternalServerError)
 		return
 	}
 
-	utils.WriteJSON(w, map[string]interface{}{"logs": logs})
+	utils.WriteJSON(w, map[string]interface{}{
+		"logs":     lines,
+		"complete": build.LogsComplete && len(lines) < limit,
+	})
 }
 
+// BuildLogsWSHandler streams the output of a build over a WebSocket: stored
+// lines after since_line are replayed, then new lines are pushed as they are
+// stored, followed by an end message carrying the final build status.
+// Browsers pass their access token in the token query parameter.
 func BuildLogsWSHandler(w http.ResponseWriter, r *http.Request) {
-	// Auth via query param
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Validate token (simplified, in real app use proper validation)
-	client := utils.GetKeycloakClient()
-	ctx := context.Background()
-	realm := os.Getenv("KEYCLOAK_REALM")
-	_, err := client.GetUserInfo(ctx, token, realm)
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
 		return
 	}
-
-	vars := mux.Vars(r)
 	buildID, err := strconv.Atoi(vars["buildId"])
 	if err != nil {
 		http.Error(w, "Invalid build ID", http.StatusBadRequest)
 		return
 	}
 
+	sinceLine := 0
+	if value := r.URL.Query().Get("since_line"); value != "" {
+		sinceLine, err = strconv.Atoi(value)
+		if err != nil || sinceLine < 0 {
+			http.Error(w, "Invalid since_line", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Verify the build belongs to the user's project
+	var build db.Build
+	if err := db.DB.Joins("JOIN projects ON builds.project_id = projects.id").Where("builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", buildID, projectID, *userInfo.Keycloak.Sub).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true }, // Allow all origins for demo
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		http.Error(w, "Failed to upgrade", http.StatusInternalServerError)
+		// Upgrade already replied to the client
 		return
 	}
 	defer conn.Close()
 
-	// Stream logs from the Kubernetes pod
-	logChan := make(chan string, 100)
+	// Subscribe before replaying so that no line falls in between
+	sub, err := logs.Subscribe(build.ID)
+	if err != nil {
+		fmt.Printf("Failed to subscribe to logs of build %d: %v\n", build.ID, err)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to read logs"))
+		return
+	}
+	defer sub.Close()
+
+	// Keep the connection alive: pongs extend the read deadline, and the
+	// read loop notices when the client goes away
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	closed := make(chan struct{})
 	go func() {
-		err := kubernetes.StreamPodLogs(uint(buildID), logChan)
-		if err != nil {
-			fmt.Printf("Error streaming pod logs: %v\n", err)
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
 		}
 	}()
 
-	// Get the current max line number for this build
-	var maxLine db.Log
-	if err := db.DB.Where("build_id = ?", buildID).Order("line_number DESC").First(&maxLine).Error; err != nil {
-		// If no logs exist, start from 1
-		maxLine.LineNumber = 0
-	}
-	lineNumber := maxLine.LineNumber + 1
-
-	for logLine := range logChan {
-		// Save log to database
-		logEntry := db.Log{
-			BuildID:    uint(buildID),
-			LineNumber: lineNumber,
-			Content:    logLine,
-			Timestamp:  time.Now().Unix(),
-		}
-		if err := db.DB.Create(&logEntry).Error; err != nil {
-			fmt.Printf("Failed to save log to database: %v\n", err)
+	lastLine := sinceLine
+	writeLines := func(lines []db.Log) error {
+		for _, line := range lines {
+			if line.LineNumber <= lastLine {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(logMessage{Type: "line", LineNumber: line.LineNumber, Content: line.Content, Time: &line.Time}); err != nil {
+				return err
+			}
+			lastLine = line.LineNumber
 		}
+		return nil
+	}
 
-		err := conn.WriteMessage(websocket.TextMessage, []byte(logLine))
-		if err != nil {
+	// Replay stored lines up to the subscription
+	for lastLine < sub.From {
+		lines, err := logs.Lines(build.ID, lastLine, maxLogsLimit)
+		if err != nil || len(lines) == 0 {
+			break
+		}
+		if lines[len(lines)-1].LineNumber > sub.From {
+			lines = trimLines(lines, sub.From)
+		}
+		if err := writeLines(lines); err != nil {
+			return
+		}
+		if len(lines) == 0 {
 			break
 		}
-		lineNumber++
 	}
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// Dropped for lagging behind, the client resumes from its last line
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "lagging behind"))
+				return
+			}
+			if err := writeLines(event.Lines); err != nil {
+				return
+			}
+			if event.Ended {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				conn.WriteJSON(logMessage{Type: "end", Status: event.Status, LineNumber: lastLine})
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// logMessage is a frame of the build log WebSocket
+type logMessage struct {
+	Type       string     `json:"type"` // "line" or "end"
+	LineNumber int        `json:"line_number"`
+	Content    string     `json:"content,omitempty"`
+	Time       *time.Time `json:"time,omitempty"`
+	Status     string     `json:"status,omitempty"` // final build status, with "end"
+}
+
+// trimLines drops the lines numbered after last
+func trimLines(lines []db.Log, last int) []db.Log {
+	for i, line := range lines {
+		if line.LineNumber > last {
+			return lines[:i]
+		}
+	}
+	return lines
 }
 
+// BuildDownloadHandler serves the primary artifact of a build. Stored
+// artifacts are served through a short-lived presigned URL, or streamed by
+// the API with ?mode=stream; other artifacts are streamed from the executor
+// while its resources still exist.
 func BuildDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	if middleware.GetUserFromContext(r.Context()) == nil {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
 	vars := mux.Vars(r)
-	// Simulate file download
-	filename := "app-" + vars["buildId"] + ".apk"
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	w.Write([]byte("fake apk content"))
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	buildID, err := strconv.Atoi(vars["buildId"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	var build db.Build
+	if err := db.DB.Joins("JOIN projects ON builds.project_id = projects.id").Where("builds.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", buildID, projectID, *userInfo.Keycloak.Sub).First(&build).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		return
+	}
+
+	if build.Status != db.BuildStatusSuccess {
+		http.Error(w, "Build has no artifact", http.StatusConflict)
+		return
+	}
+
+	if build.ArtifactKey != "" {
+		serveStoredArtifact(w, r, build.ArtifactKey, build.ArtifactName)
+		return
+	}
+
+	list, err := executor.Default().Artifacts(r.Context(), build.ID)
+	if err != nil {
+		if err == executor.ErrNotFound || err == executor.ErrArtifactsUnavailable {
+			http.Error(w, "Artifact not available", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to list artifacts", http.StatusInternalServerError)
+		return
+	}
+
+	primary, ok := artifacts.Primary(list)
+	if !ok {
+		http.Error(w, "Artifact not available", http.StatusNotFound)
+		return
+	}
+
+	serveExecutorArtifact(w, r, build.ID, primary.Name, primary.Size)
 }
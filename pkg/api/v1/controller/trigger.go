@@ -0,0 +1,424 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// pullRequestActions are the pull request event actions a trigger can start
+// builds on
+var pullRequestActions = []string{"opened", "synchronize", "reopened"}
+
+// triggerRequest is the body of trigger requests. Fields left out keep their
+// value on update.
+type triggerRequest struct {
+	Event              *string   `json:"event"`
+	Pattern            *string   `json:"pattern"`
+	PullRequestActions *[]string `json:"pull_request_actions"`
+	Platform           *string   `json:"platform"`
+	BuildMode          *string   `json:"build_mode"`
+	BuildTarget        *string   `json:"build_target"`
+	FlutterChannel     *string   `json:"flutter_channel"`
+	Environment        *string   `json:"environment"`
+	Enabled            *bool     `json:"enabled"`
+}
+
+// TriggersGetHandler lists the build triggers of a project
+func TriggersGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var triggers []db.BuildTrigger
+	if err := db.DB.Joins("JOIN projects ON build_triggers.project_id = projects.id").Where("projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).Order("build_triggers.id").Find(&triggers).Error; err != nil {
+		http.Error(w, "Failed to fetch triggers", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"triggers": triggers})
+}
+
+// TriggerPostHandler creates a build trigger. Build settings left empty take
+// the defaults of manual builds, and pull request triggers default to the
+// opened and synchronize actions.
+func TriggerPostHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	// Verify project ownership
+	var project db.Project
+	if err := db.DB.Where("id = ? AND user_id = (SELECT id FROM users WHERE keycloak_id = ?)", projectID, *userInfo.Keycloak.Sub).First(&project).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch project", http.StatusInternalServerError)
+		return
+	}
+
+	var req triggerRequest
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	trigger := db.BuildTrigger{ProjectID: project.ID, Enabled: true}
+	req.apply(&trigger)
+	if trigger.Event == db.TriggerEventPullRequest && req.PullRequestActions == nil {
+		trigger.PullRequestActions = []string{"opened", "synchronize"}
+	}
+	if !validateTrigger(w, &trigger) {
+		return
+	}
+
+	if err := db.DB.Create(&trigger).Error; err != nil {
+		http.Error(w, "Failed to create trigger", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"trigger": trigger})
+}
+
+// TriggerGetByIdHandler returns a build trigger
+func TriggerGetByIdHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	trigger, ok := findTrigger(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"trigger": trigger})
+}
+
+// TriggerPutByIdHandler updates the fields sent of a build trigger
+func TriggerPutByIdHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	trigger, ok := findTrigger(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	var req triggerRequest
+	if err := utils.ReadJSON(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.apply(&trigger)
+	if !validateTrigger(w, &trigger) {
+		return
+	}
+
+	if err := db.DB.Save(&trigger).Error; err != nil {
+		http.Error(w, "Failed to update trigger", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"trigger": trigger})
+}
+
+// TriggerDeleteByIdHandler deletes a build trigger. The builds it started
+// are kept.
+func TriggerDeleteByIdHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	trigger, ok := findTrigger(w, r, userInfo)
+	if !ok {
+		return
+	}
+
+	if err := db.DB.Delete(&trigger).Error; err != nil {
+		http.Error(w, "Failed to delete trigger", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]string{"status": "deleted"})
+}
+
+// findTrigger loads the trigger of the request path, writing the error
+// response when it is not accessible
+func findTrigger(w http.ResponseWriter, r *http.Request, userInfo *middleware.UserContext) (db.BuildTrigger, bool) {
+	var trigger db.BuildTrigger
+
+	vars := mux.Vars(r)
+	projectID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return trigger, false
+	}
+
+	triggerID, err := strconv.Atoi(vars["triggerId"])
+	if err != nil {
+		http.Error(w, "Invalid trigger ID", http.StatusBadRequest)
+		return trigger, false
+	}
+
+	if err := db.DB.Joins("JOIN projects ON build_triggers.project_id = projects.id").Where("build_triggers.id = ? AND projects.id = ? AND projects.user_id = (SELECT id FROM users WHERE keycloak_id = ?)", triggerID, projectID, *userInfo.Keycloak.Sub).First(&trigger).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Trigger not found", http.StatusNotFound)
+			return trigger, false
+		}
+		http.Error(w, "Failed to fetch trigger", http.StatusInternalServerError)
+		return trigger, false
+	}
+
+	return trigger, true
+}
+
+// apply copies the fields sent to trigger. Only pull request triggers keep
+// pull request actions.
+func (req *triggerRequest) apply(trigger *db.BuildTrigger) {
+	if req.Event != nil {
+		trigger.Event = *req.Event
+	}
+	if req.Pattern != nil {
+		trigger.Pattern = strings.TrimSpace(*req.Pattern)
+	}
+	if req.PullRequestActions != nil {
+		trigger.PullRequestActions = *req.PullRequestActions
+	}
+	if trigger.Event != db.TriggerEventPullRequest {
+		trigger.PullRequestActions = nil
+	}
+	for dest, value := range map[*string]*string{
+		&trigger.Platform:       req.Platform,
+		&trigger.BuildMode:      req.BuildMode,
+		&trigger.BuildTarget:    req.BuildTarget,
+		&trigger.FlutterChannel: req.FlutterChannel,
+		&trigger.Environment:    req.Environment,
+	} {
+		if value != nil {
+			*dest = *value
+		}
+	}
+	if req.Enabled != nil {
+		trigger.Enabled = *req.Enabled
+	}
+	buildDefaults(&trigger.Platform, &trigger.BuildMode, &trigger.BuildTarget, &trigger.FlutterChannel)
+}
+
+// validateTrigger checks a trigger before it is saved, writing the error
+// response when it is invalid
+func validateTrigger(w http.ResponseWriter, trigger *db.BuildTrigger) bool {
+	if err := checkTrigger(trigger); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return validateBuildEnvironment(w, trigger.ProjectID, trigger.Environment)
+}
+
+// checkTrigger checks the fields of a trigger
+func checkTrigger(trigger *db.BuildTrigger) error {
+	switch trigger.Event {
+	case db.TriggerEventPush, db.TriggerEventTag, db.TriggerEventPullRequest:
+	default:
+		return errors.New("event must be push, tag or pull_request")
+	}
+	if _, err := path.Match(trigger.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", trigger.Pattern)
+	}
+	if trigger.Event == db.TriggerEventPullRequest {
+		if len(trigger.PullRequestActions) == 0 {
+			return errors.New("pull_request_actions is required")
+		}
+		for _, action := range trigger.PullRequestActions {
+			if !slices.Contains(pullRequestActions, action) {
+				return fmt.Errorf("invalid pull request action %q", action)
+			}
+		}
+	}
+	return nil
+}
+
+// repoChange is a push or pull request event, as matched against triggers
+type repoChange struct {
+	Delivery    string // GitHub delivery of the event
+	Event       string // push, tag or pull_request
+	Ref         string // branch or tag pushed, base branch of pull requests
+	Action      string // pull request action
+	Branch      string // branch or tag built
+	CommitSHA   string
+	PullRequest int
+
+	// Files lists the changed files, false when they are unknown
+	Files func() ([]string, bool)
+}
+
+// triggerMatches reports whether trigger starts a build for change.
+// Patterns are globs where * does not match /, e.g. release/*.
+func triggerMatches(trigger db.BuildTrigger, change repoChange) bool {
+	if !trigger.Enabled || trigger.Event != change.Event {
+		return false
+	}
+	if change.Event == db.TriggerEventPullRequest && !slices.Contains(trigger.PullRequestActions, change.Action) {
+		return false
+	}
+	if trigger.Pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(trigger.Pattern, change.Ref)
+	return matched
+}
+
+// touchesFolder reports whether one of files is under the build folder of a
+// project; any file is when the project builds from the repository root
+func touchesFolder(buildFolder string, files []string) bool {
+	folder := strings.Trim(path.Clean("/"+buildFolder), "/")
+	if folder == "" {
+		return true
+	}
+	for _, file := range files {
+		if file == folder || strings.HasPrefix(file, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// triggerBuilds queues a build for each trigger change matches, among the
+// projects of repo (owner/name) building with the GitHub App installation
+// the event comes from, and describes the builds queued.
+// Branch pushes and pull requests that change nothing under the build
+// folder of a project are skipped; tags always build. Disabled projects, and
+// those whose repository was removed from the installation, build nothing.
+// Triggers that already queued a build for the delivery are skipped, so
+// replaying a delivery that failed halfway only queues the missing builds.
+func triggerBuilds(installationID int64, repo string, change repoChange) (string, error) {
+	projects, err := installationProjects(installationID, repo)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch projects of %s: %v", repo, err)
+	}
+
+	var queued []string
+	var errs []error
+	for _, project := range projects {
+		if !project.Buildable() {
+			fmt.Printf("Project %d is disabled, triggers skipped for %s %s\n", project.ID, change.Event, change.Ref)
+			continue
+		}
+
+		var triggers []db.BuildTrigger
+		if err := db.DB.Where("project_id = ? AND enabled = ?", project.ID, true).Order("id").Find(&triggers).Error; err != nil {
+			errs = append(errs, fmt.Errorf("failed to fetch triggers of project %d: %v", project.ID, err))
+			continue
+		}
+
+		for _, trigger := range triggers {
+			if !triggerMatches(trigger, change) {
+				continue
+			}
+			if change.Event != db.TriggerEventTag && change.Files != nil {
+				if files, known := change.Files(); known && !touchesFolder(project.BuildFolder, files) {
+					fmt.Printf("Trigger %d: nothing changed under %s in %s, build skipped\n", trigger.ID, project.BuildFolder, change.CommitSHA)
+					continue
+				}
+			}
+
+			var existing int64
+			if err := db.DB.Model(&db.Build{}).Where("webhook_delivery = ? AND trigger_id = ?", change.Delivery, trigger.ID).Count(&existing).Error; err != nil {
+				errs = append(errs, fmt.Errorf("trigger %d: %v", trigger.ID, err))
+				continue
+			}
+			if existing > 0 {
+				continue
+			}
+
+			triggerID := trigger.ID
+			build := db.Build{
+				ProjectID:       project.ID,
+				Platform:        trigger.Platform,
+				BuildMode:       trigger.BuildMode,
+				BuildTarget:     trigger.BuildTarget,
+				FlutterChannel:  trigger.FlutterChannel,
+				GitBranch:       change.Branch,
+				CommitSHA:       change.CommitSHA,
+				PullRequest:     change.PullRequest,
+				TriggerID:       &triggerID,
+				WebhookDelivery: change.Delivery,
+				Environment:     trigger.Environment,
+			}
+			if err := enqueueBuild(&build); err != nil {
+				errs = append(errs, fmt.Errorf("trigger %d: failed to create build: %v", trigger.ID, err))
+				continue
+			}
+			fmt.Printf("Trigger %d: queued build %d of project %d for %s %s\n", trigger.ID, build.ID, project.ID, change.Event, change.Ref)
+			queued = append(queued, strconv.FormatUint(uint64(build.ID), 10))
+		}
+	}
+
+	result := "no build queued"
+	if len(queued) > 0 {
+		result = "queued builds " + strings.Join(queued, ", ")
+	}
+	return result, errors.Join(errs...)
+}
+
+// installationProjects returns the projects of repo (owner/name) building
+// with a GitHub App installation
+func installationProjects(installationID int64, repo string) ([]db.Project, error) {
+	var installation db.GithubInstallation
+	err := db.DB.Where("installation_id = ?", installationID).First(&installation).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := installationDependents(installation)
+	if err != nil {
+		return nil, err
+	}
+	var matching []db.Project
+	for _, project := range projects {
+		if repoName(project) == strings.ToLower(repo) {
+			matching = append(matching, project)
+		}
+	}
+	return matching, nil
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+func TestCheckTrigger(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger db.BuildTrigger
+		wantErr string
+	}{
+		{"push", db.BuildTrigger{Event: db.TriggerEventPush, Pattern: "main"}, ""},
+		{"push any branch", db.BuildTrigger{Event: db.TriggerEventPush}, ""},
+		{"tag glob", db.BuildTrigger{Event: db.TriggerEventTag, Pattern: "v[0-9]*"}, ""},
+		{"pull request", db.BuildTrigger{Event: db.TriggerEventPullRequest, PullRequestActions: []string{"opened", "synchronize"}}, ""},
+		{"unknown event", db.BuildTrigger{Event: "release"}, "event must be"},
+		{"empty event", db.BuildTrigger{}, "event must be"},
+		{"invalid pattern", db.BuildTrigger{Event: db.TriggerEventPush, Pattern: "release/[a-"}, "invalid pattern"},
+		{"pull request without actions", db.BuildTrigger{Event: db.TriggerEventPullRequest}, "pull_request_actions is required"},
+		{"unknown pull request action", db.BuildTrigger{Event: db.TriggerEventPullRequest, PullRequestActions: []string{"opened", "closed"}}, `invalid pull request action "closed"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTrigger(&tt.trigger)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTriggerMatches(t *testing.T) {
+	push := func(pattern string) db.BuildTrigger {
+		return db.BuildTrigger{Event: db.TriggerEventPush, Pattern: pattern, Enabled: true}
+	}
+	pullRequest := db.BuildTrigger{Event: db.TriggerEventPullRequest, Pattern: "main", PullRequestActions: []string{"opened", "synchronize"}, Enabled: true}
+
+	tests := []struct {
+		name    string
+		trigger db.BuildTrigger
+		change  repoChange
+		want    bool
+	}{
+		{"exact branch", push("main"), repoChange{Event: db.TriggerEventPush, Ref: "main"}, true},
+		{"other branch", push("main"), repoChange{Event: db.TriggerEventPush, Ref: "develop"}, false},
+		{"empty pattern matches any", push(""), repoChange{Event: db.TriggerEventPush, Ref: "feature/x"}, true},
+		{"glob", push("release/*"), repoChange{Event: db.TriggerEventPush, Ref: "release/1.2"}, true},
+		{"star stops at slash", push("release/*"), repoChange{Event: db.TriggerEventPush, Ref: "release/1.2/hotfix"}, false},
+		{"star alone stops at slash", push("*"), repoChange{Event: db.TriggerEventPush, Ref: "feature/x"}, false},
+		{"character class", push("v[0-9]*"), repoChange{Event: db.TriggerEventPush, Ref: "v1.0.0"}, true},
+		{"question mark", push("rc?"), repoChange{Event: db.TriggerEventPush, Ref: "rc1"}, true},
+		{"disabled", db.BuildTrigger{Event: db.TriggerEventPush, Pattern: "main"}, repoChange{Event: db.TriggerEventPush, Ref: "main"}, false},
+		{"other event", push("v1"), repoChange{Event: db.TriggerEventTag, Ref: "v1"}, false},
+		{"tag", db.BuildTrigger{Event: db.TriggerEventTag, Pattern: "v*", Enabled: true}, repoChange{Event: db.TriggerEventTag, Ref: "v2.0"}, true},
+		{"pull request action", pullRequest, repoChange{Event: db.TriggerEventPullRequest, Ref: "main", Action: "synchronize"}, true},
+		{"pull request other action", pullRequest, repoChange{Event: db.TriggerEventPullRequest, Ref: "main", Action: "reopened"}, false},
+		{"pull request other base", pullRequest, repoChange{Event: db.TriggerEventPullRequest, Ref: "develop", Action: "opened"}, false},
+		{"invalid pattern", push("[a-"), repoChange{Event: db.TriggerEventPush, Ref: "a"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := triggerMatches(tt.trigger, tt.change); got != tt.want {
+				t.Errorf("triggerMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTouchesFolder(t *testing.T) {
+	tests := []struct {
+		name        string
+		buildFolder string
+		files       []string
+		want        bool
+	}{
+		{"root", "", []string{"README.md"}, true},
+		{"root as dot", ".", []string{"README.md"}, true},
+		{"root as slash", "/", []string{"README.md"}, true},
+		{"root without files", "", nil, true},
+		{"file in folder", "app", []string{"docs/a.md", "app/lib/main.dart"}, true},
+		{"folder itself", "app", []string{"app"}, true},
+		{"sibling with same prefix", "app", []string{"application/lib/main.dart"}, false},
+		{"outside folder", "app", []string{"docs/a.md", "README.md"}, false},
+		{"no files", "app", nil, false},
+		{"nested folder", "apps/mobile", []string{"apps/mobile/pubspec.yaml"}, true},
+		{"parent of nested folder", "apps/mobile", []string{"apps/web/pubspec.yaml"}, false},
+		{"slashes trimmed", "/apps/mobile/", []string{"apps/mobile/pubspec.yaml"}, true},
+		{"cleaned path", "./apps//mobile/../mobile", []string{"apps/mobile/pubspec.yaml"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := touchesFolder(tt.buildFolder, tt.files); got != tt.want {
+				t.Errorf("touchesFolder(%q, %q) = %v, want %v", tt.buildFolder, tt.files, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/webhooks"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	middleware "github.com/flotio-dev/api/pkg/api/v1/middleware"
+	utils "github.com/flotio-dev/api/pkg/utils"
+)
+
+// WebhookDeliveriesGetHandler lists the GitHub webhook deliveries, newest
+// first, for administrators. ?status= filters them (failed by default, all
+// for every status), ?limit= bounds the list (50 by default, 500 at most).
+func WebhookDeliveriesGetHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !middleware.IsAdmin(userInfo) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := db.DB.Order("id DESC")
+	switch status := r.URL.Query().Get("status"); status {
+	case "", db.WebhookDeliveryFailed:
+		query = query.Where("status = ?", db.WebhookDeliveryFailed)
+	case db.WebhookDeliveryProcessing, db.WebhookDeliveryProcessed:
+		query = query.Where("status = ?", status)
+	case "all":
+	default:
+		http.Error(w, "status must be failed, processing, processed or all", http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var deliveries []db.WebhookDelivery
+	if err := query.Limit(limit).Find(&deliveries).Error; err != nil {
+		http.Error(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, map[string]interface{}{"deliveries": deliveries})
+}
+
+// WebhookDeliveryReplayHandler processes a failed GitHub webhook delivery
+// again from its stored payload, for administrators
+func WebhookDeliveryReplayHandler(w http.ResponseWriter, r *http.Request) {
+	userInfo := middleware.GetUserFromContext(r.Context())
+	if userInfo == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !middleware.IsAdmin(userInfo) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var delivery db.WebhookDelivery
+	if err := db.DB.Where("delivery_id = ?", mux.Vars(r)["deliveryId"]).First(&delivery).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to fetch delivery", http.StatusInternalServerError)
+		return
+	}
+
+	if err := webhooks.Replay(&delivery); err != nil {
+		if err == webhooks.ErrNotReplayable {
+			http.Error(w, "Only failed deliveries can be replayed", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to replay delivery", http.StatusInternalServerError)
+		return
+	}
+	processDelivery(&delivery)
+
+	utils.WriteJSON(w, map[string]interface{}{"delivery": delivery})
+}
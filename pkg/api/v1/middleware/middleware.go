@@ -4,10 +4,12 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/Nerzal/gocloak/v13"
 	db "github.com/flotio-dev/api/pkg/db"
 	utils "github.com/flotio-dev/api/pkg/utils"
+	"github.com/gorilla/websocket"
 )
 
 type contextKey string
@@ -21,12 +23,11 @@ const userContextKey contextKey = "user"
 
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" || len(authHeader) < 7 || authHeader[:7] != "Bearer " {
+		token := bearerToken(r)
+		if token == "" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		token := authHeader[7:]
 
 		client := utils.GetKeycloakClient()
 		ctx := context.Background()
@@ -63,9 +64,37 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// bearerToken returns the access token of a request. Browsers cannot set
+// headers on WebSocket handshakes nor EventSource requests, which pass it in
+// the token query parameter.
+func bearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+		return authHeader[7:]
+	}
+	if websocket.IsWebSocketUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
 func GetUserFromContext(ctx context.Context) *UserContext {
 	if user, ok := ctx.Value(userContextKey).(*UserContext); ok {
 		return user
 	}
 	return nil
 }
+
+// IsAdmin reports whether user is a platform administrator, listed by
+// Keycloak ID in ADMIN_KEYCLOAK_IDS (comma-separated)
+func IsAdmin(user *UserContext) bool {
+	if user == nil || user.Keycloak == nil || user.Keycloak.Sub == nil {
+		return false
+	}
+	for _, id := range strings.Split(os.Getenv("ADMIN_KEYCLOAK_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" && id == *user.Keycloak.Sub {
+			return true
+		}
+	}
+	return false
+}
@@ -26,6 +26,14 @@ func Router() http.Handler {
 		w.Write([]byte("ok"))
 	}).Methods("GET")
 
+	// GitHub webhooks, authenticated by their signature
+	webhookSecret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		fmt.Println("GITHUB_WEBHOOK_SECRET is not set, webhook signatures are not verified")
+	}
+	githubController := controller.NewGithubController([]byte(webhookSecret))
+	r.HandleFunc("/github/webhooks", githubController.HandleWebhook).Methods("POST")
+
 	// Protected routes
 	protected := r.PathPrefix("/").Subrouter()
 	protected.Use(middleware.AuthMiddleware)
@@ -41,10 +49,25 @@ func Router() http.Handler {
 	protected.HandleFunc("/project/{id}/env", controller.EnvGetHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/env", controller.EnvPostHandler).Methods("POST")
 	protected.HandleFunc("/project/{id}/envs", controller.EnvGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/envs/import", controller.EnvImportHandler).Methods("POST")
+	protected.HandleFunc("/project/{id}/envs/export", controller.EnvExportHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/environments", controller.EnvironmentsGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/env-revisions", controller.EnvRevisionsGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/env-revisions/{revision}", controller.EnvRevisionGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/env-revisions/{revision}/restore", controller.EnvRevisionRestoreHandler).Methods("POST")
 	protected.HandleFunc("/project/{id}/env/{envId}", controller.EnvGetByIdHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/env/{envId}", controller.EnvPutByIdHandler).Methods("PUT")
 	protected.HandleFunc("/project/{id}/env/{envId}", controller.EnvDeleteByIdHandler).Methods("DELETE")
 
+	// Keystore routes (Android signing, by project)
+	protected.HandleFunc("/project/{id}/keystores", controller.KeystoresGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/keystores", controller.KeystorePostHandler).Methods("POST")
+	protected.HandleFunc("/project/{id}/keystores/generate", controller.KeystoreGenerateHandler).Methods("POST")
+	protected.HandleFunc("/project/{id}/keystores/{keystoreId}", controller.KeystoreGetByIdHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/keystores/{keystoreId}", controller.KeystorePutByIdHandler).Methods("PUT")
+	protected.HandleFunc("/project/{id}/keystores/{keystoreId}", controller.KeystoreDeleteByIdHandler).Methods("DELETE")
+	protected.HandleFunc("/project/{id}/keystores/{keystoreId}/backup", controller.KeystoreBackupHandler).Methods("POST")
+
 	// Project routes
 	protected.HandleFunc("/project", controller.ProjectsGetHandler).Methods("GET")
 	protected.HandleFunc("/project", controller.ProjectCreateHandler).Methods("POST")
@@ -53,22 +76,38 @@ func Router() http.Handler {
 	protected.HandleFunc("/project/{id}", controller.ProjectDeleteHandler).Methods("DELETE")
 	protected.HandleFunc("/project/{id}/build", controller.ProjectBuildHandler).Methods("POST")
 
+	// Build trigger routes (GitHub push and pull request events, by project)
+	protected.HandleFunc("/project/{id}/triggers", controller.TriggersGetHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/triggers", controller.TriggerPostHandler).Methods("POST")
+	protected.HandleFunc("/project/{id}/triggers/{triggerId}", controller.TriggerGetByIdHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/triggers/{triggerId}", controller.TriggerPutByIdHandler).Methods("PUT")
+	protected.HandleFunc("/project/{id}/triggers/{triggerId}", controller.TriggerDeleteByIdHandler).Methods("DELETE")
+
 	// Build routes
 	protected.HandleFunc("/project/{id}/build/{buildId}/cancel", controller.BuildCancelHandler).Methods("PUT")
 	protected.HandleFunc("/project/{id}/builds", controller.BuildsListHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/build/{buildId}", controller.BuildGetHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/build/{buildId}/logs", controller.BuildLogsHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/build/{buildId}/logs/ws", controller.BuildLogsWSHandler).Methods("GET")
 	protected.HandleFunc("/project/{id}/build/{buildId}/download", controller.BuildDownloadHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/build/{buildId}/artifacts", controller.BuildArtifactsHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/build/{buildId}/artifacts/{artifactId}/download", controller.BuildArtifactDownloadHandler).Methods("GET")
+
+	// Build event streams (Server-Sent Events)
+	protected.HandleFunc("/events", controller.UserEventsHandler).Methods("GET")
+	protected.HandleFunc("/project/{id}/events", controller.ProjectEventsHandler).Methods("GET")
 
 	// Github routes
-	fmt.Printf("Webhook secret: '%s'\n", os.Getenv("GITHUB_WEBHOOK_SECRET"))
-	githubController := controller.NewGithubController([]byte(os.Getenv("GITHUB_WEBHOOK_SECRET")))
-	protected.HandleFunc("/github/webhooks", githubController.HandleWebhook)
 	protected.HandleFunc("/github/post-installation", githubController.HandleGithubPostInstallation)
 	protected.HandleFunc("/github/repos", githubController.HandleGithubGetRepositories).Methods("GET")
 	protected.HandleFunc("/github/repo", githubController.HandleGithubRepoTree).Methods("GET")
 	// Check whether the authenticated user has installed the GitHub App
 	protected.HandleFunc("/github/installations", githubController.HandleGithubCheckInstallation).Methods("GET")
 
+	// Admin routes (ADMIN_KEYCLOAK_IDS)
+	protected.HandleFunc("/admin/github/deliveries", controller.WebhookDeliveriesGetHandler).Methods("GET")
+	protected.HandleFunc("/admin/github/deliveries/{deliveryId}/replay", controller.WebhookDeliveryReplayHandler).Methods("POST")
+	protected.HandleFunc("/admin/github/installations/{installationId}/organization", controller.InstallationOrganizationHandler).Methods("PUT")
+
 	return r
 }
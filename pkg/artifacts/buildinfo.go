@@ -0,0 +1,87 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+// BuildInfoFile is the metadata file written by build.sh next to the outputs
+const BuildInfoFile = "build-info.json"
+
+// maxBuildInfoSize bounds how much of build-info.json is read
+const maxBuildInfoSize = 1 << 20
+
+// BuildInfo is the content of build-info.json
+type BuildInfo struct {
+	BuildID        string              `json:"build_id"`
+	Platform       string              `json:"platform"`
+	BuildMode      string              `json:"build_mode"`
+	BuildTarget    string              `json:"build_target"`
+	FlutterChannel string              `json:"flutter_channel"`
+	FlutterVersion string              `json:"flutter_version"`
+	Timestamp      string              `json:"timestamp"`
+	Artifacts      []BuildInfoArtifact `json:"artifacts"`
+}
+
+// BuildInfoArtifact describes one output file in build-info.json
+type BuildInfoArtifact struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ParseBuildInfo decodes build-info.json
+func ParseBuildInfo(r io.Reader) (*BuildInfo, error) {
+	var info BuildInfo
+	if err := json.NewDecoder(io.LimitReader(r, maxBuildInfoSize)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", BuildInfoFile, err)
+	}
+	return &info, nil
+}
+
+// Artifact returns the entry describing the file name, if any
+func (info *BuildInfo) Artifact(name string) (BuildInfoArtifact, bool) {
+	if info != nil {
+		for _, artifact := range info.Artifacts {
+			if artifact.Name == name {
+				return artifact, true
+			}
+		}
+	}
+	return BuildInfoArtifact{}, false
+}
+
+// KindFromName guesses the kind of an artifact from its file name, for
+// outputs not described in build-info.json
+func KindFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".apk"):
+		return db.ArtifactKindAPK
+	case strings.HasSuffix(name, ".aab"):
+		return db.ArtifactKindAAB
+	case strings.HasSuffix(name, ".ipa"):
+		return db.ArtifactKindIPA
+	case strings.HasPrefix(name, "debug-symbols"):
+		return db.ArtifactKindDebugSymbols
+	case strings.HasPrefix(name, "web-build"):
+		return db.ArtifactKindWeb
+	case strings.HasPrefix(name, "ios-build"):
+		return db.ArtifactKindIOSApp
+	}
+	return db.ArtifactKindOther
+}
+
+// validKind reports whether kind is one of the known artifact kinds
+func validKind(kind string) bool {
+	switch kind {
+	case db.ArtifactKindAPK, db.ArtifactKindAAB, db.ArtifactKindIPA, db.ArtifactKindIOSApp,
+		db.ArtifactKindWeb, db.ArtifactKindDebugSymbols, db.ArtifactKindOther:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,338 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"github.com/flotio-dev/api/pkg/storage"
+	"gorm.io/gorm"
+)
+
+const (
+	// collectInterval is how often successful builds are looked up when nothing wakes the collector
+	collectInterval = 30 * time.Second
+
+	// collectBatchSize bounds how many builds are collected per pass
+	collectBatchSize = 20
+
+	// collectDeadline is how long after the end of a build collection is
+	// retried, past which the executor resources are assumed gone
+	collectDeadline = time.Hour
+)
+
+// primaryKinds are the artifact kinds served by the download endpoint, by preference
+var primaryKinds = []string{
+	db.ArtifactKindAPK,
+	db.ArtifactKindAAB,
+	db.ArtifactKindIPA,
+	db.ArtifactKindIOSApp,
+	db.ArtifactKindWeb,
+	db.ArtifactKindOther,
+}
+
+// Collector records the artifacts of successful builds and, when object
+// storage is configured, copies them there so they outlive the build resources
+type Collector struct {
+	executor executor.BuildExecutor
+	storage  *storage.Storage
+	wake     chan struct{}
+}
+
+// NewCollector creates a collector reading artifacts from exec. store may be
+// nil, in which case artifacts are only recorded.
+func NewCollector(exec executor.BuildExecutor, store *storage.Storage) *Collector {
+	return &Collector{
+		executor: exec,
+		storage:  store,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Notify asks the collector to look for builds without waiting for the next poll
+func (c *Collector) Notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run collects artifacts until ctx is cancelled
+func (c *Collector) Run(ctx context.Context) {
+	log.Println("Artifact collector started")
+
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+
+	for {
+		c.collectPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Artifact collector stopped")
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+// collectPending collects the successful builds whose artifacts were not handled yet
+func (c *Collector) collectPending(ctx context.Context) {
+	var builds []db.Build
+	err := db.DB.Where("status = ? AND artifacts_status = ?", db.BuildStatusSuccess, "").
+		Order("finished_at, id").
+		Limit(collectBatchSize).
+		Find(&builds).Error
+	if err != nil {
+		log.Printf("Artifact collector: failed to list builds: %v", err)
+		return
+	}
+
+	for _, build := range builds {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := c.collect(ctx, build); err != nil {
+			log.Printf("Artifact collector: build %d: %v", build.ID, err)
+
+			// Give up once the executor resources have expired
+			if build.FinishedAt != nil && time.Since(*build.FinishedAt) > collectDeadline {
+				c.setStatus(build.ID, db.ArtifactsStatusFailed)
+			}
+		}
+	}
+}
+
+// collect records every artifact of build, uploading them when storage is
+// configured, and selects the one served for download
+func (c *Collector) collect(ctx context.Context, build db.Build) error {
+	list, err := c.executor.Artifacts(ctx, build.ID)
+	if err != nil {
+		if err == executor.ErrNotFound || err == executor.ErrArtifactsUnavailable {
+			c.setStatus(build.ID, db.ArtifactsStatusMissing)
+			return nil
+		}
+		return fmt.Errorf("failed to list artifacts: %v", err)
+	}
+
+	info := c.readBuildInfo(ctx, build.ID, list)
+
+	// Uploads overwrite the same keys, so collecting a build twice is harmless
+	var records []db.BuildArtifact
+	for _, artifact := range list {
+		if artifact.Name == BuildInfoFile {
+			if c.storage != nil {
+				if _, err := c.upload(ctx, build.ID, artifact); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		record, err := c.record(ctx, build.ID, artifact, info)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+
+	kinds := make([]string, len(records))
+	for i, record := range records {
+		kinds[i] = record.Kind
+	}
+	primary := choosePrimary(kinds)
+	if primary < 0 {
+		c.setStatus(build.ID, db.ArtifactsStatusMissing)
+		return nil
+	}
+
+	status := db.ArtifactsStatusRecorded
+	if c.storage != nil {
+		status = db.ArtifactsStatusStored
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("build_id = ?", build.ID).Delete(&db.BuildArtifact{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&records).Error; err != nil {
+			return err
+		}
+		return tx.Model(&db.Build{}).Where("id = ?", build.ID).Updates(map[string]interface{}{
+			"artifact_name":    records[primary].Name,
+			"artifact_key":     records[primary].StorageKey,
+			"apk_url":          DownloadURL(build.ProjectID, build.ID),
+			"artifacts_status": status,
+		}).Error
+	})
+}
+
+// record describes an artifact, preferring the kind declared in
+// build-info.json. The checksum is computed from the content when it is
+// uploaded or not declared.
+func (c *Collector) record(ctx context.Context, buildID uint, artifact executor.Artifact, info *BuildInfo) (db.BuildArtifact, error) {
+	record := db.BuildArtifact{
+		BuildID: buildID,
+		Name:    artifact.Name,
+		Kind:    KindFromName(artifact.Name),
+		Size:    artifact.Size,
+	}
+
+	declared, ok := info.Artifact(artifact.Name)
+	if ok && validKind(declared.Kind) {
+		record.Kind = declared.Kind
+	}
+
+	switch {
+	case c.storage != nil:
+		sum, err := c.upload(ctx, buildID, artifact)
+		if err != nil {
+			return record, err
+		}
+		record.SHA256 = sum
+		record.StorageKey = Key(buildID, artifact.Name)
+		if ok && declared.SHA256 != "" && declared.SHA256 != sum {
+			log.Printf("Artifact collector: build %d: checksum of %s differs from %s", buildID, artifact.Name, BuildInfoFile)
+		}
+	case ok && declared.SHA256 != "":
+		record.SHA256 = declared.SHA256
+	default:
+		sum, err := c.checksum(ctx, buildID, artifact.Name)
+		if err != nil {
+			return record, err
+		}
+		record.SHA256 = sum
+	}
+
+	return record, nil
+}
+
+// readBuildInfo returns the parsed build-info.json of a build, or nil when
+// it is absent or invalid
+func (c *Collector) readBuildInfo(ctx context.Context, buildID uint, list []executor.Artifact) *BuildInfo {
+	found := false
+	for _, artifact := range list {
+		if artifact.Name == BuildInfoFile {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	reader, err := c.executor.OpenArtifact(ctx, buildID, BuildInfoFile)
+	if err != nil {
+		log.Printf("Artifact collector: build %d: failed to open %s: %v", buildID, BuildInfoFile, err)
+		return nil
+	}
+	defer reader.Close()
+
+	info, err := ParseBuildInfo(reader)
+	if err != nil {
+		log.Printf("Artifact collector: build %d: %v", buildID, err)
+		return nil
+	}
+	return info
+}
+
+// upload copies an artifact to storage and returns its SHA-256 checksum
+func (c *Collector) upload(ctx context.Context, buildID uint, artifact executor.Artifact) (string, error) {
+	reader, err := c.executor.OpenArtifact(ctx, buildID, artifact.Name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", artifact.Name, err)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if err := c.storage.Upload(ctx, Key(buildID, artifact.Name), io.TeeReader(reader, hash), artifact.Size, ContentType(artifact.Name)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksum reads an artifact from the executor and returns its SHA-256 checksum
+func (c *Collector) checksum(ctx context.Context, buildID uint, name string) (string, error) {
+	reader, err := c.executor.OpenArtifact(ctx, buildID, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *Collector) setStatus(buildID uint, status string) {
+	err := db.DB.Model(&db.Build{}).Where("id = ?", buildID).Update("artifacts_status", status).Error
+	if err != nil {
+		log.Printf("Artifact collector: failed to update build %d: %v", buildID, err)
+	}
+}
+
+// Key returns the object storage key of a build artifact
+func Key(buildID uint, name string) string {
+	return fmt.Sprintf("builds/%d/%s", buildID, name)
+}
+
+// DownloadURL returns the API path downloading the primary artifact of a build
+func DownloadURL(projectID, buildID uint) string {
+	return fmt.Sprintf("/project/%d/build/%d/download", projectID, buildID)
+}
+
+// Primary returns the artifact served by the download endpoint: the first
+// package by kind preference, never build metadata nor debug symbols
+func Primary(artifacts []executor.Artifact) (executor.Artifact, bool) {
+	kinds := make([]string, len(artifacts))
+	for i, artifact := range artifacts {
+		kinds[i] = KindFromName(artifact.Name)
+		if artifact.Name == BuildInfoFile {
+			kinds[i] = ""
+		}
+	}
+
+	i := choosePrimary(kinds)
+	if i < 0 {
+		return executor.Artifact{}, false
+	}
+	return artifacts[i], true
+}
+
+// choosePrimary returns the index of the preferred kind in kinds, or -1
+func choosePrimary(kinds []string) int {
+	for _, kind := range primaryKinds {
+		for i, k := range kinds {
+			if k == kind {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// ContentType returns the MIME type of an artifact from its name
+func ContentType(name string) string {
+	switch path.Ext(name) {
+	case ".apk":
+		return "application/vnd.android.package-archive"
+	case ".ipa", ".aab":
+		return "application/octet-stream"
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
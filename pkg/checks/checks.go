@@ -0,0 +1,384 @@
+// Package checks reports the builds of commits to GitHub as Check Runs and
+// commit statuses
+package checks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/githubapp"
+	"github.com/google/go-github/v76/github"
+	"gorm.io/gorm"
+)
+
+const (
+	// reportInterval is how often builds are looked up when nothing wakes the reporter
+	reportInterval = 15 * time.Second
+
+	// reportBatchSize bounds how many builds are reported per pass
+	reportBatchSize = 20
+
+	// reportDeadline is how long after its last change a build is still
+	// reported, past which failing reports are abandoned
+	reportDeadline = time.Hour
+
+	// logsGracePeriod is how long the completion of a failed build waits for
+	// its logs to be stored
+	logsGracePeriod = 2 * time.Minute
+
+	// failureLogLines is how many of the last log lines a failed build shows
+	failureLogLines = 50
+
+	// maxOutputText is the size GitHub accepts at most for each output field
+	maxOutputText = 65535
+
+	// maxStatusDescription is the length GitHub accepts at most for the
+	// description of a commit status
+	maxStatusDescription = 140
+
+	// reportLockKey is the Postgres advisory lock namespace serialising the
+	// reports of a build across API replicas
+	reportLockKey = 727003
+
+	// RerunAction identifies the Re-run button of completed Check Runs
+	RerunAction = "rerun"
+)
+
+// Reporter creates and updates the Check Run of each build tied to a commit
+type Reporter struct {
+	wake chan struct{}
+}
+
+// NewReporter creates a reporter
+func NewReporter() *Reporter {
+	return &Reporter{wake: make(chan struct{}, 1)}
+}
+
+// Notify asks the reporter to look for builds without waiting for the next poll
+func (r *Reporter) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run reports build changes until ctx is cancelled
+func (r *Reporter) Run(ctx context.Context) {
+	log.Println("Check Run reporter started")
+
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	for {
+		r.reportPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Check Run reporter stopped")
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// reportPending reports the builds whose status changed since their Check
+// Run was last updated
+func (r *Reporter) reportPending(ctx context.Context) {
+	var builds []db.Build
+	err := db.DB.Preload("Project").
+		Where("commit_sha <> '' AND check_run_status <> status AND updated_at > ?", time.Now().Add(-reportDeadline)).
+		Order("updated_at, id").
+		Limit(reportBatchSize).
+		Find(&builds).Error
+	if err != nil {
+		log.Printf("Check Run reporter: failed to list builds: %v", err)
+		return
+	}
+
+	for _, build := range builds {
+		if ctx.Err() != nil {
+			return
+		}
+		if !ready(build) {
+			continue
+		}
+		if err := reportBuild(ctx, build.ID); err != nil {
+			// Retried on a next pass
+			log.Printf("Check Run reporter: build %d: %v", build.ID, err)
+		}
+	}
+}
+
+// reportBuild reports the current status of a build while holding a lock on
+// it, so API replicas neither report a change twice nor create two Check
+// Runs for a build whose first one is being created
+func reportBuild(ctx context.Context, buildID uint) error {
+	return db.DB.Connection(func(conn *gorm.DB) error {
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?, ?)", reportLockKey, buildID).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?, ?)", reportLockKey, buildID)
+
+		// Read again under the lock, another replica may have reported it
+		var build db.Build
+		if err := db.DB.Preload("Project").First(&build, buildID).Error; err != nil {
+			return err
+		}
+		if build.CheckRunStatus == build.Status || !ready(build) {
+			return nil
+		}
+
+		if err := report(ctx, build); err != nil {
+			return err
+		}
+		return db.DB.Model(&db.Build{}).Where("id = ?", build.ID).UpdateColumn("check_run_status", build.Status).Error
+	})
+}
+
+// ready reports whether the details shown for the status of build are
+// known: the artifacts of successful builds, the logs of failed ones
+func ready(build db.Build) bool {
+	switch build.Status {
+	case db.BuildStatusSuccess:
+		return build.ArtifactsStatus != ""
+	case db.BuildStatusFailed:
+		return build.LogsComplete || build.FinishedAt == nil || time.Since(*build.FinishedAt) > logsGracePeriod
+	}
+	return true
+}
+
+// report creates or updates the Check Run of build, then sets its commit
+// status. Builds of projects whose
+// owner has no GitHub App installation are not reported.
+func report(ctx context.Context, build db.Build) error {
+	owner, repo, ok := githubapp.ParseRepo(build.Project.GitRepo)
+	if !ok || !githubapp.Configured() {
+		return nil
+	}
+	installation, err := db.ProjectInstallation(build.Project)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := githubapp.InstallationClient(installation.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	output, err := buildOutput(build)
+	if err != nil {
+		return err
+	}
+	status, conclusion := checkStatus(build)
+	var completedAt *github.Timestamp
+	var actions []*github.CheckRunAction
+	if conclusion != nil {
+		completedAt = &github.Timestamp{Time: time.Now()}
+		if build.FinishedAt != nil {
+			completedAt.Time = *build.FinishedAt
+		}
+		actions = []*github.CheckRunAction{{
+			Label:       "Re-run",
+			Description: "Build this commit again",
+			Identifier:  RerunAction,
+		}}
+	}
+	externalID := strconv.FormatUint(uint64(build.ID), 10)
+
+	if build.CheckRunID != 0 {
+		_, _, err := client.Checks.UpdateCheckRun(ctx, owner, repo, build.CheckRunID, github.UpdateCheckRunOptions{
+			Name:        checkName(build),
+			ExternalID:  &externalID,
+			Status:      &status,
+			Conclusion:  conclusion,
+			CompletedAt: completedAt,
+			Output:      output,
+			Actions:     actions,
+		})
+		if err != nil {
+			return err
+		}
+		return setCommitStatus(ctx, client, owner, repo, build, output.GetTitle())
+	}
+
+	opts := github.CreateCheckRunOptions{
+		Name:        checkName(build),
+		HeadSHA:     build.CommitSHA,
+		ExternalID:  &externalID,
+		Status:      &status,
+		Conclusion:  conclusion,
+		CompletedAt: completedAt,
+		Output:      output,
+		Actions:     actions,
+	}
+	if build.StartedAt != nil {
+		opts.StartedAt = &github.Timestamp{Time: *build.StartedAt}
+	}
+	run, _, err := client.Checks.CreateCheckRun(ctx, owner, repo, opts)
+	if err != nil {
+		return err
+	}
+	if err := db.DB.Model(&db.Build{}).Where("id = ?", build.ID).UpdateColumn("check_run_id", run.GetID()).Error; err != nil {
+		return err
+	}
+	return setCommitStatus(ctx, client, owner, repo, build, output.GetTitle())
+}
+
+// setCommitStatus mirrors the Check Run of build as a commit status, for the
+// branch protection rules and tools that only read statuses
+func setCommitStatus(ctx context.Context, client *github.Client, owner, repo string, build db.Build, description string) error {
+	if len(description) > maxStatusDescription {
+		description = description[:maxStatusDescription]
+	}
+	status := &github.RepoStatus{
+		State:       github.Ptr(commitState(build)),
+		Context:     github.Ptr(checkName(build)),
+		Description: github.Ptr(description),
+	}
+	if baseURL := strings.TrimRight(os.Getenv("API_PUBLIC_URL"), "/"); baseURL != "" {
+		status.TargetURL = github.Ptr(fmt.Sprintf("%s/project/%d/build/%d", baseURL, build.ProjectID, build.ID))
+	}
+	_, _, err := client.Repositories.CreateStatus(ctx, owner, repo, build.CommitSHA, status)
+	return err
+}
+
+// commitState returns the commit status state of build
+func commitState(build db.Build) string {
+	switch build.Status {
+	case db.BuildStatusQueued, db.BuildStatusPending, db.BuildStatusRunning:
+		return "pending"
+	case db.BuildStatusSuccess:
+		return "success"
+	case db.BuildStatusCancelled:
+		return "error"
+	}
+	return "failure"
+}
+
+// checkName names the Check Run after the build settings, so the builds of
+// several triggers of a commit are told apart
+func checkName(build db.Build) string {
+	name := fmt.Sprintf("Flotio: %s %s (%s)", build.Platform, build.BuildTarget, build.BuildMode)
+	if build.Environment != "" {
+		name += " - " + build.Environment
+	}
+	return name
+}
+
+// checkStatus returns the Check Run status of build, and its conclusion once
+// finished
+func checkStatus(build db.Build) (string, *string) {
+	conclusion := ""
+	switch build.Status {
+	case db.BuildStatusQueued:
+		return "queued", nil
+	case db.BuildStatusPending, db.BuildStatusRunning:
+		return "in_progress", nil
+	case db.BuildStatusSuccess:
+		conclusion = "success"
+	case db.BuildStatusCancelled:
+		conclusion = "cancelled"
+	default:
+		conclusion = "failure"
+		if build.TerminationReason == "DeadlineExceeded" {
+			conclusion = "timed_out"
+		}
+	}
+	return "completed", &conclusion
+}
+
+// buildOutput describes build: its settings and duration, the artifacts of
+// successful builds and the end of the logs of failed ones
+func buildOutput(build db.Build) (*github.CheckRunOutput, error) {
+	title := fmt.Sprintf("Build #%d %s", build.ID, build.Status)
+	if build.Status == db.BuildStatusFailed && build.TerminationReason != "" {
+		title += " (" + build.TerminationReason + ")"
+	}
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "**Build #%d**: %s, %s, %s, Flutter %s\n\n", build.ID, build.Platform, build.BuildMode, build.BuildTarget, build.FlutterChannel)
+	if build.Environment != "" {
+		fmt.Fprintf(&summary, "Environment: %s\n\n", build.Environment)
+	}
+	if build.IsFinished() && build.Duration > 0 {
+		fmt.Fprintf(&summary, "Duration: %s\n\n", time.Duration(build.Duration)*time.Second)
+	}
+
+	if build.Status == db.BuildStatusSuccess {
+		var artifacts []db.BuildArtifact
+		if err := db.DB.Where("build_id = ?", build.ID).Order("id").Find(&artifacts).Error; err != nil {
+			return nil, err
+		}
+		if len(artifacts) > 0 {
+			summary.WriteString("### Artifacts\n\n")
+			baseURL := strings.TrimRight(os.Getenv("API_PUBLIC_URL"), "/")
+			for _, artifact := range artifacts {
+				name := artifact.Name
+				if baseURL != "" {
+					name = fmt.Sprintf("[%s](%s/project/%d/build/%d/artifacts/%d/download)", artifact.Name, baseURL, build.ProjectID, build.ID, artifact.ID)
+				}
+				fmt.Fprintf(&summary, "- %s (%s)\n", name, formatSize(artifact.Size))
+			}
+		}
+	}
+
+	output := &github.CheckRunOutput{
+		Title:   github.Ptr(title),
+		Summary: github.Ptr(summary.String()),
+	}
+
+	if build.Status == db.BuildStatusFailed {
+		var lines []db.Log
+		if err := db.DB.Where("build_id = ?", build.ID).Order("line_number DESC").Limit(failureLogLines).Find(&lines).Error; err != nil {
+			return nil, err
+		}
+		if len(lines) > 0 {
+			output.Text = github.Ptr(logText(lines))
+		}
+	}
+
+	return output, nil
+}
+
+// logText formats log lines, given newest first, as a code block within the
+// size GitHub accepts, dropping the oldest lines that do not fit
+func logText(lines []db.Log) string {
+	var content []string
+	size := 0
+	for _, line := range lines {
+		text := strings.ReplaceAll(line.Content, "```", "'''") + "\n"
+		if size+len(text) > maxOutputText-100 {
+			break
+		}
+		size += len(text)
+		content = append(content, text)
+	}
+	slices.Reverse(content)
+
+	return fmt.Sprintf("### Last %d log lines\n\n```\n%s```\n", len(content), strings.Join(content, ""))
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -24,8 +24,17 @@ func InitDB() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Older API versions could store the same log line twice, which the
+	// unique index on (build_id, line_number) no longer allows
+	if DB.Migrator().HasTable(&Log{}) && !DB.Migrator().HasIndex(&Log{}, "idx_logs_build_line") {
+		err = DB.Exec("DELETE FROM logs a USING logs b WHERE a.build_id = b.build_id AND a.line_number = b.line_number AND a.id > b.id").Error
+		if err != nil {
+			log.Fatalf("Failed to remove duplicate log lines: %v", err)
+		}
+	}
+
 	// Auto migrate
-	err = DB.AutoMigrate(&User{}, &Project{}, &Build{}, &Env{}, &Organization{}, &GithubInstallation{})
+	err = DB.AutoMigrate(&User{}, &Project{}, &Build{}, &BuildArtifact{}, &BuildEvent{}, &BuildTrigger{}, &Env{}, &EnvRevision{}, &Keystore{}, &Organization{}, &GithubInstallation{}, &WebhookDelivery{})
 	if err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
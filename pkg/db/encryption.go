@@ -0,0 +1,124 @@
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/flotio-dev/api/pkg/secrets"
+)
+
+// EncryptedString is a text column encrypted at rest (see pkg/secrets).
+// Values are encrypted when written and decrypted when loaded, so the code
+// only handles plaintext. Rows written before encryption was configured are
+// read as is until RotateEncryptionKeys encrypts them.
+type EncryptedString string
+
+// Value encrypts the string for storage
+func (s EncryptedString) Value() (driver.Value, error) {
+	return secrets.Encrypt(string(s))
+}
+
+// Scan decrypts a stored value
+func (s *EncryptedString) Scan(value interface{}) error {
+	var stored string
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("unsupported type %T for an encrypted string", value)
+	}
+
+	plaintext, err := secrets.Decrypt(stored)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// encryptedColumns lists every EncryptedString column
+var encryptedColumns = []struct {
+	table  string
+	column string
+}{
+	{"builds", "git_username"},
+	{"builds", "git_password"},
+	{"builds", "git_token"},
+	{"envs", "value"},
+	{"env_revisions", "snapshot"},
+	{"keystores", "store_password"},
+	{"keystores", "key_password"},
+	{"keystores", "keystore_file"},
+	{"users", "github_access_token"},
+	{"users", "github_refresh_token"},
+}
+
+// rotateBatchSize bounds how many rows are read at once during a rotation
+const rotateBatchSize = 500
+
+// RotateEncryptionKeys wraps the data key of every encrypted value with the
+// current master key, and encrypts values still stored in plaintext. Values
+// wrapped by a previous key must remain readable, so the previous keys are
+// kept configured until the rotation completes. It returns the number of
+// values updated.
+func RotateEncryptionKeys() (int, error) {
+	if !secrets.Configured() {
+		return 0, secrets.ErrNotConfigured
+	}
+
+	updated := 0
+	for _, c := range encryptedColumns {
+		if !DB.Migrator().HasTable(c.table) {
+			continue
+		}
+
+		var lastID uint
+		for {
+			var rows []struct {
+				ID    uint
+				Value string
+			}
+			err := DB.Table(c.table).
+				Select("id, "+c.column+" AS value").
+				Where("id > ? AND "+c.column+" <> ''", lastID).
+				Order("id").
+				Limit(rotateBatchSize).
+				Scan(&rows).Error
+			if err != nil {
+				return updated, fmt.Errorf("failed to read %s.%s: %v", c.table, c.column, err)
+			}
+
+			for _, row := range rows {
+				lastID = row.ID
+
+				rewrapped, changed, err := secrets.Rewrap(row.Value)
+				if err != nil {
+					return updated, fmt.Errorf("%s.%s of row %d: %v", c.table, c.column, row.ID, err)
+				}
+				if !changed {
+					continue
+				}
+
+				// Skip rows modified since they were read, they hold a fresh value
+				result := DB.Table(c.table).
+					Where("id = ? AND "+c.column+" = ?", row.ID, row.Value).
+					UpdateColumn(c.column, rewrapped)
+				if result.Error != nil {
+					return updated, fmt.Errorf("failed to update %s.%s of row %d: %v", c.table, c.column, row.ID, result.Error)
+				}
+				updated += int(result.RowsAffected)
+			}
+
+			if len(rows) < rotateBatchSize {
+				break
+			}
+		}
+	}
+
+	return updated, nil
+}
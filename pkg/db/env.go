@@ -0,0 +1,195 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxEnvFilesSize bounds the decoded content of all the files of a project:
+// they are mounted from a single ConfigMap, which Kubernetes limits to 1 MiB
+const MaxEnvFilesSize = 1 << 20
+
+// FileContent returns the content of a file env, decoded when stored as
+// base64
+func (e *Env) FileContent() ([]byte, error) {
+	if !e.IsBase64 {
+		return []byte(e.Value), nil
+	}
+	content, err := base64.StdEncoding.DecodeString(string(e.Value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 content for %s: %v", e.Key, err)
+	}
+	return content, nil
+}
+
+// ResolveEnvs returns the current envs of a project that apply to a build in
+// environment
+func ResolveEnvs(projectID uint, environment string) ([]Env, error) {
+	var envs []Env
+	if err := DB.Where("project_id = ? AND environment IN ?", projectID, []string{"", environment}).Order("id").Find(&envs).Error; err != nil {
+		return nil, err
+	}
+	return resolveEnvs(envs, environment), nil
+}
+
+// BuildEnvs returns the envs a build uses: those of its env revision,
+// resolved for its environment. Builds without revision use the current
+// envs.
+func BuildEnvs(projectID uint, revision int, environment string) ([]Env, error) {
+	if revision == 0 {
+		return ResolveEnvs(projectID, environment)
+	}
+	envs, err := RevisionEnvs(projectID, revision)
+	if err != nil {
+		return nil, err
+	}
+	return resolveEnvs(envs, environment), nil
+}
+
+// resolveEnvs keeps the envs of environment, and the shared ones (without
+// environment) they do not override. Variables and files are matched by
+// type and key, the latest one winning among duplicates.
+func resolveEnvs(envs []Env, environment string) []Env {
+	index := make(map[string]int)
+	var resolved []Env
+	for _, env := range envs {
+		if env.Environment != "" && env.Environment != environment {
+			continue
+		}
+		id := env.Type + ":" + env.Key
+		i, seen := index[id]
+		if !seen {
+			index[id] = len(resolved)
+			resolved = append(resolved, env)
+			continue
+		}
+		if env.Environment != "" || resolved[i].Environment == "" {
+			resolved[i] = env
+		}
+	}
+	return resolved
+}
+
+// envSnapshot is an env as recorded in a revision
+type envSnapshot struct {
+	ID          uint   `json:"id"`
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Type        string `json:"type"`
+	Path        string `json:"path,omitempty"`
+	IsBase64    bool   `json:"is_base64,omitempty"`
+	Secret      bool   `json:"secret,omitempty"`
+	Environment string `json:"environment,omitempty"`
+}
+
+// Envs returns the envs recorded in the revision, with the IDs they had
+func (r *EnvRevision) Envs() ([]Env, error) {
+	var snapshot []envSnapshot
+	if err := json.Unmarshal([]byte(r.Snapshot), &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read env revision %d: %v", r.Number, err)
+	}
+	envs := make([]Env, len(snapshot))
+	for i, s := range snapshot {
+		envs[i] = Env{
+			ProjectID:   r.ProjectID,
+			Key:         s.Key,
+			Value:       EncryptedString(s.Value),
+			Type:        s.Type,
+			Path:        s.Path,
+			IsBase64:    s.IsBase64,
+			Secret:      s.Secret,
+			Environment: s.Environment,
+		}
+		envs[i].ID = s.ID
+	}
+	return envs, nil
+}
+
+// RevisionEnvs returns the envs recorded in a revision of a project
+func RevisionEnvs(projectID uint, number int) ([]Env, error) {
+	var revision EnvRevision
+	if err := DB.Where("project_id = ? AND number = ?", projectID, number).First(&revision).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch env revision %d: %v", number, err)
+	}
+	return revision.Envs()
+}
+
+// RecordEnvRevision records the current envs of a project as its next
+// revision. Call it in the transaction changing the envs: it locks the
+// project so concurrent changes get consecutive numbers.
+func RecordEnvRevision(tx *gorm.DB, projectID uint, author *User, action, summary string) (*EnvRevision, error) {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&Project{}, projectID).Error; err != nil {
+		return nil, err
+	}
+
+	var envs []Env
+	if err := tx.Where("project_id = ?", projectID).Order("id").Find(&envs).Error; err != nil {
+		return nil, err
+	}
+	snapshot := make([]envSnapshot, len(envs))
+	for i, env := range envs {
+		snapshot[i] = envSnapshot{
+			ID:          env.ID,
+			Key:         env.Key,
+			Value:       string(env.Value),
+			Type:        env.Type,
+			Path:        env.Path,
+			IsBase64:    env.IsBase64,
+			Secret:      env.Secret,
+			Environment: env.Environment,
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	var last int
+	if err := tx.Model(&EnvRevision{}).Where("project_id = ?", projectID).Select("COALESCE(MAX(number), 0)").Scan(&last).Error; err != nil {
+		return nil, err
+	}
+
+	revision := EnvRevision{
+		ProjectID: projectID,
+		Number:    last + 1,
+		Action:    action,
+		Summary:   summary,
+		Snapshot:  EncryptedString(data),
+	}
+	if author != nil {
+		revision.AuthorID = &author.ID
+		revision.AuthorUsername = author.Username
+	}
+	if err := tx.Create(&revision).Error; err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// CurrentEnvRevision returns the number of the latest env revision of a
+// project, recording the current envs first if the project has none yet.
+// tx must be a transaction: the project stays locked until it ends.
+func CurrentEnvRevision(tx *gorm.DB, projectID uint) (int, error) {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&Project{}, projectID).Error; err != nil {
+		return 0, err
+	}
+
+	var revision EnvRevision
+	err := tx.Where("project_id = ?", projectID).Order("number DESC").First(&revision).Error
+	if err == nil {
+		return revision.Number, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return 0, err
+	}
+
+	created, err := RecordEnvRevision(tx, projectID, nil, EnvRevisionInitial, "")
+	if err != nil {
+		return 0, err
+	}
+	return created.Number, nil
+}
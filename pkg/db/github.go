@@ -0,0 +1,22 @@
+package db
+
+// ProjectInstallation returns the GitHub App installation a project builds
+// with: that of its organization, or of its owner for personal projects.
+// It returns gorm.ErrRecordNotFound when there is none.
+func ProjectInstallation(project Project) (*GithubInstallation, error) {
+	query := DB.Where("user_id = ?", project.UserID)
+	if project.OrganizationID != nil {
+		query = DB.Where("organization_id = ?", *project.OrganizationID)
+	}
+	var installation GithubInstallation
+	if err := query.First(&installation).Error; err != nil {
+		return nil, err
+	}
+	return &installation, nil
+}
+
+// Buildable reports whether builds of the project may start: its GitHub App
+// installation is not suspended or deleted, and still grants its repository
+func (p *Project) Buildable() bool {
+	return p.DisabledReason == "" && !p.RepoRemoved
+}
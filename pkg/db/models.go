@@ -1,19 +1,21 @@
 package db
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
 // User model - additional info beyond Keycloak
 type User struct {
 	gorm.Model
-	KeycloakID         string    `gorm:"uniqueIndex" json:"keycloak_id"`
-	GithubID           *string   `json:"github_id"`
-	Email              string    `gorm:"uniqueIndex" json:"email"`
-	Username           string    `json:"username"`
-	GithubAccessToken  string    `json:"github_access_token"`
-	GithubRefreshToken string    `json:"github_refresh_token"`
-	Projects           []Project `gorm:"foreignKey:UserID" json:"projects"`
+	KeycloakID         string          `gorm:"uniqueIndex" json:"keycloak_id"`
+	GithubID           *string         `json:"github_id"`
+	Email              string          `gorm:"uniqueIndex" json:"email"`
+	Username           string          `json:"username"`
+	GithubAccessToken  EncryptedString `json:"github_access_token"`
+	GithubRefreshToken EncryptedString `json:"github_refresh_token"`
+	Projects           []Project       `gorm:"foreignKey:UserID" json:"projects"`
 
 	GithubInstallation *GithubInstallation `gorm:"foreignKey:UserID"`
 }
@@ -25,58 +27,234 @@ type Project struct {
 	GitRepo        string  `json:"git_repo"`
 	BuildFolder    string  `json:"build_folder"`
 	FlutterVersion string  `json:"flutter_version"`
+	BuildTimeout   int     `json:"build_timeout"`                                        // build deadline in seconds, 0 for the default
+	DisabledReason string  `gorm:"not null;default:''" json:"disabled_reason,omitempty"` // set while the GitHub App installation it builds with is suspended or deleted
+	RepoRemoved    bool    `gorm:"not null;default:false" json:"repository_removed"`     // the repository was removed from the GitHub App installation
 	UserID         uint    `json:"user_id"`
 	User           User    `json:"user"`
+	OrganizationID *uint   `gorm:"index" json:"organization_id,omitempty"` // builds with the GitHub App installation of the organization
 	Builds         []Build `gorm:"foreignKey:ProjectID" json:"builds"`
 	Envs           []Env   `gorm:"foreignKey:ProjectID" json:"envs"`
 }
 
+// Reasons a project is disabled
+const (
+	ProjectDisabledInstallationSuspended = "installation_suspended"
+	ProjectDisabledInstallationDeleted   = "installation_deleted"
+)
+
+// Build statuses
+const (
+	BuildStatusQueued    = "queued"
+	BuildStatusPending   = "pending"
+	BuildStatusRunning   = "running"
+	BuildStatusSuccess   = "success"
+	BuildStatusFailed    = "failed"
+	BuildStatusCancelled = "cancelled"
+)
+
+// Artifact collection statuses of successful builds
+const (
+	ArtifactsStatusStored   = "stored"   // copied to object storage
+	ArtifactsStatusRecorded = "recorded" // listed, served by the executor while its resources exist
+	ArtifactsStatusMissing  = "missing"  // the build produced no artifact
+	ArtifactsStatusFailed   = "failed"   // the artifacts could not be copied
+)
+
+// Build artifact kinds
+const (
+	ArtifactKindAPK          = "apk"
+	ArtifactKindAAB          = "aab"
+	ArtifactKindIPA          = "ipa"
+	ArtifactKindIOSApp       = "ios_app"
+	ArtifactKindWeb          = "web"
+	ArtifactKindDebugSymbols = "debug_symbols"
+	ArtifactKindOther        = "other"
+)
+
 // Build model
 type Build struct {
 	gorm.Model
-	ProjectID   uint    `json:"project_id"`
-	Project     Project `json:"project"`
-	Status      string  `json:"status"`       // pending, running, success, failed
-	Platform    string  `json:"platform"`     // e.g., android, ios
-	ContainerID string  `json:"container_id"` // Kubernetes container ID
-	Duration    int64   `json:"duration"`     // build duration in seconds
-	APKURL      string  `json:"apk_url"`
-	Logs        []Log   `gorm:"foreignKey:BuildID" json:"logs"`
+	ProjectID         uint            `json:"project_id"`
+	Project           Project         `json:"project"`
+	Status            string          `gorm:"index" json:"status"` // queued, pending, running, success, failed, cancelled
+	Platform          string          `json:"platform"`            // e.g., android, ios
+	BuildMode         string          `json:"build_mode"`          // release, debug, profile
+	BuildTarget       string          `json:"build_target"`        // apk, aab, ios, web
+	FlutterChannel    string          `json:"flutter_channel"`
+	GitBranch         string          `json:"git_branch"`
+	CommitSHA         string          `json:"commit_sha"`             // commit built, empty for the head of GitBranch
+	PullRequest       int             `json:"pull_request,omitempty"` // pull request number, for pull request builds
+	TriggerID         *uint           `json:"trigger_id"`             // trigger that started the build, nil when started from the API
+	WebhookDelivery   string          `gorm:"index" json:"-"`         // GitHub delivery that queued the build, so a replay does not queue it twice
+	Environment       string          `json:"environment"`            // env scope, empty for the shared envs only
+	EnvRevision       int             `json:"env_revision"`           // revision of the project envs used, 0 for the current envs
+	GitUsername       EncryptedString `json:"-"`                      // cleared once the logs are complete
+	GitPassword       EncryptedString `json:"-"`                      // cleared once the logs are complete
+	GitToken          EncryptedString `json:"-"`                      // installation token minted for the clone, cleared once the logs are complete
+	ContainerID       string          `json:"container_id"`           // Kubernetes container ID
+	Duration          int64           `json:"duration"`               // build duration in seconds
+	StartedAt         *time.Time      `json:"started_at"`
+	FinishedAt        *time.Time      `json:"finished_at"`
+	ExitCode          *int32          `json:"exit_code"`
+	TerminationReason string          `json:"termination_reason"` // e.g., Completed, Error, OOMKilled
+	CancelledAt       *time.Time      `json:"cancelled_at"`
+	CancelledByID     *uint           `json:"cancelled_by_id"`
+	CancelledBy       *User           `gorm:"foreignKey:CancelledByID" json:"cancelled_by,omitempty"`
+	APKURL            string          `json:"apk_url"`
+	ArtifactName      string          `json:"artifact_name"`
+	ArtifactKey       string          `json:"-"`
+	ArtifactsStatus   string          `gorm:"index" json:"artifacts_status"`
+	Artifacts         []BuildArtifact `gorm:"foreignKey:BuildID" json:"artifacts,omitempty"`
+	Logs              []Log           `gorm:"foreignKey:BuildID" json:"logs"`
+	LogsComplete      bool            `json:"logs_complete"`          // the whole output is stored
+	CheckRunID        int64           `json:"check_run_id,omitempty"` // GitHub Check Run reporting the build of CommitSHA
+	CheckRunStatus    string          `json:"-"`                      // build status last reported in the Check Run
+
+	// Queue information, computed on read for queued builds
+	QueuePosition    int        `gorm:"-" json:"queue_position,omitempty"`
+	EstimatedStartAt *time.Time `gorm:"-" json:"estimated_start_at,omitempty"`
+}
+
+// IsFinished reports whether the build reached a terminal status
+func (b *Build) IsFinished() bool {
+	switch b.Status {
+	case BuildStatusSuccess, BuildStatusFailed, BuildStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Build event types
+const (
+	BuildEventQueued       = "queued"
+	BuildEventStarted      = "started"
+	BuildEventPhaseChanged = "phase_changed"
+	BuildEventSucceeded    = "succeeded"
+	BuildEventFailed       = "failed"
+	BuildEventCancelled    = "cancelled"
+)
+
+// Build trigger events
+const (
+	TriggerEventPush        = "push"         // commits pushed to a branch
+	TriggerEventTag         = "tag"          // tag pushed
+	TriggerEventPullRequest = "pull_request" // pull request opened or updated
+)
+
+// BuildTrigger starts builds of a project on the GitHub events it matches
+type BuildTrigger struct {
+	gorm.Model
+	ProjectID          uint     `gorm:"index" json:"project_id"`
+	Event              string   `json:"event"`                                                 // push, tag, pull_request
+	Pattern            string   `json:"pattern"`                                               // glob on the branch, tag or pull request base branch, empty for any
+	PullRequestActions []string `gorm:"serializer:json" json:"pull_request_actions,omitempty"` // opened, synchronize, reopened
+	Platform           string   `json:"platform"`
+	BuildMode          string   `json:"build_mode"`
+	BuildTarget        string   `json:"build_target"`
+	FlutterChannel     string   `json:"flutter_channel"`
+	Environment        string   `gorm:"not null;default:''" json:"environment"`
+	Enabled            bool     `gorm:"not null" json:"enabled"`
+}
+
+// BuildEvent records a build lifecycle change. Its ID orders the events
+// streamed to dashboards, which resume from the last ID they received.
+type BuildEvent struct {
+	ID             uint      `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+	BuildID        uint      `json:"build_id"`
+	ProjectID      uint      `gorm:"index" json:"project_id"`
+	UserID         uint      `gorm:"index" json:"user_id"` // project owner
+	Type           string    `json:"type"`
+	Status         string    `json:"status"`
+	PreviousStatus string    `json:"previous_status,omitempty"`
+}
+
+// BuildArtifact is a file produced by a build
+type BuildArtifact struct {
+	gorm.Model
+	BuildID    uint   `gorm:"index" json:"build_id"`
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	StorageKey string `json:"-"` // object storage key, empty when not stored
 }
 
 // Log model - stores build logs line by line
 type Log struct {
 	gorm.Model
-	BuildID    uint   `json:"build_id"`
-	Build      Build  `json:"build"`
-	LineNumber int    `json:"line_number"`
-	Content    string `json:"content"`
-	Timestamp  int64  `json:"timestamp"` // Unix timestamp
+	BuildID    uint      `gorm:"uniqueIndex:idx_logs_build_line" json:"build_id"`
+	Build      Build     `json:"-"`
+	LineNumber int       `gorm:"uniqueIndex:idx_logs_build_line" json:"line_number"`
+	Content    string    `json:"content"`
+	Time       time.Time `json:"time"`      // when the line was written
+	Timestamp  int64     `json:"timestamp"` // Unix timestamp
 }
 
 // Env model - supports both environment variables and files
 type Env struct {
 	gorm.Model
-	ProjectID uint    `json:"project_id"`
-	Project   Project `json:"project"`
-	Key       string  `json:"key"`       // Variable name or file identifier
-	Value     string  `json:"value"`     // Variable value or file content (base64 for binary)
-	Type      string  `json:"type"`      // "env" for environment variable, "file" for file
-	Path      string  `json:"path"`      // Target path for files (e.g., "android/app/google-services.json")
-	IsBase64  bool    `json:"is_base64"` // True if Value is base64 encoded (for binary files)
+	ProjectID   uint            `json:"project_id"`
+	Project     Project         `json:"project"`
+	Key         string          `json:"key"`                                    // Variable name or file identifier
+	Value       EncryptedString `json:"value"`                                  // Variable value or file content (base64 for binary)
+	Type        string          `json:"type"`                                   // "env" for environment variable, "file" for file
+	Path        string          `json:"path"`                                   // Target path for files (e.g., "android/app/google-services.json")
+	IsBase64    bool            `json:"is_base64"`                              // True if Value is base64 encoded (for binary files)
+	Secret      bool            `json:"secret"`                                 // True if Value is redacted from build logs
+	Environment string          `gorm:"not null;default:''" json:"environment"` // Scope (e.g., "production") overriding the shared env of the same key, empty when shared
+}
+
+// Env revision actions
+const (
+	EnvRevisionInitial  = "initial" // envs found when the first revision was needed
+	EnvRevisionCreated  = "created"
+	EnvRevisionUpdated  = "updated"
+	EnvRevisionDeleted  = "deleted"
+	EnvRevisionImported = "imported"
+	EnvRevisionRestored = "restored"
+)
+
+// EnvRevision records the envs of a project after each change. Builds keep
+// the number of the revision they use.
+type EnvRevision struct {
+	gorm.Model
+	ProjectID      uint            `gorm:"uniqueIndex:idx_env_revisions_project_number" json:"project_id"`
+	Number         int             `gorm:"uniqueIndex:idx_env_revisions_project_number" json:"number"` // 1, 2, ... per project
+	AuthorID       *uint           `json:"author_id"`                                                  // nil for revisions made by the API itself
+	AuthorUsername string          `json:"author_username"`
+	Action         string          `json:"action"`  // initial, created, updated, deleted, imported, restored
+	Summary        string          `json:"summary"` // e.g., "API_URL (production)"
+	Snapshot       EncryptedString `json:"-"`       // JSON of the envs, see EnvRevision.Envs
 }
 
-// Keystore model - stores Android signing credentials
+// Keystore model - stores Android signing credentials. The file and the
+// passwords are write-only, they are never returned by the API.
 type Keystore struct {
 	gorm.Model
-	ProjectID     uint    `json:"project_id"`
-	Project       Project `json:"project"`
-	Name          string  `json:"name"`           // Friendly name
-	KeystoreFile  string  `json:"keystore_file"`  // Base64 encoded keystore file
-	StorePassword string  `json:"store_password"` // Encrypted
-	KeyAlias      string  `json:"key_alias"`
-	KeyPassword   string  `json:"key_password"` // Encrypted
-	IsActive      bool    `json:"is_active"`    // Only one active keystore per project
+	ProjectID     uint            `gorm:"uniqueIndex:idx_keystores_active_project,where:is_active AND deleted_at IS NULL" json:"project_id"`
+	Project       Project         `json:"-"`
+	Name          string          `json:"name"`      // Friendly name
+	FileName      string          `json:"file_name"` // Name of the uploaded file
+	KeystoreFile  EncryptedString `json:"-"`         // Base64 encoded keystore file
+	StorePassword EncryptedString `json:"-"`
+	KeyAlias      string          `json:"key_alias"`
+	KeyPassword   EncryptedString `json:"-"`
+	IsActive      bool            `json:"is_active"` // Only one active keystore per project
+
+	// BackupAvailable is set for generated keystores until the user
+	// downloads the file and its passwords, which is allowed once
+	BackupAvailable bool `json:"backup_available"`
+
+	// Signing certificate, read from the file when uploaded
+	Type              string     `json:"type"` // jks or pkcs12
+	CertSubject       string     `json:"cert_subject"`
+	CertIssuer        string     `json:"cert_issuer"`
+	CertNotBefore     *time.Time `json:"cert_not_before"`
+	CertNotAfter      *time.Time `json:"cert_not_after"`
+	SHA1Fingerprint   string     `json:"sha1_fingerprint"`
+	SHA256Fingerprint string     `json:"sha256_fingerprint"`
 }
 
 type Organization struct {
@@ -91,13 +269,36 @@ type Organization struct {
 type GithubInstallation struct {
 	gorm.Model
 
-	InstallationID int64  `json:"github_installation_id" gorm:"not null;uniqueIndex"`
-	UserID         *uint  `json:"user_id,omitempty" gorm:"unique"`
-	OrganizationID *uint  `json:"organization_id,omitempty" gorm:"unique"`
-	AccountLogin   string `json:"account_login" gorm:"not null"`
-	AccountType    string `json:"account_type" gorm:"not null"`
-	TargetID       int64  `json:"target_id" gorm:"not null"`
+	InstallationID int64      `json:"github_installation_id" gorm:"not null;uniqueIndex"`
+	UserID         *uint      `json:"user_id,omitempty" gorm:"unique"`
+	OrganizationID *uint      `json:"organization_id,omitempty" gorm:"unique"`
+	AccountLogin   string     `json:"account_login" gorm:"not null"`
+	AccountType    string     `json:"account_type" gorm:"not null"`
+	TargetID       int64      `json:"target_id" gorm:"not null"` // ID of the account
+	SuspendedAt    *time.Time `json:"suspended_at,omitempty"`
 
 	User         *User         `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
 	Organization *Organization `gorm:"foreignKey:OrganizationID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
 }
+
+// Webhook delivery statuses
+const (
+	WebhookDeliveryProcessing = "processing"
+	WebhookDeliveryProcessed  = "processed"
+	WebhookDeliveryFailed     = "failed"
+)
+
+// WebhookDelivery records a GitHub webhook delivery and how it was processed
+type WebhookDelivery struct {
+	gorm.Model
+	DeliveryID     string     `gorm:"not null;uniqueIndex" json:"delivery_id"` // X-GitHub-Delivery, the same for redeliveries
+	Event          string     `gorm:"index" json:"event"`                      // X-GitHub-Event, e.g. push
+	Action         string     `json:"action"`                                  // action of the payload, e.g. opened
+	InstallationID int64      `json:"installation_id"`
+	Payload        string     `json:"-"`
+	Status         string     `gorm:"index" json:"status"` // processing, processed, failed
+	Result         string     `json:"result"`              // what the processing did, e.g. "queued builds 12, 13"
+	Error          string     `json:"error"`
+	Attempts       int        `json:"attempts"`
+	ProcessedAt    *time.Time `json:"processed_at"`
+}
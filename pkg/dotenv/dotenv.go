@@ -0,0 +1,149 @@
+// Package dotenv reads and writes .env files
+package dotenv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Var is a variable of a .env file
+type Var struct {
+	Key   string
+	Value string
+}
+
+var (
+	keyPattern      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	unquotedPattern = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+)
+
+// Parse reads KEY=value lines, in file order. Blank lines and comments are
+// skipped, an "export " prefix is accepted. Values are unquoted, single
+// quoted (literal) or double quoted, where \n, \r, \t, \" and \\ are
+// escapes; unquoted values end at a " #" comment.
+func Parse(r io.Reader) ([]Var, error) {
+	var vars []Var
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if line == 1 {
+			text = strings.TrimPrefix(text, "\ufeff") // byte order mark
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		key, raw, found := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !found {
+			return nil, fmt.Errorf("line %d: expected KEY=value", line)
+		}
+		if !ValidKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", line, key)
+		}
+
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		vars = append(vars, Var{Key: key, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func parseValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	switch raw[0] {
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		if err := checkTrailing(raw[end+2:]); err != nil {
+			return "", err
+		}
+		return raw[1 : end+1], nil
+	case '"':
+		var value strings.Builder
+		for i := 1; i < len(raw); i++ {
+			c := raw[i]
+			switch {
+			case c == '"':
+				if err := checkTrailing(raw[i+1:]); err != nil {
+					return "", err
+				}
+				return value.String(), nil
+			case c == '\\' && i+1 < len(raw):
+				i++
+				switch raw[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case 'r':
+					value.WriteByte('\r')
+				case 't':
+					value.WriteByte('\t')
+				default:
+					value.WriteByte(raw[i])
+				}
+			default:
+				value.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	}
+
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(raw), nil
+}
+
+// checkTrailing accepts nothing but a comment after a quoted value
+func checkTrailing(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %q after quoted value", rest)
+	}
+	return nil
+}
+
+// ValidKey reports whether key can be written in a .env file
+func ValidKey(key string) bool {
+	return keyPattern.MatchString(key)
+}
+
+// Write writes vars as KEY=value lines that Parse reads back, quoting values
+// when needed
+func Write(w io.Writer, vars []Var) error {
+	for _, v := range vars {
+		if !ValidKey(v.Key) {
+			return fmt.Errorf("invalid key %q", v.Key)
+		}
+		if _, err := fmt.Fprintf(w, "%s=%s\n", v.Key, quote(v.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func quote(value string) string {
+	if unquotedPattern.MatchString(value) {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\n\r") {
+		return "'" + value + "'"
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
@@ -0,0 +1,141 @@
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/gorm"
+)
+
+const (
+	// retention is how long events are kept for clients resuming a stream
+	retention = 24 * time.Hour
+
+	// pruneInterval is how often expired events are deleted
+	pruneInterval = time.Hour
+
+	// recordLockKey is the Postgres advisory lock serialising event inserts
+	// across API replicas
+	recordLockKey = 727004
+)
+
+var (
+	mu      sync.Mutex
+	changed = make(chan struct{})
+)
+
+// BuildStatusChanged records the transition of a build from previous to
+// status (previous is empty for a new build). Failures are logged, as events
+// must never prevent a status change.
+func BuildStatusChanged(buildID uint, previous, status string) {
+	if previous == status {
+		return
+	}
+
+	var owner struct {
+		ProjectID uint
+		UserID    uint
+	}
+	err := db.DB.Table("builds").
+		Select("builds.project_id, projects.user_id").
+		Joins("JOIN projects ON projects.id = builds.project_id").
+		Where("builds.id = ?", buildID).
+		Scan(&owner).Error
+	if err != nil {
+		log.Printf("Build events: build %d: %v", buildID, err)
+		return
+	}
+
+	event := db.BuildEvent{
+		BuildID:        buildID,
+		ProjectID:      owner.ProjectID,
+		UserID:         owner.UserID,
+		Type:           eventType(previous, status),
+		Status:         status,
+		PreviousStatus: previous,
+	}
+	// Events are committed in ID order: an event allocated a lower ID but
+	// committed after a higher one was read would never be streamed, as
+	// streams resume after the last ID they sent
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", recordLockKey).Error; err != nil {
+			return err
+		}
+		return tx.Create(&event).Error
+	})
+	if err != nil {
+		log.Printf("Build events: build %d: %v", buildID, err)
+		return
+	}
+
+	// Wake the local streams, others find the event on their next poll
+	mu.Lock()
+	close(changed)
+	changed = make(chan struct{})
+	mu.Unlock()
+}
+
+// Changed returns a channel closed at the next event recorded by this process
+func Changed() <-chan struct{} {
+	mu.Lock()
+	defer mu.Unlock()
+	return changed
+}
+
+// Since returns up to limit events after lastID matching the filter, e.g.
+// "project_id = ?" or "user_id = ?" with value. Events being committed in ID
+// order, no event is ever added before lastID.
+func Since(lastID uint, filter string, value interface{}, limit int) ([]db.BuildEvent, error) {
+	var events []db.BuildEvent
+	err := db.DB.Where("id > ?", lastID).
+		Where(filter, value).
+		Order("id").
+		Limit(limit).
+		Find(&events).Error
+	return events, err
+}
+
+// LastID returns the ID of the most recent event
+func LastID() (uint, error) {
+	var last struct{ ID uint }
+	err := db.DB.Model(&db.BuildEvent{}).Select("COALESCE(MAX(id), 0) AS id").Scan(&last).Error
+	return last.ID, err
+}
+
+// Run deletes expired events until ctx is cancelled
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		err := db.DB.Where("created_at < ?", time.Now().Add(-retention)).Delete(&db.BuildEvent{}).Error
+		if err != nil {
+			log.Printf("Build events: failed to delete expired events: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func eventType(previous, status string) string {
+	switch {
+	case status == db.BuildStatusQueued:
+		return db.BuildEventQueued
+	case previous == db.BuildStatusQueued && status == db.BuildStatusPending:
+		return db.BuildEventStarted
+	case status == db.BuildStatusSuccess:
+		return db.BuildEventSucceeded
+	case status == db.BuildStatusFailed:
+		return db.BuildEventFailed
+	case status == db.BuildStatusCancelled:
+		return db.BuildEventCancelled
+	}
+	return db.BuildEventPhaseChanged
+}
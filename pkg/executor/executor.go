@@ -0,0 +1,169 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+var (
+	// ErrNotFound is returned when the backend has no trace of the build
+	ErrNotFound = errors.New("build not found in executor")
+
+	// ErrArtifactsUnavailable is returned when the backend cannot serve build artifacts
+	ErrArtifactsUnavailable = errors.New("artifacts are not available from this executor")
+)
+
+// BuildConfig contains all configuration for starting a build
+type BuildConfig struct {
+	BuildID        uint
+	Project        db.Project
+	Platform       string
+	BuildMode      string // release, debug, profile
+	BuildTarget    string // apk, aab, ios, web
+	FlutterChannel string // stable, beta, dev
+	GitBranch      string
+	GitCommit      string // commit to build instead of the head of GitBranch
+	GitUsername    string
+	GitPassword    string
+	GitToken       string // GitHub App installation token, preferred to the credentials
+	Environment    string // scope of the project envs, empty for the shared ones
+	EnvRevision    int    // revision of the project envs, 0 for the current envs
+}
+
+// BuildState is the backend-agnostic state of a build
+type BuildState struct {
+	Status     string // one of the db.BuildStatus values, empty when unknown
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	ExitCode   *int32
+	Reason     string // e.g., Completed, Error, OOMKilled
+}
+
+// Artifact describes a file produced by a build
+type Artifact struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// EnvVar is a single environment variable passed to the build
+type EnvVar struct {
+	Name   string
+	Value  string
+	Secret bool // credentials, kept out of the build spec where the backend allows it
+}
+
+// BuildExecutor runs builds on a backend (Kubernetes, local containers, ...)
+type BuildExecutor interface {
+	// Start launches the build described by config
+	Start(ctx context.Context, config BuildConfig) error
+
+	// Cancel stops the build and releases every resource created for it
+	Cancel(ctx context.Context, buildID uint) error
+
+	// Status reports the current state of the build
+	Status(ctx context.Context, buildID uint) (BuildState, error)
+
+	// Logs returns the build output collected so far, line by line
+	Logs(ctx context.Context, buildID uint) ([]LogLine, error)
+
+	// StreamLogs follows the build output written at or after since (all of
+	// it when since is zero), sending it line by line to lines and closing
+	// lines when the stream ends
+	StreamLogs(ctx context.Context, buildID uint, since time.Time, lines chan<- LogLine) error
+
+	// Artifacts lists the files produced by the build
+	Artifacts(ctx context.Context, buildID uint) ([]Artifact, error)
+
+	// OpenArtifact opens a file produced by the build for reading
+	OpenArtifact(ctx context.Context, buildID uint, name string) (io.ReadCloser, error)
+}
+
+// Watcher is implemented by executors that need a background loop to report
+// build progress through ApplyState
+type Watcher interface {
+	Watch(ctx context.Context)
+}
+
+var defaultExecutor BuildExecutor
+
+// SetDefault sets the process-wide executor used by the API
+func SetDefault(e BuildExecutor) {
+	defaultExecutor = e
+}
+
+// Default returns the process-wide executor
+func Default() BuildExecutor {
+	return defaultExecutor
+}
+
+// Environment returns the variables the build script expects for config
+func Environment(config BuildConfig) []EnvVar {
+	envVars := []EnvVar{
+		{Name: "GIT_REPO", Value: config.Project.GitRepo},
+		{Name: "BUILD_FOLDER", Value: config.Project.BuildFolder},
+		{Name: "PLATFORM", Value: config.Platform},
+		{Name: "BUILD_ID", Value: strconv.Itoa(int(config.BuildID))},
+		{Name: "BUILD_MODE", Value: buildMode(config.BuildMode)},
+		{Name: "BUILD_TARGET", Value: buildTarget(config.Platform, config.BuildTarget)},
+		{Name: "FLUTTER_CHANNEL", Value: flutterChannel(config.FlutterChannel)},
+		{Name: "OUTPUT_DIR", Value: "/outputs"},
+		{Name: "ENV_FILES_DIR", Value: "/env-files"},
+	}
+
+	// Add Git branch if specified
+	if config.GitBranch != "" {
+		envVars = append(envVars, EnvVar{Name: "GIT_BRANCH", Value: config.GitBranch})
+	}
+	if config.GitCommit != "" {
+		envVars = append(envVars, EnvVar{Name: "GIT_COMMIT", Value: config.GitCommit})
+	}
+
+	// Add Git credentials if specified
+	if config.GitUsername != "" {
+		envVars = append(envVars, EnvVar{Name: "GIT_USERNAME", Value: config.GitUsername, Secret: true})
+	}
+	if config.GitPassword != "" {
+		envVars = append(envVars, EnvVar{Name: "GIT_PASSWORD", Value: config.GitPassword, Secret: true})
+	}
+	if config.GitToken != "" {
+		envVars = append(envVars, EnvVar{Name: "GIT_TOKEN", Value: config.GitToken, Secret: true})
+	}
+
+	return envVars
+}
+
+func buildMode(mode string) string {
+	if mode == "" {
+		return "release"
+	}
+	return mode
+}
+
+func buildTarget(platform, target string) string {
+	if target != "" {
+		return target
+	}
+
+	switch platform {
+	case "android":
+		return "apk"
+	case "ios":
+		return "ios"
+	case "web":
+		return "web"
+	default:
+		return "apk"
+	}
+}
+
+func flutterChannel(channel string) string {
+	if channel == "" || channel == "latest" {
+		return "stable"
+	}
+	return channel
+}
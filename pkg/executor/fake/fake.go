@@ -0,0 +1,238 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+)
+
+// Executor is an in-memory executor for tests and for running the API
+// without any container runtime
+type Executor struct {
+	// StartErr, when set, is returned by Start instead of recording the build
+	StartErr error
+
+	// AutoComplete, when positive, makes every started build succeed after
+	// that delay and records the result in the database
+	AutoComplete time.Duration
+
+	mu     sync.Mutex
+	builds map[uint]*build
+}
+
+type build struct {
+	config    executor.BuildConfig
+	state     executor.BuildState
+	logs      []executor.LogLine
+	artifacts map[string][]byte
+}
+
+var _ executor.BuildExecutor = (*Executor)(nil)
+
+// NewExecutor creates an empty fake executor
+func NewExecutor() *Executor {
+	return &Executor{builds: map[uint]*build{}}
+}
+
+// Start records the build as pending
+func (e *Executor) Start(ctx context.Context, config executor.BuildConfig) error {
+	if e.StartErr != nil {
+		return e.StartErr
+	}
+
+	e.mu.Lock()
+	e.builds[config.BuildID] = &build{
+		config:    config,
+		state:     executor.BuildState{Status: db.BuildStatusPending},
+		artifacts: map[string][]byte{},
+	}
+	e.mu.Unlock()
+
+	if e.AutoComplete > 0 {
+		go e.autoComplete(config.BuildID)
+	}
+
+	return nil
+}
+
+// Cancel forgets the build
+func (e *Executor) Cancel(ctx context.Context, buildID uint) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.builds[buildID]; !ok {
+		return executor.ErrNotFound
+	}
+	delete(e.builds, buildID)
+	return nil
+}
+
+// Status returns the state last set for the build
+func (e *Executor) Status(ctx context.Context, buildID uint) (executor.BuildState, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.builds[buildID]
+	if !ok {
+		return executor.BuildState{}, executor.ErrNotFound
+	}
+	return b.state, nil
+}
+
+// Logs returns the lines appended to the build
+func (e *Executor) Logs(ctx context.Context, buildID uint) ([]executor.LogLine, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.builds[buildID]
+	if !ok {
+		return nil, executor.ErrNotFound
+	}
+	return append([]executor.LogLine(nil), b.logs...), nil
+}
+
+// StreamLogs sends the lines appended so far at or after since and closes lines
+func (e *Executor) StreamLogs(ctx context.Context, buildID uint, since time.Time, lines chan<- executor.LogLine) error {
+	defer close(lines)
+
+	logs, err := e.Logs(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	for _, line := range logs {
+		if line.Time.Before(since) {
+			continue
+		}
+		select {
+		case lines <- line:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Artifacts lists the artifacts added to the build
+func (e *Executor) Artifacts(ctx context.Context, buildID uint) ([]executor.Artifact, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.builds[buildID]
+	if !ok {
+		return nil, executor.ErrNotFound
+	}
+
+	artifacts := make([]executor.Artifact, 0, len(b.artifacts))
+	for name, content := range b.artifacts {
+		artifacts = append(artifacts, executor.Artifact{Name: name, Size: int64(len(content))})
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return artifacts, nil
+}
+
+// OpenArtifact returns the content of an artifact added to the build
+func (e *Executor) OpenArtifact(ctx context.Context, buildID uint, name string) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.builds[buildID]
+	if !ok {
+		return nil, executor.ErrNotFound
+	}
+	content, ok := b.artifacts[name]
+	if !ok {
+		return nil, executor.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Config returns the configuration the build was started with
+func (e *Executor) Config(buildID uint) (executor.BuildConfig, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.builds[buildID]
+	if !ok {
+		return executor.BuildConfig{}, false
+	}
+	return b.config, true
+}
+
+// SetState replaces the state reported for the build
+func (e *Executor) SetState(buildID uint, state executor.BuildState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if b, ok := e.builds[buildID]; ok {
+		b.state = state
+	}
+}
+
+// AppendLog adds output lines to the build
+func (e *Executor) AppendLog(buildID uint, lines ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if b, ok := e.builds[buildID]; ok {
+		now := time.Now()
+		for _, line := range lines {
+			b.logs = append(b.logs, executor.LogLine{Time: now, Content: line})
+		}
+	}
+}
+
+// AddArtifact attaches a file to the build
+func (e *Executor) AddArtifact(buildID uint, name string, content []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if b, ok := e.builds[buildID]; ok {
+		b.artifacts[name] = content
+	}
+}
+
+func (e *Executor) autoComplete(buildID uint) {
+	startedAt := time.Now()
+	e.SetState(buildID, executor.BuildState{Status: db.BuildStatusRunning, StartedAt: &startedAt})
+	e.AppendLog(buildID, "Fake build started")
+	if err := executor.ApplyState(buildID, executor.BuildState{Status: db.BuildStatusRunning, StartedAt: &startedAt}); err != nil {
+		log.Printf("Fake executor: failed to update build %d: %v", buildID, err)
+	}
+
+	time.Sleep(e.AutoComplete)
+
+	finishedAt := time.Now()
+	exitCode := int32(0)
+	state := executor.BuildState{
+		Status:     db.BuildStatusSuccess,
+		StartedAt:  &startedAt,
+		FinishedAt: &finishedAt,
+		ExitCode:   &exitCode,
+		Reason:     "Completed",
+	}
+
+	e.mu.Lock()
+	b, ok := e.builds[buildID]
+	if ok {
+		b.state = state
+		b.logs = append(b.logs, executor.LogLine{Time: finishedAt, Content: "Fake build completed"})
+		b.artifacts["app-release.apk"] = []byte("fake apk content")
+	}
+	e.mu.Unlock()
+
+	// The build was cancelled in the meantime
+	if !ok {
+		return
+	}
+
+	if err := executor.ApplyState(buildID, state); err != nil {
+		log.Printf("Fake executor: failed to update build %d: %v", buildID, err)
+	}
+}
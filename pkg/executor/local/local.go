@@ -0,0 +1,424 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"gorm.io/gorm"
+)
+
+const (
+	// pollInterval is how often container states are copied to the database
+	pollInterval = 5 * time.Second
+
+	// stopTimeout is how long a container has to stop before being killed
+	stopTimeout = 30
+
+	// orphanGracePeriod is how long a pending build may exist without a container
+	orphanGracePeriod = 2 * time.Minute
+)
+
+// Executor runs builds as containers on the local Docker or Podman engine.
+// It is meant for development machines without a Kubernetes cluster.
+type Executor struct {
+	runtime string // docker or podman
+	image   string
+	workDir string // per-build directories holding outputs, env files and keystores
+}
+
+var _ executor.BuildExecutor = (*Executor)(nil)
+
+// NewExecutor creates a local executor from the environment.
+// BUILD_LOCAL_RUNTIME selects docker or podman (auto-detected when empty),
+// BUILD_LOCAL_WORKDIR is where build outputs are kept.
+func NewExecutor() (*Executor, error) {
+	runtime := os.Getenv("BUILD_LOCAL_RUNTIME")
+	if runtime == "" {
+		for _, candidate := range []string{"docker", "podman"} {
+			if _, err := exec.LookPath(candidate); err == nil {
+				runtime = candidate
+				break
+			}
+		}
+	}
+	if runtime == "" {
+		return nil, errors.New("no container runtime found (install docker or podman, or set BUILD_LOCAL_RUNTIME)")
+	}
+
+	workDir := os.Getenv("BUILD_LOCAL_WORKDIR")
+	if workDir == "" {
+		workDir = filepath.Join(os.TempDir(), "flotio-builds")
+	}
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %v", err)
+	}
+
+	image := os.Getenv("FLUTTER_BUILD_IMAGE")
+	if image == "" {
+		image = "flotio/flutter-build:latest"
+	}
+
+	return &Executor{
+		runtime: runtime,
+		image:   image,
+		workDir: workDir,
+	}, nil
+}
+
+// Start runs the build container in the background
+func (e *Executor) Start(ctx context.Context, config executor.BuildConfig) error {
+	buildDir := e.buildDir(config.BuildID)
+	outputsDir := filepath.Join(buildDir, "outputs")
+	envFilesDir := filepath.Join(buildDir, "env-files")
+	keystoreDir := filepath.Join(buildDir, "keystore")
+
+	for _, dir := range []string{outputsDir, envFilesDir, keystoreDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	envVars := executor.Environment(config)
+
+	if db.DB != nil {
+		dbEnvs, err := db.BuildEnvs(config.Project.ID, config.EnvRevision, config.Environment)
+		if err != nil {
+			return fmt.Errorf("failed to fetch environment: %v", err)
+		}
+		for _, dbEnv := range dbEnvs {
+			if dbEnv.Type == "file" {
+				if err := writeEnvFile(envFilesDir, dbEnv); err != nil {
+					return err
+				}
+				continue
+			}
+			envVars = append(envVars, executor.EnvVar{Name: dbEnv.Key, Value: string(dbEnv.Value)})
+		}
+
+		if config.Platform == "android" {
+			keystoreVars, err := writeKeystore(keystoreDir, config.Project.ID)
+			if err != nil {
+				return err
+			}
+			envVars = append(envVars, keystoreVars...)
+		}
+	}
+
+	args := []string{
+		"run", "--detach",
+		"--name", containerName(config.BuildID),
+		"--label", "app=flotio-build",
+		"--label", "build-id=" + strconv.Itoa(int(config.BuildID)),
+		"--label", "project-id=" + strconv.Itoa(int(config.Project.ID)),
+		"--volume", outputsDir + ":/outputs",
+		"--volume", envFilesDir + ":/env-files:ro",
+		"--volume", keystoreDir + ":/keystore:ro",
+	}
+	for _, env := range envVars {
+		args = append(args, "--env", env.Name+"="+env.Value)
+	}
+	args = append(args, e.image)
+
+	if _, err := e.run(ctx, args...); err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+
+	return nil
+}
+
+// Cancel stops the build container and removes its working directory
+func (e *Executor) Cancel(ctx context.Context, buildID uint) error {
+	name := containerName(buildID)
+
+	if _, err := e.run(ctx, "stop", "--time", strconv.Itoa(stopTimeout), name); err != nil && !isNoSuchContainer(err) {
+		return fmt.Errorf("failed to stop container %s: %v", name, err)
+	}
+	if _, err := e.run(ctx, "rm", "--force", name); err != nil && !isNoSuchContainer(err) {
+		return fmt.Errorf("failed to remove container %s: %v", name, err)
+	}
+
+	if err := os.RemoveAll(e.buildDir(buildID)); err != nil {
+		return fmt.Errorf("failed to remove build directory: %v", err)
+	}
+
+	return nil
+}
+
+// containerState mirrors the fields of `inspect --format '{{json .State}}'`
+// shared by Docker and Podman
+type containerState struct {
+	Status     string
+	Running    bool
+	ExitCode   int32
+	OOMKilled  bool
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Status inspects the build container
+func (e *Executor) Status(ctx context.Context, buildID uint) (executor.BuildState, error) {
+	out, err := e.run(ctx, "inspect", "--format", "{{json .State}}", containerName(buildID))
+	if err != nil {
+		if isNoSuchContainer(err) {
+			return executor.BuildState{}, executor.ErrNotFound
+		}
+		return executor.BuildState{}, err
+	}
+
+	var cs containerState
+	if err := json.Unmarshal(out, &cs); err != nil {
+		return executor.BuildState{}, fmt.Errorf("failed to parse container state: %v", err)
+	}
+
+	var state executor.BuildState
+	if !cs.StartedAt.IsZero() && cs.StartedAt.Year() > 1 {
+		startedAt := cs.StartedAt
+		state.StartedAt = &startedAt
+	}
+
+	switch {
+	case cs.Running:
+		state.Status = db.BuildStatusRunning
+	case cs.Status == "created" || cs.Status == "configured":
+		state.Status = db.BuildStatusPending
+	case cs.Status == "exited" || cs.Status == "stopped" || cs.Status == "dead":
+		exitCode := cs.ExitCode
+		state.ExitCode = &exitCode
+		if !cs.FinishedAt.IsZero() && cs.FinishedAt.Year() > 1 {
+			finishedAt := cs.FinishedAt
+			state.FinishedAt = &finishedAt
+		}
+
+		switch {
+		case cs.OOMKilled:
+			state.Status = db.BuildStatusFailed
+			state.Reason = "OOMKilled"
+		case cs.ExitCode == 0:
+			state.Status = db.BuildStatusSuccess
+			state.Reason = "Completed"
+		default:
+			state.Status = db.BuildStatusFailed
+			state.Reason = "Error"
+		}
+	}
+
+	return state, nil
+}
+
+// Logs returns the build container output
+func (e *Executor) Logs(ctx context.Context, buildID uint) ([]executor.LogLine, error) {
+	cmd := exec.CommandContext(ctx, e.runtime, "logs", "--timestamps", containerName(buildID))
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(buf.String())
+		if isNoSuchContainer(errors.New(msg)) {
+			return nil, executor.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get logs: %v: %s", err, msg)
+	}
+
+	lineChan := make(chan executor.LogLine)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- executor.ReadTimestampedLines(ctx, &buf, lineChan)
+		close(lineChan)
+	}()
+
+	var lines []executor.LogLine
+	for line := range lineChan {
+		lines = append(lines, line)
+	}
+	return lines, <-errChan
+}
+
+// StreamLogs follows the build container output until it exits
+func (e *Executor) StreamLogs(ctx context.Context, buildID uint, since time.Time, lines chan<- executor.LogLine) error {
+	defer close(lines)
+
+	if _, err := e.run(ctx, "inspect", "--format", "{{.Id}}", containerName(buildID)); err != nil {
+		if isNoSuchContainer(err) {
+			return executor.ErrNotFound
+		}
+		return err
+	}
+
+	args := []string{"logs", "--follow", "--timestamps"}
+	if !since.IsZero() {
+		args = append(args, "--since", since.UTC().Format(time.RFC3339Nano))
+	}
+	args = append(args, containerName(buildID))
+
+	cmd := exec.CommandContext(ctx, e.runtime, args...)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to follow logs: %v", err)
+	}
+	go func() {
+		writer.CloseWithError(cmd.Wait())
+	}()
+
+	return executor.ReadTimestampedLines(ctx, reader, lines)
+}
+
+// Artifacts lists the files the build wrote to /outputs
+func (e *Executor) Artifacts(ctx context.Context, buildID uint) ([]executor.Artifact, error) {
+	entries, err := os.ReadDir(filepath.Join(e.buildDir(buildID), "outputs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, executor.ErrNotFound
+		}
+		return nil, err
+	}
+
+	var artifacts []executor.Artifact
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, executor.Artifact{Name: entry.Name(), Size: info.Size()})
+	}
+	return artifacts, nil
+}
+
+// OpenArtifact opens a file the build wrote to /outputs
+func (e *Executor) OpenArtifact(ctx context.Context, buildID uint, name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(e.buildDir(buildID), "outputs", filepath.Base(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, executor.ErrNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// Watch polls the containers of unfinished builds and records their state
+// until ctx is cancelled. Polling from the database also recovers builds
+// started before an API restart.
+func (e *Executor) Watch(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.sync(ctx)
+		}
+	}
+}
+
+func (e *Executor) sync(ctx context.Context) {
+	builds, err := executor.UnfinishedBuilds()
+	if err != nil {
+		log.Printf("Local executor: failed to list unfinished builds: %v", err)
+		return
+	}
+
+	for _, build := range builds {
+		state, err := e.Status(ctx, build.ID)
+		if errors.Is(err, executor.ErrNotFound) {
+			if build.Status == db.BuildStatusPending && time.Since(build.CreatedAt) < orphanGracePeriod {
+				continue
+			}
+			err = executor.MarkLost(build.ID, "ContainerNotFound")
+		} else if err == nil {
+			err = executor.ApplyState(build.ID, state)
+		}
+		if err != nil {
+			log.Printf("Local executor: failed to sync build %d: %v", build.ID, err)
+		}
+	}
+}
+
+func (e *Executor) buildDir(buildID uint) string {
+	return filepath.Join(e.workDir, fmt.Sprintf("build-%d", buildID))
+}
+
+func (e *Executor) run(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, e.runtime, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v: %s", e.runtime, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func containerName(buildID uint) string {
+	return fmt.Sprintf("flotio-build-%d", buildID)
+}
+
+func isNoSuchContainer(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such container") || strings.Contains(msg, "no container with name")
+}
+
+// writeEnvFile writes a "file" env using the same naming the ConfigMap uses,
+// so build.sh places it at its target path
+func writeEnvFile(dir string, env db.Env) error {
+	content, err := env.FileContent()
+	if err != nil {
+		return err
+	}
+
+	fileName := env.Key
+	if env.Path != "" {
+		fileName = fmt.Sprintf("%s::%s", env.Key, strings.ReplaceAll(env.Path, "/", "__"))
+	}
+
+	return os.WriteFile(filepath.Join(dir, fileName), content, 0o644)
+}
+
+// writeKeystore writes the active keystore of the project and returns the
+// variables build.sh needs to sign with it
+func writeKeystore(dir string, projectID uint) ([]executor.EnvVar, error) {
+	var keystore db.Keystore
+	if err := db.DB.Where("project_id = ? AND is_active = ?", projectID, true).First(&keystore).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil // No keystore configured (not an error)
+		}
+		return nil, fmt.Errorf("failed to fetch keystore: %v", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(string(keystore.KeystoreFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keystore file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keystore.jks"), data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write keystore: %v", err)
+	}
+
+	return []executor.EnvVar{
+		{Name: "KEYSTORE_PATH", Value: "/keystore/keystore.jks"},
+		{Name: "KEYSTORE_PASSWORD", Value: string(keystore.StorePassword)},
+		{Name: "KEY_ALIAS", Value: keystore.KeyAlias},
+		{Name: "KEY_PASSWORD", Value: string(keystore.KeyPassword)},
+	}, nil
+}
@@ -0,0 +1,72 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxLogLineSize is the longest line kept whole, longer output is split
+const maxLogLineSize = 64 * 1024
+
+// LogLine is a single line of build output
+type LogLine struct {
+	Time    time.Time
+	Content string // without the trailing newline
+}
+
+// ReadTimestampedLines splits output prefixed with RFC 3339 timestamps, as
+// produced by `kubectl logs --timestamps` and `docker logs --timestamps`,
+// into lines sent to lines. It returns when r is exhausted or ctx is done.
+func ReadTimestampedLines(ctx context.Context, r io.Reader, lines chan<- LogLine) error {
+	reader := bufio.NewReaderSize(r, maxLogLineSize)
+	continued := false
+	var last time.Time
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(chunk) > 0 {
+			text := strings.TrimRight(string(chunk), "\r\n")
+
+			line := LogLine{Time: last, Content: text}
+			if !continued {
+				line = parseTimestamp(text)
+				last = line.Time
+			}
+			// A line longer than the buffer continues in the next chunk
+			continued = err == bufio.ErrBufferFull
+
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseTimestamp splits the leading timestamp from a line, falling back to
+// the current time when it has none
+func parseTimestamp(text string) LogLine {
+	if prefix, content, ok := strings.Cut(text, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, prefix); err == nil {
+			return LogLine{Time: t, Content: content}
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		return LogLine{Time: t}
+	}
+	return LogLine{Time: time.Now(), Content: text}
+}
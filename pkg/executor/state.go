@@ -0,0 +1,121 @@
+package executor
+
+import (
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/events"
+)
+
+// unfinishedStatuses are the statuses of builds an executor is responsible for
+var unfinishedStatuses = []string{db.BuildStatusPending, db.BuildStatusRunning}
+
+var finishedHooks []func(buildID uint, status string)
+
+// OnFinished registers fn to be called each time an executor reports that a
+// build reached a terminal status. Hooks must not block.
+func OnFinished(fn func(buildID uint, status string)) {
+	finishedHooks = append(finishedHooks, fn)
+}
+
+func notifyFinished(buildID uint, status string) {
+	for _, fn := range finishedHooks {
+		fn(buildID, status)
+	}
+}
+
+// ApplyState records the state reported by an executor on the build row.
+// Builds that already reached a terminal status are left untouched, so a
+// cancelled build whose container is still stopping keeps its status.
+func ApplyState(buildID uint, state BuildState) error {
+	var build db.Build
+	if err := db.DB.First(&build, buildID).Error; err != nil {
+		return err
+	}
+
+	if build.IsFinished() {
+		return nil
+	}
+
+	updates := map[string]interface{}{}
+
+	if state.Status != "" && state.Status != build.Status {
+		updates["status"] = state.Status
+	}
+
+	startedAt := build.StartedAt
+	if startedAt == nil && state.StartedAt != nil {
+		startedAt = state.StartedAt
+		updates["started_at"] = *startedAt
+	}
+
+	finishedAt := state.FinishedAt
+	if finishedAt == nil && (state.Status == db.BuildStatusSuccess || state.Status == db.BuildStatusFailed) {
+		now := time.Now()
+		finishedAt = &now
+	}
+	if finishedAt != nil {
+		updates["finished_at"] = *finishedAt
+		if startedAt != nil {
+			updates["duration"] = int64(finishedAt.Sub(*startedAt).Seconds())
+		}
+	}
+
+	if state.ExitCode != nil {
+		updates["exit_code"] = *state.ExitCode
+	}
+	if state.Reason != "" {
+		updates["termination_reason"] = state.Reason
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	// The build may have been cancelled since it was read
+	result := db.DB.Model(&db.Build{}).
+		Where("id = ? AND status IN ?", build.ID, unfinishedStatuses).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	if status, ok := updates["status"].(string); ok {
+		events.BuildStatusChanged(build.ID, build.Status, status)
+	}
+	if state.Status == db.BuildStatusSuccess || state.Status == db.BuildStatusFailed {
+		notifyFinished(build.ID, state.Status)
+	}
+	return nil
+}
+
+// MarkLost fails a build that is still unfinished but whose execution has
+// disappeared from the backend, leaving terminal builds untouched
+func MarkLost(buildID uint, reason string) error {
+	result := db.DB.Model(&db.Build{}).
+		Where("id = ? AND status IN ?", buildID, unfinishedStatuses).
+		Updates(map[string]interface{}{
+			"status":             db.BuildStatusFailed,
+			"termination_reason": reason,
+			"finished_at":        time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected > 0 {
+		events.BuildStatusChanged(buildID, "", db.BuildStatusFailed)
+		notifyFinished(buildID, db.BuildStatusFailed)
+	}
+	return nil
+}
+
+// UnfinishedBuilds returns the builds an executor should still be tracking
+func UnfinishedBuilds() ([]db.Build, error) {
+	var builds []db.Build
+	err := db.DB.Where("status IN ?", unfinishedStatuses).Find(&builds).Error
+	return builds, err
+}
@@ -0,0 +1,103 @@
+// Package githubapp authenticates as the Flotio GitHub App and its
+// installations
+package githubapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/google/go-github/v76/github"
+)
+
+var (
+	// ErrNotConfigured is returned when GITHUB_APP_ID or
+	// GITHUB_APP_PRIVATE_KEY_PATH is not set
+	ErrNotConfigured = errors.New("GitHub App not configured")
+
+	// ErrOtherAccount is returned when a repository does not belong to the
+	// account of an installation
+	ErrOtherAccount = errors.New("repository of another account")
+)
+
+// Configured reports whether the App credentials are set
+func Configured() bool {
+	return os.Getenv("GITHUB_APP_ID") != "" && os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH") != ""
+}
+
+// AppsTransport authenticates requests as the App itself
+func AppsTransport() (*ghinstallation.AppsTransport, error) {
+	if !Configured() {
+		return nil, ErrNotConfigured
+	}
+	appID, err := strconv.ParseInt(os.Getenv("GITHUB_APP_ID"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_ID: %v", err)
+	}
+	return ghinstallation.NewAppsTransportKeyFromFile(http.DefaultTransport, appID, os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"))
+}
+
+// InstallationClient returns a client acting as an installation of the App
+func InstallationClient(installationID int64) (*github.Client, error) {
+	itr, err := AppsTransport()
+	if err != nil {
+		return nil, err
+	}
+	tr := ghinstallation.NewFromAppsTransport(itr, installationID)
+	return github.NewClient(&http.Client{Transport: tr}), nil
+}
+
+// ParseRepo returns the owner and name of a https://github.com repository
+// URL, with or without the .git suffix
+func ParseRepo(gitRepo string) (owner, name string, ok bool) {
+	u, err := url.Parse(strings.TrimSpace(gitRepo))
+	if err != nil || u.Scheme != "https" || !strings.EqualFold(u.Host, "github.com") {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	name = strings.TrimSuffix(parts[1], ".git")
+	if name == "" {
+		return "", "", false
+	}
+	return parts[0], name, true
+}
+
+// RepositoryToken mints an installation access token limited to reading the
+// contents of the owner/repo repository. It expires after an hour.
+func RepositoryToken(ctx context.Context, installationID int64, owner, repo string) (string, time.Time, error) {
+	itr, err := AppsTransport()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	client := github.NewClient(&http.Client{Transport: itr})
+
+	// Repository names are relative to the account of the installation
+	installation, _, err := client.Apps.GetInstallation(ctx, installationID)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to fetch installation: %v", err)
+	}
+	if !strings.EqualFold(installation.GetAccount().GetLogin(), owner) {
+		return "", time.Time{}, ErrOtherAccount
+	}
+
+	token, _, err := client.Apps.CreateInstallationToken(ctx, installationID, &github.InstallationTokenOptions{
+		Repositories: []string{repo},
+		Permissions: &github.InstallationPermissions{
+			Contents: github.Ptr("read"),
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create installation token: %v", err)
+	}
+	return token.GetToken(), token.GetExpiresAt().Time, nil
+}
@@ -0,0 +1,266 @@
+package kubernetes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/executor"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// artifactReaderLifetime bounds how long a reader pod keeps the PVC mounted
+	artifactReaderLifetime = 600 // seconds
+	artifactReaderTimeout  = 2 * time.Minute
+)
+
+// Artifacts lists the files a build wrote to /outputs on its PVC
+func (e *Executor) Artifacts(ctx context.Context, buildID uint) ([]executor.Artifact, error) {
+	podName, err := e.artifactReader(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := []string{"find", "/outputs", "-maxdepth", "1", "-type", "f", "-exec", "stat", "-c", "%s %n", "{}", "+"}
+	if err := e.exec(ctx, podName, cmd, &stdout); err != nil {
+		return nil, fmt.Errorf("failed to list artifacts: %v", err)
+	}
+
+	var artifacts []executor.Artifact
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		size, file, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			continue
+		}
+		artifacts = append(artifacts, executor.Artifact{Name: path.Base(file), Size: n})
+	}
+	return artifacts, scanner.Err()
+}
+
+// OpenArtifact streams a file a build wrote to /outputs on its PVC
+func (e *Executor) OpenArtifact(ctx context.Context, buildID uint, name string) (io.ReadCloser, error) {
+	artifacts, err := e.Artifacts(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, artifact := range artifacts {
+		if artifact.Name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, executor.ErrNotFound
+	}
+
+	podName := artifactReaderName(buildID)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(e.exec(ctx, podName, []string{"cat", path.Join("/outputs", name)}, writer))
+	}()
+	return reader, nil
+}
+
+// artifactReader returns a running pod mounting the artifacts PVC of a build,
+// creating it if needed. The pod is owned by the build Job so that it is
+// removed along with the PVC.
+func (e *Executor) artifactReader(ctx context.Context, buildID uint) (string, error) {
+	podName := artifactReaderName(buildID)
+	pods := e.clientset.CoreV1().Pods(e.namespace)
+
+	pod, err := pods.Get(ctx, podName, metav1.GetOptions{})
+	if err == nil && (pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed) {
+		// The previous reader expired, replace it
+		if err := pods.Delete(ctx, podName, metav1.DeleteOptions{GracePeriodSeconds: int64Ptr(0)}); err != nil && !apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("failed to delete expired artifact reader: %v", err)
+		}
+		if err := e.waitPodDeleted(ctx, podName); err != nil {
+			return "", err
+		}
+		err = apierrors.NewNotFound(v1.Resource("pods"), podName)
+	}
+
+	if apierrors.IsNotFound(err) {
+		if err := e.createArtifactReader(ctx, buildID); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get artifact reader: %v", err)
+	}
+
+	err = wait.PollUntilContextTimeout(ctx, time.Second, artifactReaderTimeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := pods.Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			return true, nil
+		case v1.PodSucceeded, v1.PodFailed:
+			return false, fmt.Errorf("artifact reader terminated with phase %s", pod.Status.Phase)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("artifact reader not ready: %v", err)
+	}
+
+	return podName, nil
+}
+
+func (e *Executor) createArtifactReader(ctx context.Context, buildID uint) error {
+	// Without the Job, its PVC has been garbage-collected as well
+	job, err := e.clientset.BatchV1().Jobs(e.namespace).Get(ctx, fmt.Sprintf("build-%d", buildID), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return executor.ErrNotFound
+		}
+		return fmt.Errorf("failed to get Job: %v", err)
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      artifactReaderName(buildID),
+			Namespace: e.namespace,
+			Labels: map[string]string{
+				// Not flotio-build, so that the reconciler ignores it
+				"app":      "flotio-artifacts",
+				"build-id": strconv.Itoa(int(buildID)),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "batch/v1",
+					Kind:       "Job",
+					Name:       job.Name,
+					UID:        job.UID,
+				},
+			},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy:                 v1.RestartPolicyNever,
+			ActiveDeadlineSeconds:         int64Ptr(artifactReaderLifetime),
+			TerminationGracePeriodSeconds: int64Ptr(0),
+			Containers: []v1.Container{
+				{
+					Name:    "reader",
+					Image:   getArtifactReaderImage(),
+					Command: []string{"sleep", strconv.Itoa(artifactReaderLifetime)},
+					VolumeMounts: []v1.VolumeMount{
+						{
+							Name:      "artifacts",
+							MountPath: "/outputs",
+							ReadOnly:  true,
+						},
+					},
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    parseQuantity("10m"),
+							v1.ResourceMemory: parseQuantity("16Mi"),
+						},
+						Limits: v1.ResourceList{
+							v1.ResourceCPU:    parseQuantity("500m"),
+							v1.ResourceMemory: parseQuantity("64Mi"),
+						},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "artifacts",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+							ClaimName: fmt.Sprintf("build-%d-artifacts", buildID),
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	_, err = e.clientset.CoreV1().Pods(e.namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create artifact reader: %v", err)
+	}
+	return nil
+}
+
+func (e *Executor) waitPodDeleted(ctx context.Context, podName string) error {
+	return wait.PollUntilContextTimeout(ctx, time.Second, artifactReaderTimeout, true, func(ctx context.Context) (bool, error) {
+		_, err := e.clientset.CoreV1().Pods(e.namespace).Get(ctx, podName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+// exec runs cmd in the reader container of podName, writing its output to stdout
+func (e *Executor) exec(ctx context.Context, podName string, cmd []string, stdout io.Writer) error {
+	if e.restConfig == nil {
+		return fmt.Errorf("no cluster configuration to exec in pod %s", podName)
+	}
+
+	req := e.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(e.namespace).
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: "reader",
+			Command:   cmd,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(e.restConfig, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func artifactReaderName(buildID uint) string {
+	return fmt.Sprintf("build-%d-artifacts-reader", buildID)
+}
+
+func getArtifactReaderImage() string {
+	image := os.Getenv("ARTIFACT_READER_IMAGE")
+	if image == "" {
+		image = "busybox:1.36"
+	}
+	return image
+}
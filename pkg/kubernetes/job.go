@@ -0,0 +1,141 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"github.com/flotio-dev/api/pkg/utils"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultBuildTimeout    = 3600 // seconds
+	defaultBackoffLimit    = 2
+	defaultJobTTLAfterDone = 3600 // seconds
+)
+
+// ownedResource is a build resource garbage-collected with its Job
+type ownedResource struct {
+	kind string // ConfigMap, Secret or PersistentVolumeClaim
+	name string
+}
+
+// CreateBuildJob creates the batch/v1 Job running the build pod.
+// Failures of the build script fail the Job immediately, while pods lost to
+// node failure or eviction are retried up to the configured backoff limit.
+func CreateBuildJob(ctx context.Context, clientset kubernetes.Interface, config executor.BuildConfig, podSpec v1.PodSpec, namespace string) (*batchv1.Job, error) {
+	labels := map[string]string{
+		"app":        "flotio-build",
+		"build-id":   strconv.Itoa(int(config.BuildID)),
+		"project-id": strconv.Itoa(int(config.Project.ID)),
+		"platform":   config.Platform,
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("build-%d", config.BuildID),
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			ActiveDeadlineSeconds:   int64Ptr(buildTimeout(config.Project)),
+			BackoffLimit:            int32Ptr(getBackoffLimit()),
+			TTLSecondsAfterFinished: int32Ptr(getJobTTL()),
+			PodFailurePolicy: &batchv1.PodFailurePolicy{
+				Rules: []batchv1.PodFailurePolicyRule{
+					{
+						// Disruptions (eviction, preemption, node loss) count against the backoff limit
+						Action: batchv1.PodFailurePolicyActionCount,
+						OnPodConditions: []batchv1.PodFailurePolicyOnPodConditionsPattern{
+							{Type: v1.DisruptionTarget, Status: v1.ConditionTrue},
+						},
+					},
+					{
+						// A failing build script is not retried
+						Action: batchv1.PodFailurePolicyActionFailJob,
+						OnExitCodes: &batchv1.PodFailurePolicyOnExitCodesRequirement{
+							ContainerName: stringPtr("build"),
+							Operator:      batchv1.PodFailurePolicyOnExitCodesOpNotIn,
+							Values:        []int32{0},
+						},
+					},
+				},
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+
+	return clientset.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
+}
+
+// setJobOwner adds an owner reference to job on each resource so that they
+// are deleted together with it
+func setJobOwner(ctx context.Context, clientset kubernetes.Interface, job *batchv1.Job, resources []ownedResource, namespace string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{
+				{
+					APIVersion: "batch/v1",
+					Kind:       "Job",
+					Name:       job.Name,
+					UID:        job.UID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, res := range resources {
+		switch res.kind {
+		case "ConfigMap":
+			_, err = clientset.CoreV1().ConfigMaps(namespace).Patch(ctx, res.name, types.MergePatchType, patch, metav1.PatchOptions{})
+		case "Secret":
+			_, err = clientset.CoreV1().Secrets(namespace).Patch(ctx, res.name, types.MergePatchType, patch, metav1.PatchOptions{})
+		case "PersistentVolumeClaim":
+			_, err = clientset.CoreV1().PersistentVolumeClaims(namespace).Patch(ctx, res.name, types.MergePatchType, patch, metav1.PatchOptions{})
+		default:
+			err = fmt.Errorf("unsupported kind %s", res.kind)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set owner on %s %s: %v", res.kind, res.name, err)
+		}
+	}
+
+	return nil
+}
+
+// buildTimeout returns the deadline of a build in seconds, using the project
+// timeout when set
+func buildTimeout(project db.Project) int64 {
+	if project.BuildTimeout > 0 {
+		return int64(project.BuildTimeout)
+	}
+	return int64(utils.EnvInt("BUILD_DEFAULT_TIMEOUT", defaultBuildTimeout, 1))
+}
+
+func getBackoffLimit() int32 {
+	return int32(utils.EnvInt("BUILD_BACKOFF_LIMIT", defaultBackoffLimit, 0))
+}
+
+func getJobTTL() int32 {
+	return int32(utils.EnvInt("BUILD_JOB_TTL", defaultJobTTLAfterDone, 0))
+}
+
+func int32Ptr(i int32) *int32    { return &i }
+func int64Ptr(i int64) *int64    { return &i }
+func stringPtr(s string) *string { return &s }
@@ -4,51 +4,65 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-// BuildConfig contains all configuration for creating a build pod
-type BuildConfig struct {
-	BuildID        uint
-	Project        db.Project
-	Platform       string
-	BuildMode      string // release, debug, profile
-	BuildTarget    string // apk, aab, ios, web
-	FlutterChannel string // stable, beta, dev
-	GitBranch      string
-	GitUsername    string
-	GitPassword    string
+// Executor runs builds as pods in a Kubernetes namespace
+type Executor struct {
+	clientset  kubernetes.Interface
+	restConfig *rest.Config
+	namespace  string
 }
 
-// CreateBuildPod creates a Kubernetes pod to build a Flutter application
-func CreateBuildPod(config BuildConfig) error {
-	kubeConfig, err := getKubernetesConfig()
+var _ executor.BuildExecutor = (*Executor)(nil)
+
+// NewExecutor creates an executor using the configured cluster credentials
+func NewExecutor() (*Executor, error) {
+	config, err := getKubernetesConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return fmt.Errorf("failed to create clientset: %v", err)
+		return nil, fmt.Errorf("failed to create clientset: %v", err)
 	}
 
-	namespace := getNamespace()
-	podName := fmt.Sprintf("build-%d", config.BuildID)
+	return &Executor{
+		clientset:  clientset,
+		restConfig: config,
+		namespace:  getNamespace(),
+	}, nil
+}
+
+// Start creates a Kubernetes Job to build a Flutter application. On failure,
+// the resources already created are deleted, the Job included, so that no
+// Secret holding credentials is left behind and the build is not running.
+func (e *Executor) Start(ctx context.Context, config executor.BuildConfig) (err error) {
+	defer func() {
+		if err != nil {
+			if cleanupErr := DeleteBuildResources(e.clientset, config.BuildID, e.namespace); cleanupErr != nil {
+				fmt.Printf("Warning: failed to clean up build %d: %v\n", config.BuildID, cleanupErr)
+			}
+		}
+	}()
 
 	// Create PVC for artifacts
-	pvcName, err := CreatePersistentVolumeClaimForArtifacts(clientset, config.BuildID, namespace)
+	pvcName, err := CreatePersistentVolumeClaimForArtifacts(e.clientset, config.BuildID, e.namespace)
 	if err != nil {
 		return fmt.Errorf("failed to create PVC: %v", err)
 	}
 
 	// Create ConfigMap for environment files
-	configMapName, err := CreateConfigMapForEnvFiles(clientset, config.BuildID, config.Project.ID, namespace)
+	configMapName, envFileItems, err := CreateConfigMapForEnvFiles(e.clientset, config.BuildID, config.Project.ID, config.EnvRevision, config.Environment, e.namespace)
 	if err != nil {
 		return fmt.Errorf("failed to create ConfigMap: %v", err)
 	}
@@ -56,28 +70,38 @@ func CreateBuildPod(config BuildConfig) error {
 	// Create Secret for keystore (Android only)
 	var secretName string
 	if config.Platform == "android" {
-		secretName, err = CreateSecretForKeystore(clientset, config.BuildID, config.Project.ID, namespace)
+		secretName, err = CreateSecretForKeystore(e.clientset, config.BuildID, config.Project.ID, e.namespace)
 		if err != nil {
 			return fmt.Errorf("failed to create Secret: %v", err)
 		}
 	}
 
-	// Build environment variables
-	envVars := buildEnvironmentVariables(config)
+	// Build environment variables: the build settings in the pod spec, the
+	// git credentials and project variables in a Secret, out of reach of
+	// whoever can read pods
+	envVars, secretVars := buildEnvironmentVariables(config)
 
-	// Add environment variables from database
+	// Add environment variables from the build env revision, resolved for
+	// the build environment and decrypted when loaded
 	if db.DB != nil {
-		var dbEnvs []db.Env
-		if err := db.DB.Where("project_id = ? AND type = ?", config.Project.ID, "env").Find(&dbEnvs).Error; err == nil {
-			for _, dbEnv := range dbEnvs {
-				envVars = append(envVars, v1.EnvVar{
-					Name:  dbEnv.Key,
-					Value: dbEnv.Value,
-				})
+		dbEnvs, err := db.BuildEnvs(config.Project.ID, config.EnvRevision, config.Environment)
+		if err != nil {
+			return fmt.Errorf("failed to fetch environment variables: %v", err)
+		}
+		for _, dbEnv := range dbEnvs {
+			if dbEnv.Type != "env" {
+				continue
 			}
+			secretVars = append(secretVars, executor.EnvVar{Name: dbEnv.Key, Value: string(dbEnv.Value), Secret: true})
 		}
 	}
 
+	envSecretName, secretEnvVars, err := CreateSecretForEnvVars(e.clientset, config.BuildID, secretVars, e.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to create environment Secret: %v", err)
+	}
+	envVars = append(envVars, secretEnvVars...)
+
 	// Build volume mounts
 	volumeMounts := []v1.VolumeMount{
 		{
@@ -157,6 +181,7 @@ func CreateBuildPod(config BuildConfig) error {
 					LocalObjectReference: v1.LocalObjectReference{
 						Name: configMapName,
 					},
+					Items: envFileItems,
 				},
 			},
 		})
@@ -174,223 +199,172 @@ func CreateBuildPod(config BuildConfig) error {
 		})
 	}
 
-	// Define the pod
-	pod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      podName,
-			Namespace: namespace,
-			Labels: map[string]string{
-				"app":        "flotio-build",
-				"build-id":   strconv.Itoa(int(config.BuildID)),
-				"project-id": strconv.Itoa(int(config.Project.ID)),
-				"platform":   config.Platform,
-			},
-		},
-		Spec: v1.PodSpec{
-			RestartPolicy: v1.RestartPolicyNever,
-			Containers: []v1.Container{
-				{
-					Name:         "build",
-					Image:        getFlutterBuildImage(),
-					Env:          envVars,
-					VolumeMounts: volumeMounts,
-					Resources: v1.ResourceRequirements{
-						Requests: v1.ResourceList{
-							v1.ResourceCPU:    parseQuantity("1000m"),
-							v1.ResourceMemory: parseQuantity("2Gi"),
-						},
-						Limits: v1.ResourceList{
-							v1.ResourceCPU:    parseQuantity("4000m"),
-							v1.ResourceMemory: parseQuantity("8Gi"),
-						},
+	// Define the pod template run by the build Job
+	podSpec := v1.PodSpec{
+		RestartPolicy:                 v1.RestartPolicyNever,
+		TerminationGracePeriodSeconds: int64Ptr(buildPodGracePeriod),
+		Containers: []v1.Container{
+			{
+				Name:         "build",
+				Image:        getFlutterBuildImage(),
+				Env:          envVars,
+				VolumeMounts: volumeMounts,
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceCPU:    parseQuantity("1000m"),
+						v1.ResourceMemory: parseQuantity("2Gi"),
+					},
+					Limits: v1.ResourceList{
+						v1.ResourceCPU:    parseQuantity("4000m"),
+						v1.ResourceMemory: parseQuantity("8Gi"),
 					},
 				},
 			},
-			Volumes: volumes,
 		},
+		Volumes: volumes,
 	}
 
-	// Create the pod
-	_, err = clientset.CoreV1().Pods(namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	job, err := CreateBuildJob(ctx, e.clientset, config, podSpec, e.namespace)
 	if err != nil {
-		return fmt.Errorf("failed to create pod: %v", err)
+		return fmt.Errorf("failed to create Job: %v", err)
 	}
 
-	return nil
-}
-
-// buildEnvironmentVariables creates the environment variables for the build container
-func buildEnvironmentVariables(config BuildConfig) []v1.EnvVar {
-	envVars := []v1.EnvVar{
-		{Name: "GIT_REPO", Value: config.Project.GitRepo},
-		{Name: "BUILD_FOLDER", Value: config.Project.BuildFolder},
-		{Name: "PLATFORM", Value: config.Platform},
-		{Name: "BUILD_ID", Value: strconv.Itoa(int(config.BuildID))},
-		{Name: "BUILD_MODE", Value: getBuildMode(config.BuildMode)},
-		{Name: "BUILD_TARGET", Value: getBuildTarget(config.Platform, config.BuildTarget)},
-		{Name: "FLUTTER_CHANNEL", Value: getFlutterChannel(config.FlutterChannel)},
-		{Name: "OUTPUT_DIR", Value: "/outputs"},
-		{Name: "ENV_FILES_DIR", Value: "/env-files"},
+	// Let the ConfigMap, Secret and PVC be garbage-collected with the Job.
+	// Without that they would outlive it, the Job is deleted on failure.
+	owned := []ownedResource{{kind: "PersistentVolumeClaim", name: pvcName}}
+	if configMapName != "" {
+		owned = append(owned, ownedResource{kind: "ConfigMap", name: configMapName})
 	}
-
-	// Add Git branch if specified
-	if config.GitBranch != "" {
-		envVars = append(envVars, v1.EnvVar{Name: "GIT_BRANCH", Value: config.GitBranch})
+	if secretName != "" {
+		owned = append(owned, ownedResource{kind: "Secret", name: secretName})
 	}
-
-	// Add Git credentials if specified
-	if config.GitUsername != "" {
-		envVars = append(envVars, v1.EnvVar{Name: "GIT_USERNAME", Value: config.GitUsername})
+	if envSecretName != "" {
+		owned = append(owned, ownedResource{kind: "Secret", name: envSecretName})
 	}
-	if config.GitPassword != "" {
-		envVars = append(envVars, v1.EnvVar{Name: "GIT_PASSWORD", Value: config.GitPassword})
+	if err := setJobOwner(ctx, e.clientset, job, owned, e.namespace); err != nil {
+		return fmt.Errorf("failed to attach resources to Job: %v", err)
 	}
 
-	return envVars
+	return nil
 }
 
-func GetPodLogs(buildID uint) ([]string, error) {
-	config, err := getKubernetesConfig()
-	if err != nil {
-		return nil, err
+// buildEnvironmentVariables creates the environment variables for the build
+// container, and returns apart the credentials to store in a Secret
+func buildEnvironmentVariables(config executor.BuildConfig) ([]v1.EnvVar, []executor.EnvVar) {
+	var envVars []v1.EnvVar
+	var secretVars []executor.EnvVar
+	for _, env := range executor.Environment(config) {
+		if env.Secret {
+			secretVars = append(secretVars, env)
+			continue
+		}
+		envVars = append(envVars, v1.EnvVar{Name: env.Name, Value: env.Value})
 	}
+	return envVars, secretVars
+}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create clientset: %v", err)
-	}
+// Cancel gracefully stops a build Job and removes the ConfigMap, Secret and
+// PVC created for it
+func (e *Executor) Cancel(ctx context.Context, buildID uint) error {
+	return DeleteBuildResources(e.clientset, buildID, e.namespace)
+}
 
-	podName := fmt.Sprintf("build-%d", buildID)
-	namespace := getNamespace()
+// Status returns the current state of a build Job
+func (e *Executor) Status(ctx context.Context, buildID uint) (executor.BuildState, error) {
+	jobName := fmt.Sprintf("build-%d", buildID)
 
-	req := clientset.CoreV1().Pods(namespace).GetLogs(podName, &v1.PodLogOptions{})
-	logStream, err := req.Stream(context.TODO())
+	job, err := e.clientset.BatchV1().Jobs(e.namespace).Get(ctx, jobName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get log stream: %v", err)
+		if apierrors.IsNotFound(err) {
+			return executor.BuildState{}, executor.ErrNotFound
+		}
+		return executor.BuildState{}, fmt.Errorf("failed to get Job: %v", err)
 	}
-	defer logStream.Close()
 
-	var logs []string
-	buf := make([]byte, 4096)
-	for {
-		n, err := logStream.Read(buf)
-		if n > 0 {
-			logs = append(logs, string(buf[:n]))
-		}
-		if err != nil {
-			break
-		}
+	pod, err := e.latestPod(ctx, buildID)
+	if err != nil && err != executor.ErrNotFound {
+		return executor.BuildState{}, err
 	}
 
-	return logs, nil
+	return jobState(job, pod), nil
 }
 
-func StreamPodLogs(buildID uint, logChan chan<- string) error {
-	config, err := getKubernetesConfig()
-	if err != nil {
-		return err
-	}
+// Logs returns the output of the latest pod of a build
+func (e *Executor) Logs(ctx context.Context, buildID uint) ([]executor.LogLine, error) {
+	lineChan := make(chan executor.LogLine)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- e.readLogs(ctx, buildID, &v1.PodLogOptions{Timestamps: true}, lineChan)
+		close(lineChan)
+	}()
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return fmt.Errorf("failed to create clientset: %v", err)
+	var lines []executor.LogLine
+	for line := range lineChan {
+		lines = append(lines, line)
 	}
+	return lines, <-errChan
+}
 
-	podName := fmt.Sprintf("build-%d", buildID)
-	namespace := getNamespace()
+// StreamLogs follows the output of the latest pod of a build until it terminates
+func (e *Executor) StreamLogs(ctx context.Context, buildID uint, since time.Time, lines chan<- executor.LogLine) error {
+	defer close(lines)
 
-	req := clientset.CoreV1().Pods(namespace).GetLogs(podName, &v1.PodLogOptions{
-		Follow: true,
-	})
-	logStream, err := req.Stream(context.TODO())
-	if err != nil {
-		return fmt.Errorf("failed to get log stream: %v", err)
+	options := &v1.PodLogOptions{
+		Follow:     true,
+		Timestamps: true,
 	}
-	defer logStream.Close()
-
-	buf := make([]byte, 4096)
-	for {
-		n, err := logStream.Read(buf)
-		if n > 0 {
-			logChan <- string(buf[:n])
-		}
-		if err != nil {
-			close(logChan)
-			break
-		}
+	if !since.IsZero() {
+		// The API has a one second resolution, callers drop what they already have
+		sinceTime := metav1.NewTime(since.Truncate(time.Second))
+		options.SinceTime = &sinceTime
 	}
 
-	return nil
+	return e.readLogs(ctx, buildID, options, lines)
 }
 
-// GetPodStatus returns the current status of a build pod
-func GetPodStatus(buildID uint) (string, error) {
-	config, err := getKubernetesConfig()
-	if err != nil {
-		return "", err
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
+// readLogs sends the log lines of the latest pod of a build to lines
+func (e *Executor) readLogs(ctx context.Context, buildID uint, options *v1.PodLogOptions, lines chan<- executor.LogLine) error {
+	pod, err := e.latestPod(ctx, buildID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create clientset: %v", err)
+		return err
 	}
 
-	podName := fmt.Sprintf("build-%d", buildID)
-	namespace := getNamespace()
-
-	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
+	options.Container = "build"
+	logStream, err := e.clientset.CoreV1().Pods(e.namespace).GetLogs(pod.Name, options).Stream(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get pod: %v", err)
+		return fmt.Errorf("failed to get log stream: %v", err)
 	}
+	defer logStream.Close()
 
-	return string(pod.Status.Phase), nil
-}
-
-// CopyArtifactFromPod copies a build artifact from the pod to a local path
-// This can be used to retrieve APK/AAB/IPA files after build completion
-func CopyArtifactFromPod(buildID uint, artifactPath string, destinationPath string) error {
-	// Note: This is a simplified version. In production, you might want to use
-	// kubectl cp equivalent or directly access the PVC
-	// For now, we'll document that artifacts should be uploaded to object storage
-	// from within the build script itself
-	return fmt.Errorf("artifact copying should be handled by the build script uploading to object storage")
+	return executor.ReadTimestampedLines(ctx, logStream, lines)
 }
 
-// GetBuildArtifacts returns information about the artifacts produced by a build
-func GetBuildArtifacts(buildID uint) (map[string]string, error) {
-	config, err := getKubernetesConfig()
+// latestPod returns the most recently created pod of a build Job, which is
+// the one still running or the last retry
+func (e *Executor) latestPod(ctx context.Context, buildID uint) (*v1.Pod, error) {
+	pods, err := e.clientset.CoreV1().Pods(e.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=flotio-build,build-id=%d", buildID),
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to list pods: %v", err)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create clientset: %v", err)
+	var latest *v1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if latest == nil || pod.CreationTimestamp.After(latest.CreationTimestamp.Time) {
+			latest = pod
+		}
 	}
-
-	podName := fmt.Sprintf("build-%d", buildID)
-	namespace := getNamespace()
-
-	// Read build-info.json from the pod
-	req := clientset.CoreV1().Pods(namespace).GetLogs(podName, &v1.PodLogOptions{
-		Container: "build",
-	})
-
-	logStream, err := req.Stream(context.TODO())
-	if err != nil {
-		return nil, fmt.Errorf("failed to get logs: %v", err)
+	if latest == nil {
+		return nil, executor.ErrNotFound
 	}
-	defer logStream.Close()
-
-	// In a real implementation, you would:
-	// 1. Mount the PVC to another pod to read the artifacts
-	// 2. Or have the build script upload artifacts to S3/MinIO/GCS
-	// 3. Return URLs to the artifacts
-
-	artifacts := make(map[string]string)
-	artifacts["status"] = "Build artifacts should be retrieved from object storage"
+	return latest, nil
+}
 
-	return artifacts, nil
+// Watch runs the build reconciler until ctx is cancelled
+func (e *Executor) Watch(ctx context.Context) {
+	NewBuildReconciler(e.clientset, e.namespace).Run(ctx)
 }
 
 // Helper functions
@@ -431,34 +405,3 @@ func getFlutterBuildImage() string {
 	}
 	return image
 }
-
-func getBuildMode(mode string) string {
-	if mode == "" {
-		return "release"
-	}
-	return mode
-}
-
-func getBuildTarget(platform, target string) string {
-	if target != "" {
-		return target
-	}
-
-	switch platform {
-	case "android":
-		return "apk"
-	case "ios":
-		return "ios"
-	case "web":
-		return "web"
-	default:
-		return "apk"
-	}
-}
-
-func getFlutterChannel(channel string) string {
-	if channel == "" || channel == "latest" {
-		return "stable"
-	}
-	return channel
-}
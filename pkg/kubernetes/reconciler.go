@@ -0,0 +1,331 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	buildPodSelector = "app=flotio-build"
+
+	// reconcilerResyncPeriod is how often the informer replays every cached pod
+	reconcilerResyncPeriod = 5 * time.Minute
+
+	// orphanGracePeriod is how long a pending build may exist without a Job
+	// before the reconciler considers it lost
+	orphanGracePeriod = 2 * time.Minute
+)
+
+// BuildReconciler watches build Jobs and their pods and drives db.Build rows
+// to completion
+type BuildReconciler struct {
+	clientset kubernetes.Interface
+	namespace string
+	jobLister batchlisters.JobLister
+	podLister corelisters.PodLister
+}
+
+// NewBuildReconciler creates a reconciler watching build Jobs in namespace
+func NewBuildReconciler(clientset kubernetes.Interface, namespace string) *BuildReconciler {
+	return &BuildReconciler{
+		clientset: clientset,
+		namespace: namespace,
+	}
+}
+
+// Run starts the Job and pod informers and blocks until ctx is cancelled.
+// Once the caches are synced, unfinished builds in the database are
+// reconciled against the Jobs currently in the cluster so that state lost
+// during an API restart is recovered.
+func (r *BuildReconciler) Run(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		r.clientset,
+		reconcilerResyncPeriod,
+		informers.WithNamespace(r.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = buildPodSelector
+		}),
+	)
+
+	jobInformer := factory.Batch().V1().Jobs()
+	podInformer := factory.Core().V1().Pods()
+	r.jobLister = jobInformer.Lister()
+	r.podLister = podInformer.Lister()
+
+	jobInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if job, ok := obj.(*batchv1.Job); ok {
+				r.syncObject(job)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if job, ok := newObj.(*batchv1.Job); ok {
+				r.syncObject(job)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if job, ok := obj.(*batchv1.Job); ok {
+				r.handleJobDeleted(job)
+			}
+		},
+	})
+
+	// Pod events carry container start and termination details the Job lacks
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				r.syncObject(pod)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if pod, ok := newObj.(*v1.Pod); ok {
+				r.syncObject(pod)
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), jobInformer.Informer().HasSynced, podInformer.Informer().HasSynced) {
+		log.Println("Build reconciler: failed to sync caches")
+		return
+	}
+
+	log.Println("Build reconciler started")
+	r.recoverUnfinishedBuilds()
+
+	<-ctx.Done()
+	factory.Shutdown()
+	log.Println("Build reconciler stopped")
+}
+
+// recoverUnfinishedBuilds matches every build still pending or running in
+// the database with its Job, failing builds whose Job has disappeared
+func (r *BuildReconciler) recoverUnfinishedBuilds() {
+	builds, err := executor.UnfinishedBuilds()
+	if err != nil {
+		log.Printf("Build reconciler: failed to list unfinished builds: %v", err)
+		return
+	}
+
+	for _, build := range builds {
+		_, err := r.jobLister.Jobs(r.namespace).Get(fmt.Sprintf("build-%d", build.ID))
+		if err == nil {
+			r.syncBuild(build.ID)
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			log.Printf("Build reconciler: failed to get Job for build %d: %v", build.ID, err)
+			continue
+		}
+
+		// A pending build may simply not have its Job yet
+		if build.Status == db.BuildStatusPending && time.Since(build.CreatedAt) < orphanGracePeriod {
+			continue
+		}
+
+		if err := executor.MarkLost(build.ID, "JobNotFound"); err != nil {
+			log.Printf("Build reconciler: failed to mark build %d as failed: %v", build.ID, err)
+		}
+	}
+}
+
+// syncObject reconciles the build a Job or pod belongs to
+func (r *BuildReconciler) syncObject(obj metav1.Object) {
+	buildID, err := buildIDFromLabels(obj)
+	if err != nil {
+		log.Printf("Build reconciler: %v", err)
+		return
+	}
+	r.syncBuild(buildID)
+}
+
+// syncBuild maps the Job conditions and latest pod state onto the build
+func (r *BuildReconciler) syncBuild(buildID uint) {
+	job, err := r.jobLister.Jobs(r.namespace).Get(fmt.Sprintf("build-%d", buildID))
+	if err != nil {
+		// Pods outlive their Job only while being deleted, which handleJobDeleted covers
+		return
+	}
+
+	if err := executor.ApplyState(buildID, jobState(job, r.latestPod(buildID))); err != nil {
+		log.Printf("Build reconciler: failed to update build %d from Job %s: %v", buildID, job.Name, err)
+	}
+}
+
+// handleJobDeleted fails builds whose Job vanished before finishing
+func (r *BuildReconciler) handleJobDeleted(job *batchv1.Job) {
+	buildID, err := buildIDFromLabels(job)
+	if err != nil {
+		log.Printf("Build reconciler: %v", err)
+		return
+	}
+
+	// Record whatever final state the Job carried before deciding it was lost
+	if err := executor.ApplyState(buildID, jobState(job, r.latestPod(buildID))); err != nil {
+		log.Printf("Build reconciler: failed to update build %d from Job %s: %v", buildID, job.Name, err)
+	}
+	if err := executor.MarkLost(buildID, "JobDeleted"); err != nil {
+		log.Printf("Build reconciler: failed to mark build %d as failed: %v", buildID, err)
+	}
+}
+
+// latestPod returns the most recently created cached pod of a build, or nil
+func (r *BuildReconciler) latestPod(buildID uint) *v1.Pod {
+	pods, err := r.podLister.Pods(r.namespace).List(labels.SelectorFromSet(labels.Set{
+		"app":      "flotio-build",
+		"build-id": strconv.Itoa(int(buildID)),
+	}))
+	if err != nil {
+		return nil
+	}
+
+	var latest *v1.Pod
+	for _, pod := range pods {
+		if latest == nil || pod.CreationTimestamp.After(latest.CreationTimestamp.Time) {
+			latest = pod
+		}
+	}
+	return latest
+}
+
+// jobState combines the Job conditions with the state of its latest pod.
+// The Job decides whether the build finished; the pod provides container
+// timings, exit code and termination reason.
+func jobState(job *batchv1.Job, pod *v1.Pod) executor.BuildState {
+	state := executor.BuildState{Status: db.BuildStatusPending}
+	if pod != nil {
+		state = podState(pod)
+	}
+
+	if state.StartedAt == nil && job.Status.StartTime != nil {
+		startedAt := job.Status.StartTime.Time
+		state.StartedAt = &startedAt
+	}
+
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != v1.ConditionTrue {
+			continue
+		}
+
+		switch cond.Type {
+		case batchv1.JobComplete:
+			state.Status = db.BuildStatusSuccess
+			if state.FinishedAt == nil {
+				finishedAt := cond.LastTransitionTime.Time
+				if job.Status.CompletionTime != nil {
+					finishedAt = job.Status.CompletionTime.Time
+				}
+				state.FinishedAt = &finishedAt
+			}
+			return state
+
+		case batchv1.JobFailed:
+			state.Status = db.BuildStatusFailed
+			// Keep the container reason when the build script itself failed
+			if cond.Reason != batchv1.JobReasonPodFailurePolicy || state.Reason == "" {
+				state.Reason = cond.Reason
+			}
+			if state.FinishedAt == nil {
+				finishedAt := cond.LastTransitionTime.Time
+				state.FinishedAt = &finishedAt
+			}
+			return state
+		}
+	}
+
+	// The Job is still active: a failed pod only means a retry is coming
+	if state.Status == db.BuildStatusFailed || state.Status == db.BuildStatusSuccess || state.Status == "" {
+		state.Status = db.BuildStatusPending
+		state.FinishedAt = nil
+		state.ExitCode = nil
+		state.Reason = ""
+	}
+
+	return state
+}
+
+// podState converts the pod phase and build container state into a BuildState
+func podState(pod *v1.Pod) executor.BuildState {
+	state := executor.BuildState{Status: buildStatusFromPhase(pod.Status.Phase)}
+
+	if cs := buildContainerState(pod); cs != nil {
+		if cs.Running != nil && !cs.Running.StartedAt.IsZero() {
+			startedAt := cs.Running.StartedAt.Time
+			state.StartedAt = &startedAt
+		}
+
+		if term := cs.Terminated; term != nil {
+			if !term.StartedAt.IsZero() {
+				startedAt := term.StartedAt.Time
+				state.StartedAt = &startedAt
+			}
+			if !term.FinishedAt.IsZero() {
+				finishedAt := term.FinishedAt.Time
+				state.FinishedAt = &finishedAt
+			}
+			exitCode := term.ExitCode
+			state.ExitCode = &exitCode
+			state.Reason = term.Reason
+		}
+	}
+
+	// A failed pod may not carry container state (e.g. eviction, deadline exceeded)
+	if state.Status == db.BuildStatusFailed && state.Reason == "" {
+		state.Reason = pod.Status.Reason
+	}
+
+	return state
+}
+
+// buildStatusFromPhase maps a pod phase to a build status, or "" when unknown
+func buildStatusFromPhase(phase v1.PodPhase) string {
+	switch phase {
+	case v1.PodPending:
+		return db.BuildStatusPending
+	case v1.PodRunning:
+		return db.BuildStatusRunning
+	case v1.PodSucceeded:
+		return db.BuildStatusSuccess
+	case v1.PodFailed:
+		return db.BuildStatusFailed
+	default:
+		return ""
+	}
+}
+
+// buildContainerState returns the state of the "build" container, if reported
+func buildContainerState(pod *v1.Pod) *v1.ContainerState {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == "build" {
+			return &pod.Status.ContainerStatuses[i].State
+		}
+	}
+	return nil
+}
+
+func buildIDFromLabels(obj metav1.Object) (uint, error) {
+	id, err := strconv.ParseUint(obj.GetLabels()["build-id"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s has an invalid build-id label: %v", obj.GetName(), err)
+	}
+	return uint(id), nil
+}
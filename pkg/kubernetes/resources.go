@@ -4,62 +4,76 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 
 	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"gorm.io/gorm"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 )
 
-// CreateConfigMapForEnvFiles creates a ConfigMap containing environment files for a build
-func CreateConfigMapForEnvFiles(clientset *kubernetes.Clientset, buildID uint, projectID uint, namespace string) (string, error) {
+// buildPodGracePeriod is how long a build pod has to stop after a deletion request
+const buildPodGracePeriod int64 = 30
+
+// CreateConfigMapForEnvFiles creates a ConfigMap containing the environment
+// files of a build, from its env revision resolved for its environment, and
+// the items mounting each of them under the name build.sh expects. ConfigMap
+// keys cannot hold the "::" and "/" of these names.
+func CreateConfigMapForEnvFiles(clientset kubernetes.Interface, buildID uint, projectID uint, revision int, environment string, namespace string) (string, []v1.KeyToPath, error) {
 	// Check if database is initialized
 	if db.DB == nil {
 		// No database connection, skip environment files
-		return "", nil
+		return "", nil, nil
 	}
 
 	// Fetch environment files from database
+	resolved, err := db.BuildEnvs(projectID, revision, environment)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch environment files: %v", err)
+	}
 	var envs []db.Env
-	if err := db.DB.Where("project_id = ? AND type = ?", projectID, "file").Find(&envs).Error; err != nil {
-		return "", fmt.Errorf("failed to fetch environment files: %v", err)
+	for _, env := range resolved {
+		if env.Type == "file" {
+			envs = append(envs, env)
+		}
 	}
 
 	if len(envs) == 0 {
-		return "", nil // No files to mount
+		return "", nil, nil // No files to mount
 	}
 
 	configMapName := fmt.Sprintf("build-%d-env-files", buildID)
-	data := make(map[string]string)
+	data := make(map[string][]byte)
+	items := make([]v1.KeyToPath, 0, len(envs))
+	size := 0
 
 	for _, env := range envs {
-		var content string
-		if env.IsBase64 {
-			// Decode base64 content
-			decoded, err := base64.StdEncoding.DecodeString(env.Value)
-			if err != nil {
-				return "", fmt.Errorf("failed to decode base64 content for %s: %v", env.Key, err)
-			}
-			content = string(decoded)
-		} else {
-			content = env.Value
+		content, err := env.FileContent()
+		if err != nil {
+			return "", nil, err
 		}
+		size += len(content)
 
-		// Use path as key with special encoding to preserve directory structure
-		// Format: path::actual_path where __ represents /
+		// Use path as file name with special encoding to preserve directory structure
+		// Format: key::encoded_path where __ represents /
 		// Example: google-services.json::android__app__google-services.json
 		fileName := env.Key
 		if env.Path != "" {
-			// Encode path: replace / with __
-			encodedPath := env.Path
-			for old, new := range map[string]string{"/": "__"} {
-				encodedPath = replaceAll(encodedPath, old, new)
-			}
-			fileName = fmt.Sprintf("%s::%s", env.Key, encodedPath)
+			fileName = fmt.Sprintf("%s::%s", env.Key, strings.ReplaceAll(env.Path, "/", "__"))
 		}
 
-		data[fileName] = content
+		key := fmt.Sprintf("env-%d", env.ID)
+		data[key] = content
+		items = append(items, v1.KeyToPath{Key: key, Path: fileName})
+	}
+
+	if size > db.MaxEnvFilesSize {
+		return "", nil, fmt.Errorf("environment files total %d bytes, more than the %d bytes a ConfigMap holds", size, db.MaxEnvFilesSize)
 	}
 
 	configMap := &v1.ConfigMap{
@@ -71,19 +85,19 @@ func CreateConfigMapForEnvFiles(clientset *kubernetes.Clientset, buildID uint, p
 				"build-id": fmt.Sprintf("%d", buildID),
 			},
 		},
-		Data: data,
+		BinaryData: data,
 	}
 
-	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
 	if err != nil {
-		return "", fmt.Errorf("failed to create ConfigMap: %v", err)
+		return "", nil, fmt.Errorf("failed to create ConfigMap: %v", err)
 	}
 
-	return configMapName, nil
+	return configMapName, items, nil
 }
 
 // CreateSecretForKeystore creates a Secret containing the keystore and credentials
-func CreateSecretForKeystore(clientset *kubernetes.Clientset, buildID uint, projectID uint, namespace string) (string, error) {
+func CreateSecretForKeystore(clientset kubernetes.Interface, buildID uint, projectID uint, namespace string) (string, error) {
 	// Check if database is initialized
 	if db.DB == nil {
 		// No database connection, skip keystore
@@ -93,13 +107,16 @@ func CreateSecretForKeystore(clientset *kubernetes.Clientset, buildID uint, proj
 	// Fetch active keystore from database
 	var keystore db.Keystore
 	if err := db.DB.Where("project_id = ? AND is_active = ?", projectID, true).First(&keystore).Error; err != nil {
-		return "", nil // No keystore configured (not an error)
+		if err == gorm.ErrRecordNotFound {
+			return "", nil // No keystore configured (not an error)
+		}
+		return "", fmt.Errorf("failed to fetch keystore: %v", err)
 	}
 
 	secretName := fmt.Sprintf("build-%d-keystore", buildID)
 
 	// Decode keystore file from base64
-	keystoreData, err := base64.StdEncoding.DecodeString(keystore.KeystoreFile)
+	keystoreData, err := base64.StdEncoding.DecodeString(string(keystore.KeystoreFile))
 	if err != nil {
 		return "", fmt.Errorf("failed to decode keystore file: %v", err)
 	}
@@ -118,9 +135,9 @@ func CreateSecretForKeystore(clientset *kubernetes.Clientset, buildID uint, proj
 			"keystore.jks": keystoreData,
 		},
 		StringData: map[string]string{
-			"store-password": keystore.StorePassword,
+			"store-password": string(keystore.StorePassword),
 			"key-alias":      keystore.KeyAlias,
-			"key-password":   keystore.KeyPassword,
+			"key-password":   string(keystore.KeyPassword),
 		},
 	}
 
@@ -132,8 +149,58 @@ func CreateSecretForKeystore(clientset *kubernetes.Clientset, buildID uint, proj
 	return secretName, nil
 }
 
+// CreateSecretForEnvVars creates a Secret holding the values of vars and
+// returns the variables referencing them for the build container. Keys are
+// the variable names when Secrets accept them.
+func CreateSecretForEnvVars(clientset kubernetes.Interface, buildID uint, vars []executor.EnvVar, namespace string) (string, []v1.EnvVar, error) {
+	if len(vars) == 0 {
+		return "", nil, nil
+	}
+
+	secretName := fmt.Sprintf("build-%d-env", buildID)
+	data := make(map[string][]byte, len(vars))
+	envVars := make([]v1.EnvVar, 0, len(vars))
+
+	for i, env := range vars {
+		key := env.Name
+		if len(validation.IsConfigMapKey(key)) > 0 || data[key] != nil {
+			key = fmt.Sprintf("env-%d", i)
+		}
+		data[key] = []byte(env.Value)
+		envVars = append(envVars, v1.EnvVar{
+			Name: env.Name,
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+					Key:                  key,
+				},
+			},
+		})
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":      "flotio-build",
+				"build-id": fmt.Sprintf("%d", buildID),
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create Secret: %v", err)
+	}
+
+	return secretName, envVars, nil
+}
+
 // CreatePersistentVolumeClaimForArtifacts creates a PVC for storing build artifacts
-func CreatePersistentVolumeClaimForArtifacts(clientset *kubernetes.Clientset, buildID uint, namespace string) (string, error) {
+func CreatePersistentVolumeClaimForArtifacts(clientset kubernetes.Interface, buildID uint, namespace string) (string, error) {
 	pvcName := fmt.Sprintf("build-%d-artifacts", buildID)
 
 	storageClassName := "standard" // Adjust based on your cluster
@@ -169,39 +236,41 @@ func CreatePersistentVolumeClaimForArtifacts(clientset *kubernetes.Clientset, bu
 	return pvcName, nil
 }
 
-// DeleteBuildResources deletes all Kubernetes resources associated with a build
-func DeleteBuildResources(clientset *kubernetes.Clientset, buildID uint, namespace string) error {
+// DeleteBuildResources deletes all Kubernetes resources associated with a build.
+// Deleting the Job removes its pods, which get buildPodGracePeriod seconds to
+// stop before being killed.
+func DeleteBuildResources(clientset kubernetes.Interface, buildID uint, namespace string) error {
 	ctx := context.TODO()
 	deletePolicy := metav1.DeletePropagationForeground
 
-	// Delete Pod
-	podName := fmt.Sprintf("build-%d", buildID)
-	err := clientset.CoreV1().Pods(namespace).Delete(ctx, podName, metav1.DeleteOptions{
+	// Delete Job and its pods
+	jobName := fmt.Sprintf("build-%d", buildID)
+	err := clientset.BatchV1().Jobs(namespace).Delete(ctx, jobName, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	})
-	if err != nil {
-		// Log but don't fail if pod doesn't exist
-		fmt.Printf("Warning: failed to delete pod %s: %v\n", podName, err)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete Job %s: %v", jobName, err)
 	}
 
 	// Delete ConfigMap
 	configMapName := fmt.Sprintf("build-%d-env-files", buildID)
 	err = clientset.CoreV1().ConfigMaps(namespace).Delete(ctx, configMapName, metav1.DeleteOptions{})
-	if err != nil {
+	if err != nil && !apierrors.IsNotFound(err) {
 		fmt.Printf("Warning: failed to delete ConfigMap %s: %v\n", configMapName, err)
 	}
 
-	// Delete Secret
-	secretName := fmt.Sprintf("build-%d-keystore", buildID)
-	err = clientset.CoreV1().Secrets(namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
-	if err != nil {
-		fmt.Printf("Warning: failed to delete Secret %s: %v\n", secretName, err)
+	// Delete Secrets
+	for _, secretName := range []string{fmt.Sprintf("build-%d-keystore", buildID), fmt.Sprintf("build-%d-env", buildID)} {
+		err = clientset.CoreV1().Secrets(namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			fmt.Printf("Warning: failed to delete Secret %s: %v\n", secretName, err)
+		}
 	}
 
 	// Delete PVC
 	pvcName := fmt.Sprintf("build-%d-artifacts", buildID)
 	err = clientset.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, pvcName, metav1.DeleteOptions{})
-	if err != nil {
+	if err != nil && !apierrors.IsNotFound(err) {
 		fmt.Printf("Warning: failed to delete PVC %s: %v\n", pvcName, err)
 	}
 
@@ -209,18 +278,6 @@ func DeleteBuildResources(clientset *kubernetes.Clientset, buildID uint, namespa
 }
 
 // Helper functions
-func replaceAll(s, old, new string) string {
-	result := ""
-	for _, char := range s {
-		if string(char) == old {
-			result += new
-		} else {
-			result += string(char)
-		}
-	}
-	return result
-}
-
 func parseQuantity(s string) resource.Quantity {
 	q, _ := resource.ParseQuantity(s)
 	return q
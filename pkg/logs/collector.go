@@ -0,0 +1,233 @@
+package logs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"gorm.io/gorm"
+)
+
+const (
+	// pollInterval is how often builds to follow are looked up when nothing wakes the collector
+	pollInterval = 2 * time.Second
+
+	// retryDelay is how long to wait before following a build again once its stream ended
+	retryDelay = 2 * time.Second
+
+	// maxFinishedRetries is how many times the logs of a finished build are
+	// requested after an error before giving up
+	maxFinishedRetries = 5
+
+	// catchUpWindow is how long after their end builds with incomplete logs
+	// are still followed, e.g. after an API restart
+	catchUpWindow = time.Hour
+
+	// followLockKey is the Postgres advisory lock namespace ensuring a single
+	// API replica follows a given build
+	followLockKey = 727002
+)
+
+var (
+	activeStatuses   = []string{db.BuildStatusPending, db.BuildStatusRunning}
+	finishedStatuses = []string{db.BuildStatusSuccess, db.BuildStatusFailed, db.BuildStatusCancelled}
+)
+
+// Collector follows the output of every started build and stores each line
+// exactly once, whether or not anybody is watching
+type Collector struct {
+	executor executor.BuildExecutor
+	wake     chan struct{}
+
+	mu        sync.Mutex
+	following map[uint]bool
+}
+
+// NewCollector creates a collector following builds run by exec
+func NewCollector(exec executor.BuildExecutor) *Collector {
+	return &Collector{
+		executor:  exec,
+		wake:      make(chan struct{}, 1),
+		following: map[uint]bool{},
+	}
+}
+
+// Notify asks the collector to look for builds without waiting for the next poll
+func (c *Collector) Notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run follows builds until ctx is cancelled
+func (c *Collector) Run(ctx context.Context) {
+	log.Println("Log collector started")
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		c.followPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Log collector stopped")
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+// followPending starts following the started builds whose logs are incomplete
+func (c *Collector) followPending(ctx context.Context) {
+	var builds []db.Build
+	err := db.DB.Select("id").
+		Where("logs_complete = ?", false).
+		Where(db.DB.Where("status IN ?", activeStatuses).
+			Or("status IN ? AND finished_at > ?", finishedStatuses, time.Now().Add(-catchUpWindow))).
+		Find(&builds).Error
+	if err != nil {
+		log.Printf("Log collector: failed to list builds: %v", err)
+		return
+	}
+
+	for _, build := range builds {
+		c.mu.Lock()
+		if c.following[build.ID] {
+			c.mu.Unlock()
+			continue
+		}
+		c.following[build.ID] = true
+		c.mu.Unlock()
+
+		go c.follow(ctx, build.ID)
+	}
+}
+
+// follow stores the output of a build until it is complete, unless another
+// API replica already follows it
+func (c *Collector) follow(ctx context.Context, buildID uint) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.following, buildID)
+		c.mu.Unlock()
+	}()
+
+	err := db.DB.Connection(func(conn *gorm.DB) error {
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?, ?)", followLockKey, buildID).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?, ?)", followLockKey, buildID)
+
+		return c.collect(ctx, buildID)
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Log collector: build %d: %v", buildID, err)
+	}
+}
+
+// collect follows the build output across pod retries and API restarts
+// until the build is finished and its stream exhausted
+func (c *Collector) collect(ctx context.Context, buildID uint) error {
+	w, err := newLineWriter(buildID)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for {
+		streamErr := c.stream(ctx, w)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var build db.Build
+		if err := db.DB.Select("id", "status").First(&build, buildID).Error; err != nil {
+			return err
+		}
+
+		exhausted := streamErr == nil || streamErr == executor.ErrNotFound
+		switch {
+		case build.IsFinished() && exhausted:
+			return complete(buildID)
+		case build.IsFinished():
+			failures++
+			if failures >= maxFinishedRetries {
+				log.Printf("Log collector: build %d: giving up: %v", buildID, streamErr)
+				return complete(buildID)
+			}
+			log.Printf("Log collector: build %d: %v", buildID, streamErr)
+		case !exhausted && build.Status == db.BuildStatusRunning:
+			// Pending builds have no pod to read from yet
+			log.Printf("Log collector: build %d: %v", buildID, streamErr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// complete records that the whole output of a build is stored. The git
+// credentials of the build were only kept to mask its logs, they are cleared.
+func complete(buildID uint) error {
+	if err := db.DB.Model(&db.Build{}).Where("id = ?", buildID).Updates(map[string]interface{}{
+		"logs_complete": true,
+		"git_username":  "",
+		"git_password":  "",
+		"git_token":     "",
+	}).Error; err != nil {
+		return err
+	}
+	notifyHub(buildID)
+	return nil
+}
+
+// stream follows the build output once, storing lines as they arrive
+func (c *Collector) stream(ctx context.Context, w *lineWriter) error {
+	// The dispatcher stores the git token of a build after it leaves the
+	// queue and before its pod exists: the masker is rebuilt each time the
+	// output is attached, so it holds the token once there is output
+	masker, err := MaskerForBuild(w.buildID)
+	if err != nil {
+		return err
+	}
+	w.masker = masker
+
+	since := w.resume()
+	lines := make(chan executor.LogLine, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.executor.StreamLogs(ctx, w.buildID, since, lines)
+	}()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				w.flush()
+				return <-errChan
+			}
+			w.add(line)
+			if len(w.buf) >= flushSize {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package logs
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+const (
+	// hubPollInterval is how often a build with subscribers looks for lines
+	// stored by another API replica
+	hubPollInterval = time.Second
+
+	// subscriberBuffer is how many events a subscriber may lag behind before
+	// being dropped
+	subscriberBuffer = 256
+
+	// hubBatchSize bounds how many lines are read from the store at once
+	hubBatchSize = 1000
+)
+
+// Event is delivered to the subscribers of a build: new lines, or the end
+// of the build output
+type Event struct {
+	Lines  []db.Log
+	Ended  bool
+	Status string // final build status, set with Ended
+}
+
+// Subscription receives the events of one build
+type Subscription struct {
+	// C is closed after the end event, or early when the subscriber lagged
+	// too far behind
+	C <-chan Event
+
+	// From is the last line published before the subscription; later lines
+	// are delivered on C
+	From int
+
+	buildID uint
+	ch      chan Event
+}
+
+// hub shares one store reader per build among all its subscribers
+type hub struct {
+	mu     sync.Mutex
+	topics map[uint]*topic
+}
+
+type topic struct {
+	buildID uint
+	last    int // last line published
+	subs    map[chan Event]struct{}
+	wake    chan struct{}
+}
+
+var buildHub = &hub{topics: map[uint]*topic{}}
+
+// Subscribe registers for the lines of a build stored from now on. Lines up
+// to Subscription.From are read from the store with Lines.
+func Subscribe(buildID uint) (*Subscription, error) {
+	buildHub.mu.Lock()
+	defer buildHub.mu.Unlock()
+
+	t, ok := buildHub.topics[buildID]
+	if !ok {
+		var last struct{ Max int }
+		if err := db.DB.Model(&db.Log{}).Select("COALESCE(MAX(line_number), 0) AS max").Where("build_id = ?", buildID).Scan(&last).Error; err != nil {
+			return nil, err
+		}
+
+		t = &topic{
+			buildID: buildID,
+			last:    last.Max,
+			subs:    map[chan Event]struct{}{},
+			wake:    make(chan struct{}, 1),
+		}
+		buildHub.topics[buildID] = t
+		go t.run()
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	t.subs[ch] = struct{}{}
+
+	return &Subscription{C: ch, From: t.last, buildID: buildID, ch: ch}, nil
+}
+
+// Close stops the delivery of events
+func (s *Subscription) Close() {
+	buildHub.mu.Lock()
+	defer buildHub.mu.Unlock()
+
+	if t, ok := buildHub.topics[s.buildID]; ok {
+		if _, ok := t.subs[s.ch]; ok {
+			delete(t.subs, s.ch)
+			close(s.ch)
+		}
+	}
+}
+
+// notifyHub wakes the reader of a build after lines were stored locally
+func notifyHub(buildID uint) {
+	buildHub.mu.Lock()
+	t, ok := buildHub.topics[buildID]
+	buildHub.mu.Unlock()
+
+	if ok {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run publishes stored lines until the build output ends or nobody listens
+func (t *topic) run() {
+	ticker := time.NewTicker(hubPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if !t.poll() {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+		}
+	}
+}
+
+// poll publishes the lines stored since the last poll and reports whether
+// the topic is still needed
+func (t *topic) poll() bool {
+	if !t.publishNew() {
+		return t.closeIfUnused()
+	}
+
+	var build db.Build
+	if err := db.DB.Select("id", "status", "logs_complete").First(&build, t.buildID).Error; err != nil {
+		log.Printf("Log hub: build %d: %v", t.buildID, err)
+		return t.closeIfUnused()
+	}
+
+	if build.LogsComplete {
+		// Lines stored right before completion
+		if t.publishNew() {
+			t.end(build.Status)
+			return false
+		}
+	}
+
+	return t.closeIfUnused()
+}
+
+// publishNew sends every line stored after the last published one, and
+// reports whether the store could be read
+func (t *topic) publishNew() bool {
+	for {
+		buildHub.mu.Lock()
+		last := t.last
+		buildHub.mu.Unlock()
+
+		lines, err := Lines(t.buildID, last, hubBatchSize)
+		if err != nil {
+			log.Printf("Log hub: build %d: %v", t.buildID, err)
+			return false
+		}
+		if len(lines) == 0 {
+			return true
+		}
+
+		t.publish(Event{Lines: lines})
+		if len(lines) < hubBatchSize {
+			return true
+		}
+	}
+}
+
+func (t *topic) publish(event Event) {
+	buildHub.mu.Lock()
+	defer buildHub.mu.Unlock()
+
+	if len(event.Lines) > 0 {
+		t.last = event.Lines[len(event.Lines)-1].LineNumber
+	}
+
+	for ch := range t.subs {
+		select {
+		case ch <- event:
+		default:
+			// Too slow: drop the subscriber, which resumes from its last line
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// end sends the end event and closes every subscription
+func (t *topic) end(status string) {
+	t.publish(Event{Ended: true, Status: status})
+
+	buildHub.mu.Lock()
+	defer buildHub.mu.Unlock()
+
+	for ch := range t.subs {
+		delete(t.subs, ch)
+		close(ch)
+	}
+	delete(buildHub.topics, t.buildID)
+}
+
+// closeIfUnused removes the topic once it has no subscriber
+func (t *topic) closeIfUnused() bool {
+	buildHub.mu.Lock()
+	defer buildHub.mu.Unlock()
+
+	if len(t.subs) > 0 {
+		return true
+	}
+	delete(buildHub.topics, t.buildID)
+	return false
+}
@@ -0,0 +1,122 @@
+package logs
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+const (
+	// redacted replaces secret values in stored logs
+	redacted = "***"
+
+	// minSecretLength is the shortest value masked, shorter ones would
+	// redact unrelated output
+	minSecretLength = 4
+)
+
+// Masker redacts known secret values, and their base64 and URL-encoded
+// forms, from log lines
+type Masker struct {
+	replacer *strings.Replacer
+}
+
+// NewMasker creates a masker for the given secret values
+func NewMasker(secrets []string) *Masker {
+	seen := map[string]bool{}
+	var forms []string
+	add := func(form string) {
+		if len(form) >= minSecretLength && !seen[form] {
+			seen[form] = true
+			forms = append(forms, form)
+		}
+	}
+
+	for _, secret := range secrets {
+		// Lines are masked one at a time, so multi-line values are masked line by line
+		for _, value := range strings.Split(secret, "\n") {
+			value = strings.TrimRight(value, "\r")
+			if len(value) < minSecretLength {
+				continue
+			}
+			add(value)
+			add(base64.StdEncoding.EncodeToString([]byte(value)))
+			add(base64.RawStdEncoding.EncodeToString([]byte(value)))
+			add(base64.URLEncoding.EncodeToString([]byte(value)))
+			add(base64.RawURLEncoding.EncodeToString([]byte(value)))
+			add(url.QueryEscape(value))
+			add(url.PathEscape(value))
+		}
+	}
+
+	if len(forms) == 0 {
+		return &Masker{}
+	}
+
+	// The replacer tries its arguments in order, longer forms must win over
+	// their prefixes
+	sort.Slice(forms, func(i, j int) bool { return len(forms[i]) > len(forms[j]) })
+
+	pairs := make([]string, 0, 2*len(forms))
+	for _, form := range forms {
+		pairs = append(pairs, form, redacted)
+	}
+	return &Masker{replacer: strings.NewReplacer(pairs...)}
+}
+
+// Mask returns line with every secret value redacted
+func (m *Masker) Mask(line string) string {
+	if m == nil || m.replacer == nil {
+		return line
+	}
+	return m.replacer.Replace(line)
+}
+
+// MaskerForBuild returns a masker for the secrets injected into a build: the
+// git password or token, the project variables flagged as secret and the keystore
+// passwords
+func MaskerForBuild(buildID uint) (*Masker, error) {
+	var build db.Build
+	if err := db.DB.Select("id", "project_id", "git_password", "git_token", "env_revision").First(&build, buildID).Error; err != nil {
+		return nil, err
+	}
+
+	secrets := []string{string(build.GitPassword), string(build.GitToken)}
+
+	// The current secrets, and those of the revision the build uses
+	var envs []db.Env
+	if err := db.DB.Where("project_id = ? AND secret = ?", build.ProjectID, true).Find(&envs).Error; err != nil {
+		return nil, err
+	}
+	if build.EnvRevision != 0 {
+		revisionEnvs, err := db.RevisionEnvs(build.ProjectID, build.EnvRevision)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, revisionEnvs...)
+	}
+	for _, env := range envs {
+		if !env.Secret {
+			continue
+		}
+		secrets = append(secrets, string(env.Value))
+		if env.IsBase64 {
+			if decoded, err := base64.StdEncoding.DecodeString(string(env.Value)); err == nil {
+				secrets = append(secrets, string(decoded))
+			}
+		}
+	}
+
+	var keystores []db.Keystore
+	if err := db.DB.Where("project_id = ?", build.ProjectID).Find(&keystores).Error; err != nil {
+		return nil, err
+	}
+	for _, keystore := range keystores {
+		secrets = append(secrets, string(keystore.StorePassword), string(keystore.KeyPassword))
+	}
+
+	return NewMasker(secrets), nil
+}
@@ -0,0 +1,128 @@
+package logs
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/executor"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// flushInterval is the longest a line waits in memory before being stored
+	flushInterval = 500 * time.Millisecond
+
+	// flushSize is how many buffered lines trigger an immediate flush
+	flushSize = 200
+)
+
+// Lines returns up to limit stored lines of a build numbered after afterLine
+func Lines(buildID uint, afterLine, limit int) ([]db.Log, error) {
+	var lines []db.Log
+	err := db.DB.Where("build_id = ? AND line_number > ?", buildID, afterLine).
+		Order("line_number").
+		Limit(limit).
+		Find(&lines).Error
+	return lines, err
+}
+
+// lineWriter numbers the lines of a build and stores them in batches. It
+// resumes after the last stored line, so following a build again never
+// stores a line twice.
+type lineWriter struct {
+	buildID  uint
+	masker   *Masker   // rebuilt by the collector for each stream
+	next     int       // number of the next stored line
+	last     time.Time // time of the last stored line
+	atLast   int       // how many stored lines have exactly that time
+	skip     int       // lines at last time still to skip in the current stream
+	resuming bool      // no line of the current stream was stored yet
+	buf      []db.Log
+}
+
+func newLineWriter(buildID uint) (*lineWriter, error) {
+	w := &lineWriter{buildID: buildID, next: 1}
+
+	var lastLine db.Log
+	err := db.DB.Where("build_id = ?", buildID).Order("line_number DESC").First(&lastLine).Error
+	if err == gorm.ErrRecordNotFound {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var atLast int64
+	if err := db.DB.Model(&db.Log{}).Where("build_id = ? AND time = ?", buildID, lastLine.Time).Count(&atLast).Error; err != nil {
+		return nil, err
+	}
+
+	w.next = lastLine.LineNumber + 1
+	w.last = lastLine.Time
+	w.atLast = int(atLast)
+	return w, nil
+}
+
+// resume prepares the writer for a new stream and returns the time it
+// should start from
+func (w *lineWriter) resume() time.Time {
+	w.resuming = !w.last.IsZero()
+	w.skip = w.atLast
+	return w.last
+}
+
+// add buffers a line unless it was already stored
+func (w *lineWriter) add(line executor.LogLine) {
+	// Match the precision of stored times so that resuming compares equal
+	t := line.Time.Truncate(time.Microsecond)
+
+	// A resumed stream starts up to a second early, drop what is stored
+	if w.resuming {
+		if t.Before(w.last) {
+			return
+		}
+		if t.Equal(w.last) && w.skip > 0 {
+			w.skip--
+			return
+		}
+		w.resuming = false
+	}
+
+	// Postgres text cannot hold NUL bytes nor invalid UTF-8
+	content := strings.ToValidUTF8(strings.ReplaceAll(line.Content, "\x00", ""), "�")
+	content = w.masker.Mask(content)
+
+	w.buf = append(w.buf, db.Log{
+		BuildID:    w.buildID,
+		LineNumber: w.next,
+		Content:    content,
+		Time:       t,
+		Timestamp:  t.Unix(),
+	})
+	w.next++
+
+	if t.Equal(w.last) {
+		w.atLast++
+	} else {
+		w.last = t
+		w.atLast = 1
+	}
+}
+
+// flush stores the buffered lines, keeping them for the next flush on error
+func (w *lineWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+
+	err := db.DB.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(w.buf, flushSize).Error
+	if err != nil {
+		log.Printf("Log collector: build %d: failed to store %d lines: %v", w.buildID, len(w.buf), err)
+		return
+	}
+	w.buf = w.buf[:0]
+	notifyHub(w.buildID)
+}
@@ -0,0 +1,301 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"github.com/flotio-dev/api/pkg/events"
+	"github.com/flotio-dev/api/pkg/executor"
+	"github.com/flotio-dev/api/pkg/githubapp"
+	"github.com/flotio-dev/api/pkg/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	// dispatchInterval is how often the queue is polled when nothing wakes the dispatcher
+	dispatchInterval = 5 * time.Second
+
+	// dispatcherLockKey is the Postgres advisory lock serialising dispatch across API replicas
+	dispatcherLockKey = 727001
+)
+
+// activeStatuses are the statuses counted against the concurrency limits
+var activeStatuses = []string{db.BuildStatusPending, db.BuildStatusRunning}
+
+// Limits caps how many builds may be active at the same time
+type Limits struct {
+	Global     int
+	PerUser    int
+	PerProject int
+}
+
+// LimitsFromEnv reads the concurrency limits from the environment
+func LimitsFromEnv() Limits {
+	return Limits{
+		Global:     utils.EnvInt("BUILD_MAX_CONCURRENT", 10, 1),
+		PerUser:    utils.EnvInt("BUILD_MAX_CONCURRENT_PER_USER", 2, 1),
+		PerProject: utils.EnvInt("BUILD_MAX_CONCURRENT_PER_PROJECT", 1, 1),
+	}
+}
+
+// Dispatcher starts queued builds while the concurrency limits allow it
+type Dispatcher struct {
+	limits Limits
+	wake   chan struct{}
+}
+
+var dispatcher *Dispatcher
+
+// InitDispatcher creates the process-wide dispatcher from the environment
+func InitDispatcher() *Dispatcher {
+	dispatcher = NewDispatcher(LimitsFromEnv())
+	return dispatcher
+}
+
+// Notify wakes the process-wide dispatcher, if any
+func Notify() {
+	if dispatcher != nil {
+		dispatcher.Notify()
+	}
+}
+
+// NewDispatcher creates a dispatcher enforcing the given limits
+func NewDispatcher(limits Limits) *Dispatcher {
+	return &Dispatcher{
+		limits: limits,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Notify asks the dispatcher to look at the queue without waiting for the next poll
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches queued builds until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	log.Printf("Build dispatcher started (global=%d, per user=%d, per project=%d)",
+		d.limits.Global, d.limits.PerUser, d.limits.PerProject)
+
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatch(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Build dispatcher stopped")
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// dispatch claims every queued build that fits within the limits and starts it
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	var claimed, cancelled []db.Build
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", dispatcherLockKey).Error; err != nil {
+			return err
+		}
+
+		var active []struct {
+			ProjectID uint
+			UserID    uint
+		}
+		if err := tx.Table("builds").
+			Select("builds.project_id, projects.user_id").
+			Joins("JOIN projects ON projects.id = builds.project_id").
+			Where("builds.status IN ? AND builds.deleted_at IS NULL", activeStatuses).
+			Scan(&active).Error; err != nil {
+			return err
+		}
+
+		total := len(active)
+		perUser := map[uint]int{}
+		perProject := map[uint]int{}
+		for _, a := range active {
+			perUser[a.UserID]++
+			perProject[a.ProjectID]++
+		}
+
+		if total >= d.limits.Global {
+			return nil
+		}
+
+		var queued []db.Build
+		if err := tx.Preload("Project").
+			Where("status = ?", db.BuildStatusQueued).
+			Order("created_at, id").
+			Find(&queued).Error; err != nil {
+			return err
+		}
+
+		for _, build := range queued {
+			if total >= d.limits.Global {
+				break
+			}
+
+			// The project was deleted while the build was waiting
+			if build.Project.ID == 0 {
+				result := tx.Model(&db.Build{}).Where("id = ? AND status = ?", build.ID, db.BuildStatusQueued).Updates(map[string]interface{}{
+					"status":             db.BuildStatusCancelled,
+					"termination_reason": "ProjectDeleted",
+					"finished_at":        time.Now(),
+				})
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected > 0 {
+					cancelled = append(cancelled, build)
+				}
+				continue
+			}
+
+			// The GitHub App installation of the project was suspended or
+			// deleted, or no longer grants its repository
+			if !build.Project.Buildable() {
+				result := tx.Model(&db.Build{}).Where("id = ? AND status = ?", build.ID, db.BuildStatusQueued).Updates(map[string]interface{}{
+					"status":             db.BuildStatusCancelled,
+					"termination_reason": "ProjectDisabled",
+					"finished_at":        time.Now(),
+				})
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected > 0 {
+					cancelled = append(cancelled, build)
+				}
+				continue
+			}
+
+			userID := build.Project.UserID
+			if perUser[userID] >= d.limits.PerUser || perProject[build.ProjectID] >= d.limits.PerProject {
+				continue
+			}
+
+			// Cancels do not take the dispatcher lock, the build may no
+			// longer be queued
+			result := tx.Model(&db.Build{}).Where("id = ? AND status = ?", build.ID, db.BuildStatusQueued).Update("status", db.BuildStatusPending)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+
+			total++
+			perUser[userID]++
+			perProject[build.ProjectID]++
+			claimed = append(claimed, build)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("Build dispatcher: failed to claim queued builds: %v", err)
+		return
+	}
+
+	for _, build := range cancelled {
+		events.BuildStatusChanged(build.ID, db.BuildStatusQueued, db.BuildStatusCancelled)
+	}
+	for _, build := range claimed {
+		events.BuildStatusChanged(build.ID, db.BuildStatusQueued, db.BuildStatusPending)
+		start(ctx, build)
+	}
+}
+
+// start hands a claimed build to the executor, failing it if that is not possible
+func start(ctx context.Context, build db.Build) {
+	config := executor.BuildConfig{
+		BuildID:        build.ID,
+		Project:        build.Project,
+		Platform:       build.Platform,
+		BuildMode:      build.BuildMode,
+		BuildTarget:    build.BuildTarget,
+		FlutterChannel: build.FlutterChannel,
+		GitBranch:      build.GitBranch,
+		GitCommit:      build.CommitSHA,
+		GitUsername:    string(build.GitUsername),
+		GitPassword:    string(build.GitPassword),
+		Environment:    build.Environment,
+		EnvRevision:    build.EnvRevision,
+	}
+
+	token, err := gitToken(ctx, build)
+	if err != nil {
+		log.Printf("Build dispatcher: failed to mint a GitHub token for build %d: %v", build.ID, err)
+		failStart(build, "GitTokenFailed")
+		return
+	}
+	config.GitToken = token
+
+	if err := executor.Default().Start(ctx, config); err != nil {
+		log.Printf("Build dispatcher: failed to start build %d: %v", build.ID, err)
+		failStart(build, "PodCreationFailed")
+		return
+	}
+
+	// The build may have been cancelled while it was being started
+	var current db.Build
+	if err := db.DB.Select("id", "status").First(&current, build.ID).Error; err == nil && current.Status == db.BuildStatusCancelled {
+		if err := executor.Default().Cancel(ctx, build.ID); err != nil {
+			log.Printf("Build dispatcher: failed to tear down cancelled build %d: %v", build.ID, err)
+		}
+	}
+}
+
+// failStart marks a pending build that could not be started as failed
+func failStart(build db.Build, reason string) {
+	result := db.DB.Model(&db.Build{}).Where("id = ? AND status = ?", build.ID, db.BuildStatusPending).Updates(map[string]interface{}{
+		"status":             db.BuildStatusFailed,
+		"termination_reason": reason,
+		"finished_at":        time.Now(),
+	})
+	if result.Error != nil {
+		log.Printf("Build dispatcher: failed to mark build %d as failed: %v", build.ID, result.Error)
+	} else if result.RowsAffected > 0 {
+		events.BuildStatusChanged(build.ID, db.BuildStatusPending, db.BuildStatusFailed)
+	}
+}
+
+// gitToken mints a read-only token for the GitHub repository of a build, when
+// the project owner installed the GitHub App on its account. It returns an
+// empty token when the build clones without it. The token is stored with the
+// build so its logs are masked.
+func gitToken(ctx context.Context, build db.Build) (string, error) {
+	owner, repo, ok := githubapp.ParseRepo(build.Project.GitRepo)
+	if !ok || !githubapp.Configured() {
+		return "", nil
+	}
+
+	installation, err := db.ProjectInstallation(build.Project)
+	if err == gorm.ErrRecordNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	token, _, err := githubapp.RepositoryToken(ctx, installation.InstallationID, owner, repo)
+	if err == githubapp.ErrOtherAccount {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := db.DB.Model(&db.Build{}).Where("id = ?", build.ID).Update("git_token", db.EncryptedString(token)).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
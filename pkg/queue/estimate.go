@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+)
+
+const (
+	// defaultBuildDuration is assumed when no build has completed yet
+	defaultBuildDuration = 10 * time.Minute
+
+	// durationSampleSize is how many recent successful builds feed the average duration
+	durationSampleSize = 50
+)
+
+// Annotate fills QueuePosition and EstimatedStartAt on queued builds.
+// Positions are global, so a build held back by its per-user or per-project
+// limit may start later than estimated.
+func Annotate(builds []db.Build) error {
+	var queued []uint
+	for i := range builds {
+		if builds[i].Status == db.BuildStatusQueued {
+			queued = append(queued, builds[i].ID)
+		}
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+
+	limits := LimitsFromEnv()
+	if dispatcher != nil {
+		limits = dispatcher.limits
+	}
+
+	var active int64
+	if err := db.DB.Model(&db.Build{}).Where("status IN ?", activeStatuses).Count(&active).Error; err != nil {
+		return err
+	}
+
+	average, err := averageBuildDuration()
+	if err != nil {
+		return err
+	}
+
+	// Positions of the listed builds among all the queued ones
+	var rows []struct {
+		ID       uint
+		Position int
+	}
+	err = db.DB.Raw(`SELECT id, position FROM (
+		SELECT id, ROW_NUMBER() OVER (ORDER BY created_at, id) AS position FROM builds
+		WHERE status = ? AND deleted_at IS NULL
+	) queue WHERE id IN ?`, db.BuildStatusQueued, queued).Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	positions := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		positions[row.ID] = row.Position
+	}
+
+	now := time.Now()
+	for i := range builds {
+		build := &builds[i]
+		position, ok := positions[build.ID]
+		if build.Status != db.BuildStatusQueued || !ok {
+			// Dispatched since it was read
+			continue
+		}
+
+		build.QueuePosition = position
+
+		// Every build ahead, running or queued, must free a slot first
+		waves := (int(active) + position - 1) / limits.Global
+		estimate := now.Add(time.Duration(waves) * average)
+		build.EstimatedStartAt = &estimate
+	}
+
+	return nil
+}
+
+// averageBuildDuration returns the mean duration of recent successful builds
+func averageBuildDuration() (time.Duration, error) {
+	var average float64
+	err := db.DB.Raw(`SELECT COALESCE(AVG(duration), 0) FROM (
+		SELECT duration FROM builds
+		WHERE status = ? AND duration > 0 AND deleted_at IS NULL
+		ORDER BY finished_at DESC
+		LIMIT ?
+	) recent`, db.BuildStatusSuccess, durationSampleSize).Scan(&average).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if average <= 0 {
+		return defaultBuildDuration, nil
+	}
+	return time.Duration(average * float64(time.Second)), nil
+}
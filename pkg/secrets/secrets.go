@@ -0,0 +1,279 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// prefix marks encrypted values, anything else is legacy plaintext
+const prefix = "enc:v1:"
+
+// keySize is the length of master and data keys (AES-256)
+const keySize = 32
+
+var (
+	// ErrNotConfigured is returned when no master key is set
+	ErrNotConfigured = errors.New("encryption key is not configured")
+
+	// ErrUnknownKey is returned for values wrapped by a master key that is
+	// neither the current one nor a previous one
+	ErrUnknownKey = errors.New("value encrypted with an unknown master key")
+)
+
+// masterKey wraps the data keys of encrypted values
+type masterKey struct {
+	id   string // derived from the key, stored with each value
+	aead cipher.AEAD
+}
+
+// keyring holds the key used for new values and every key still accepted
+// for decryption
+type keyring struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+var ring *keyring
+
+// Init loads the master keys from the environment: the current key from
+// ENCRYPTION_KEY or the file named by ENCRYPTION_KEY_FILE, and the keys being
+// rotated out from ENCRYPTION_PREVIOUS_KEYS (comma separated) or
+// ENCRYPTION_PREVIOUS_KEYS_FILE (one per line). Keys are 32 bytes, base64
+// encoded. It returns ErrNotConfigured when no current key is set.
+func Init() error {
+	current, err := readKeys("ENCRYPTION_KEY")
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return ErrNotConfigured
+	}
+	if len(current) > 1 {
+		return fmt.Errorf("ENCRYPTION_KEY must hold a single key")
+	}
+
+	previous, err := readKeys("ENCRYPTION_PREVIOUS_KEYS")
+	if err != nil {
+		return err
+	}
+
+	r := &keyring{keys: map[string]*masterKey{}}
+	for i, encoded := range append(current, previous...) {
+		key, err := newMasterKey(encoded)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			r.current = key
+		}
+		r.keys[key.id] = key
+	}
+
+	ring = r
+	return nil
+}
+
+// Configured reports whether new values are encrypted
+func Configured() bool {
+	return ring != nil
+}
+
+// IsEncrypted reports whether value was produced by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt seals plaintext with a new data key wrapped by the current master
+// key. Empty values are returned as is. Without master key it returns
+// ErrNotConfigured rather than storing plaintext.
+func Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return plaintext, nil
+	}
+	if ring == nil {
+		return "", ErrNotConfigured
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(data, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return ring.current.wrap(dataKey, sealed)
+}
+
+// Decrypt returns the plaintext of a value produced by Encrypt. Values
+// without the encryption prefix are returned as is.
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	keyID, dataKey, sealed, err := unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(data, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value (key %s): %v", keyID, err)
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap returns value with its data key wrapped by the current master key,
+// encrypting legacy plaintext. The sealed data is kept, so rotating the
+// master key does not re-encrypt the values themselves. changed is false
+// when value is already up to date.
+func Rewrap(value string) (rewrapped string, changed bool, err error) {
+	if ring == nil {
+		return "", false, ErrNotConfigured
+	}
+	if value == "" {
+		return value, false, nil
+	}
+	if !IsEncrypted(value) {
+		rewrapped, err = Encrypt(value)
+		return rewrapped, err == nil, err
+	}
+
+	keyID, dataKey, sealed, err := unwrap(value)
+	if err != nil {
+		return "", false, err
+	}
+	if keyID == ring.current.id {
+		return value, false, nil
+	}
+
+	rewrapped, err = ring.current.wrap(dataKey, sealed)
+	return rewrapped, err == nil, err
+}
+
+// wrap encodes a value as prefix + key ID : wrapped data key : sealed data
+func (k *masterKey) wrap(dataKey, sealed []byte) (string, error) {
+	wrapped, err := seal(k.aead, dataKey, []byte(k.id))
+	if err != nil {
+		return "", err
+	}
+	return prefix + k.id + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrap decodes a value and returns its data key, unwrapped with the
+// master key it names
+func unwrap(value string) (keyID string, dataKey, sealed []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value")
+	}
+	keyID = parts[0]
+
+	if ring == nil {
+		return keyID, nil, nil, ErrNotConfigured
+	}
+	key, ok := ring.keys[keyID]
+	if !ok {
+		return keyID, nil, nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return keyID, nil, nil, fmt.Errorf("malformed encrypted value: %v", err)
+	}
+	sealed, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return keyID, nil, nil, fmt.Errorf("malformed encrypted value: %v", err)
+	}
+
+	dataKey, err = open(key.aead, wrapped, []byte(keyID))
+	if err != nil {
+		return keyID, nil, nil, fmt.Errorf("failed to unwrap data key (key %s): %v", keyID, err)
+	}
+	return keyID, dataKey, sealed, nil
+}
+
+// readKeys returns the keys set in the variable name, or in the file named
+// by name_FILE
+func readKeys(name string) ([]string, error) {
+	raw := os.Getenv(name)
+	separator := ","
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		if raw != "" {
+			return nil, fmt.Errorf("%s and %s_FILE are both set", name, name)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_FILE: %v", name, err)
+		}
+		raw = string(content)
+		separator = "\n"
+	}
+
+	var keys []string
+	for _, key := range strings.Split(raw, separator) {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func newMasterKey(encoded string) (*masterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("encryption keys must be %d bytes, base64 encoded", keySize)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the nonce followed by the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,300 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	keyA = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'a'}, keySize))
+	keyB = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'b'}, keySize))
+	keyC = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'c'}, keySize))
+)
+
+// configure loads current and previous as the master keys, restoring the
+// keyring at the end of the test
+func configure(t *testing.T, current, previous string) {
+	t.Helper()
+
+	saved := ring
+	t.Cleanup(func() { ring = saved })
+
+	t.Setenv("ENCRYPTION_KEY", current)
+	t.Setenv("ENCRYPTION_KEY_FILE", "")
+	t.Setenv("ENCRYPTION_PREVIOUS_KEYS", previous)
+	t.Setenv("ENCRYPTION_PREVIOUS_KEYS_FILE", "")
+	if err := Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+}
+
+func TestInit(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "previous")
+	if err := os.WriteFile(keyFile, []byte(keyB+"\n\n"+keyC+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantKeys int
+		wantErr  string
+	}{
+		{"not configured", map[string]string{}, 0, ErrNotConfigured.Error()},
+		{"current only", map[string]string{"ENCRYPTION_KEY": keyA}, 1, ""},
+		{"previous keys", map[string]string{"ENCRYPTION_KEY": keyA, "ENCRYPTION_PREVIOUS_KEYS": keyB + ", " + keyC}, 3, ""},
+		{"previous keys file", map[string]string{"ENCRYPTION_KEY": keyA, "ENCRYPTION_PREVIOUS_KEYS_FILE": keyFile}, 3, ""},
+		{"several current keys", map[string]string{"ENCRYPTION_KEY": keyA + "," + keyB}, 0, "single key"},
+		{"short key", map[string]string{"ENCRYPTION_KEY": base64.StdEncoding.EncodeToString([]byte("short"))}, 0, "32 bytes"},
+		{"not base64", map[string]string{"ENCRYPTION_KEY": "not base64!"}, 0, "32 bytes"},
+		{"variable and file", map[string]string{"ENCRYPTION_KEY": keyA, "ENCRYPTION_PREVIOUS_KEYS": keyB, "ENCRYPTION_PREVIOUS_KEYS_FILE": keyFile}, 0, "both set"},
+		{"missing file", map[string]string{"ENCRYPTION_KEY_FILE": filepath.Join(t.TempDir(), "missing")}, 0, "failed to read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := ring
+			t.Cleanup(func() { ring = saved })
+			ring = nil
+
+			for _, name := range []string{"ENCRYPTION_KEY", "ENCRYPTION_KEY_FILE", "ENCRYPTION_PREVIOUS_KEYS", "ENCRYPTION_PREVIOUS_KEYS_FILE"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			err := Init()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if Configured() {
+					t.Error("Configured after a failed Init")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			if len(ring.keys) != tt.wantKeys {
+				t.Errorf("got %d keys, want %d", len(ring.keys), tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	configure(t, keyA, "")
+
+	tests := []struct {
+		name      string
+		plaintext string
+		encrypted bool
+	}{
+		{"empty stays empty", "", false},
+		{"ascii", "s3cr3t", true},
+		{"separator", "a:b:c", true},
+		{"unicode", "mot de passe é 🔑", true},
+		{"looks encrypted", prefix + "x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := Encrypt(tt.plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if IsEncrypted(value) != tt.encrypted {
+				t.Fatalf("IsEncrypted(%q) = %v, want %v", value, !tt.encrypted, tt.encrypted)
+			}
+			if tt.encrypted && strings.Contains(value, tt.plaintext) {
+				t.Errorf("%q holds the plaintext", value)
+			}
+
+			got, err := Decrypt(value)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if got != tt.plaintext {
+				t.Errorf("Decrypt = %q, want %q", got, tt.plaintext)
+			}
+		})
+	}
+
+	// Each value has its own data key and nonce
+	first, _ := Encrypt("same")
+	second, _ := Encrypt("same")
+	if first == second {
+		t.Error("encrypting the same value twice gives the same ciphertext")
+	}
+}
+
+func TestEncryptNotConfigured(t *testing.T) {
+	saved := ring
+	t.Cleanup(func() { ring = saved })
+	ring = nil
+
+	tests := []struct {
+		plaintext string
+		wantErr   error
+	}{
+		{"", nil},
+		{"plain", ErrNotConfigured},
+	}
+	for _, tt := range tests {
+		value, err := Encrypt(tt.plaintext)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Encrypt(%q): err = %v, want %v", tt.plaintext, err, tt.wantErr)
+		}
+		if err == nil && value != tt.plaintext {
+			t.Errorf("Encrypt(%q) = %q, want it unchanged", tt.plaintext, value)
+		}
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	configure(t, keyA, "")
+	encrypted, err := Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(encrypted, prefix), ":")
+
+	// Another data key, sealing different data
+	other, err := Encrypt("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherParts := strings.Split(strings.TrimPrefix(other, prefix), ":")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{"legacy plaintext", "plain", "plain", ""},
+		{"encrypted", encrypted, "s3cr3t", ""},
+		{"missing part", prefix + parts[0] + ":" + parts[1], "", "malformed"},
+		{"bad base64", prefix + parts[0] + ":" + parts[1] + ":!!", "", "malformed"},
+		{"unknown key", prefix + "00000000:" + parts[1] + ":" + parts[2], "", ErrUnknownKey.Error()},
+		{"swapped data key", prefix + parts[0] + ":" + otherParts[1] + ":" + parts[2], "", "failed to decrypt"},
+		{"truncated data", prefix + parts[0] + ":" + parts[1] + ":" + parts[2][:8], "", "failed to decrypt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decrypt(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Decrypt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	// Values written before the rotation, under key A
+	configure(t, keyA, "")
+	underA, err := Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(t, keyC, "")
+	underC, err := Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Key B replaces key A, which is kept for decryption
+	configure(t, keyB, keyA)
+	underB, err := Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		wantChanged bool
+		wantErr     error
+	}{
+		{"empty", "", false, nil},
+		{"legacy plaintext", "s3cr3t", true, nil},
+		{"previous key", underA, true, nil},
+		{"current key", underB, false, nil},
+		{"unknown key", underC, false, ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewrapped, changed, err := Rewrap(tt.value)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rewrap: %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if !changed && rewrapped != tt.value {
+				t.Errorf("unchanged value rewritten to %q", rewrapped)
+			}
+			if tt.value == "" {
+				return
+			}
+
+			keyID, _, sealed, err := unwrap(rewrapped)
+			if err != nil {
+				t.Fatalf("unwrap: %v", err)
+			}
+			if keyID != ring.current.id {
+				t.Errorf("wrapped by %s, want the current key %s", keyID, ring.current.id)
+			}
+			if IsEncrypted(tt.value) {
+				// Only the data key is rewrapped, the sealed data is kept
+				_, _, original, _ := unwrap(tt.value)
+				if !bytes.Equal(sealed, original) {
+					t.Error("rewrapping re-encrypted the data")
+				}
+			}
+			if got, err := Decrypt(rewrapped); err != nil || got != "s3cr3t" {
+				t.Errorf("Decrypt = %q, %v, want %q", got, err, "s3cr3t")
+			}
+		})
+	}
+
+	// Once the previous key is dropped, only rewrapped values still open
+	rewrapped, _, err := Rewrap(underA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(t, keyB, "")
+	if _, err := Decrypt(underA); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("old value: err = %v, want %v", err, ErrUnknownKey)
+	}
+	if got, err := Decrypt(rewrapped); err != nil || got != "s3cr3t" {
+		t.Errorf("rewrapped value: Decrypt = %q, %v, want %q", got, err, "s3cr3t")
+	}
+}
+
+func TestRewrapNotConfigured(t *testing.T) {
+	saved := ring
+	t.Cleanup(func() { ring = saved })
+	ring = nil
+
+	if _, _, err := Rewrap("plain"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("err = %v, want %v", err, ErrNotConfigured)
+	}
+}
@@ -0,0 +1,149 @@
+package signing
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	// DefaultAlias is the alias of generated keys, the one the Android
+	// documentation uses for upload keys
+	DefaultAlias = "upload"
+
+	// DefaultValidityYears covers the 25 years Google Play requires
+	DefaultValidityYears = 25
+
+	// DefaultKeySize is the RSA key size of generated keys
+	DefaultKeySize = 2048
+
+	// passwordLength is the length of generated passwords
+	passwordLength = 32
+	passwordChars  = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// GenerateOptions describes the key and certificate to generate
+type GenerateOptions struct {
+	Type          string // TypePKCS12 (default) or TypeJKS
+	Alias         string
+	Subject       pkix.Name
+	ValidityYears int
+	KeySize       int // 2048, 3072 or 4096
+}
+
+// Generated is a new keystore and the random passwords protecting it
+type Generated struct {
+	Data          []byte
+	StorePassword string
+	KeyPassword   string // equals StorePassword for PKCS#12
+	Info          *Info
+}
+
+// Generate creates an RSA key and its self-signed certificate, packaged in
+// a keystore protected by random passwords
+func Generate(opts GenerateOptions) (*Generated, error) {
+	if opts.Type == "" {
+		opts.Type = TypePKCS12
+	}
+	if opts.Alias == "" {
+		opts.Alias = DefaultAlias
+	}
+	if opts.ValidityYears == 0 {
+		opts.ValidityYears = DefaultValidityYears
+	}
+	if opts.KeySize == 0 {
+		opts.KeySize = DefaultKeySize
+	}
+
+	if opts.Type != TypePKCS12 && opts.Type != TypeJKS {
+		return nil, fmt.Errorf("unsupported keystore type %q", opts.Type)
+	}
+	if opts.KeySize != 2048 && opts.KeySize != 3072 && opts.KeySize != 4096 {
+		return nil, fmt.Errorf("unsupported key size %d", opts.KeySize)
+	}
+	if opts.ValidityYears < 1 || opts.ValidityYears > 100 {
+		return nil, fmt.Errorf("validity must be between 1 and 100 years")
+	}
+	if opts.Subject.CommonName == "" {
+		return nil, fmt.Errorf("the common name is required")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, opts.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber:       serial,
+		Subject:            opts.Subject,
+		NotBefore:          now,
+		NotAfter:           now.AddDate(opts.ValidityYears, 0, 0),
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	chain := []*x509.Certificate{cert}
+
+	storePassword, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	keyPassword := storePassword
+
+	var data []byte
+	if opts.Type == TypeJKS {
+		if keyPassword, err = randomPassword(); err != nil {
+			return nil, err
+		}
+		data, err = encodeJKS(opts.Alias, key, chain, storePassword, keyPassword, now)
+	} else {
+		data, err = encodePKCS12(opts.Alias, key, chain, storePassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Read it back the way uploads are checked
+	info, err := Inspect(data, storePassword, opts.Alias, keyPassword)
+	if err != nil {
+		return nil, fmt.Errorf("generated keystore does not open: %v", err)
+	}
+
+	return &Generated{
+		Data:          data,
+		StorePassword: storePassword,
+		KeyPassword:   keyPassword,
+		Info:          info,
+	}, nil
+}
+
+// randomPassword returns a password of letters and digits, which every tool
+// accepts without quoting
+func randomPassword() (string, error) {
+	max := big.NewInt(int64(len(passwordChars)))
+	password := make([]byte, passwordLength)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordChars[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,94 @@
+package signing
+
+import (
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	subject := pkix.Name{CommonName: "Flotio", Organization: []string{"Flotio"}, Country: []string{"FR"}}
+
+	tests := []struct {
+		name      string
+		opts      GenerateOptions
+		wantType  string
+		wantAlias string
+		wantYears int
+		wantErr   string
+	}{
+		{"defaults", GenerateOptions{Subject: subject}, TypePKCS12, DefaultAlias, DefaultValidityYears, ""},
+		{"jks", GenerateOptions{Type: TypeJKS, Alias: "release", Subject: subject, ValidityYears: 30}, TypeJKS, "release", 30, ""},
+		{"pkcs12 alias", GenerateOptions{Type: TypePKCS12, Alias: "release", Subject: subject, ValidityYears: 1}, TypePKCS12, "release", 1, ""},
+		{"unknown type", GenerateOptions{Type: "bks", Subject: subject}, "", "", 0, "unsupported keystore type"},
+		{"unsupported key size", GenerateOptions{KeySize: 1024, Subject: subject}, "", "", 0, "unsupported key size"},
+		{"validity too long", GenerateOptions{ValidityYears: 101, Subject: subject}, "", "", 0, "validity"},
+		{"negative validity", GenerateOptions{ValidityYears: -1, Subject: subject}, "", "", 0, "validity"},
+		{"missing common name", GenerateOptions{Subject: pkix.Name{Organization: []string{"Flotio"}}}, "", "", 0, "common name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generated, err := Generate(tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+
+			if len(generated.StorePassword) != passwordLength {
+				t.Errorf("store password has %d characters, want %d", len(generated.StorePassword), passwordLength)
+			}
+			if tt.wantType == TypePKCS12 && generated.KeyPassword != generated.StorePassword {
+				t.Error("PKCS#12 key password differs from the store password")
+			}
+			if tt.wantType == TypeJKS && generated.KeyPassword == generated.StorePassword {
+				t.Error("JKS key password reuses the store password")
+			}
+
+			// The returned passwords open the keystore the way uploads are checked
+			info, err := Inspect(generated.Data, generated.StorePassword, tt.wantAlias, generated.KeyPassword)
+			if err != nil {
+				t.Fatalf("Inspect: %v", err)
+			}
+			if info.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", info.Type, tt.wantType)
+			}
+			if info.Alias != tt.wantAlias {
+				t.Errorf("Alias = %q, want %q", info.Alias, tt.wantAlias)
+			}
+			if info.Subject != subject.String() || info.Issuer != subject.String() {
+				t.Errorf("Subject = %q, Issuer = %q, want %q self-signed", info.Subject, info.Issuer, subject.String())
+			}
+			if want := info.NotBefore.AddDate(tt.wantYears, 0, 0); !info.NotAfter.Equal(want) {
+				t.Errorf("NotAfter = %v, want %v", info.NotAfter, want)
+			}
+			if *info != *generated.Info {
+				t.Errorf("Info = %+v, want %+v", generated.Info, info)
+			}
+		})
+	}
+}
+
+func TestRandomPassword(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		password, err := randomPassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(password) != passwordLength {
+			t.Errorf("%q has %d characters, want %d", password, len(password), passwordLength)
+		}
+		if strings.Trim(password, passwordChars) != "" {
+			t.Errorf("%q has characters outside %q", password, passwordChars)
+		}
+		if seen[password] {
+			t.Errorf("%q generated twice", password)
+		}
+		seen[password] = true
+	}
+}
@@ -0,0 +1,308 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Java KeyStore (JKS) format, as written by keytool:
+//
+//	magic, version, entry count
+//	entries: tag, alias, creation time, then
+//	  private key: protected key, certificate chain
+//	  trusted certificate: certificate
+//	SHA-1 of the password, "Mighty Aphrodite" and everything above
+const (
+	jksMagic          = 0xFEEDFEED
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+	jksWhitener       = "Mighty Aphrodite"
+)
+
+// oidJKSKeyProtector identifies the proprietary key protection of JKS
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// jksEntry is a private key entry of a JKS keystore, still protected by the
+// key password
+type jksEntry struct {
+	alias        string
+	protectedKey []byte
+	chain        []*x509.Certificate
+}
+
+// encryptedPrivateKeyInfo is the PKCS#8 envelope of a protected key
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// decodeJKS checks the integrity of a JKS keystore with the store password
+// and returns its private key entries
+func decodeJKS(data []byte, storePassword string) ([]jksEntry, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+	}
+
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if subtle.ConstantTimeCompare(jksDigest(body, storePassword), digest) != 1 {
+		return nil, ErrIncorrectPassword
+	}
+
+	r := bytes.NewReader(body)
+	var header struct {
+		Magic   uint32
+		Version uint32
+		Count   uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil || header.Magic != jksMagic {
+		return nil, fmt.Errorf("%w: not a JKS keystore", ErrInvalidKeystore)
+	}
+	if header.Version != 1 && header.Version != 2 {
+		return nil, fmt.Errorf("%w: unsupported JKS version %d", ErrInvalidKeystore, header.Version)
+	}
+
+	var entries []jksEntry
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		if err := binary.Read(r, binary.BigEndian, &tag); err != nil {
+			return nil, fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+		}
+		alias, err := readJKSString(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(8, io.SeekCurrent); err != nil { // creation time
+			return nil, err
+		}
+
+		switch tag {
+		case jksPrivateKeyTag:
+			protectedKey, err := readJKSBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			var count uint32
+			if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+				return nil, fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+			}
+			entry := jksEntry{alias: alias, protectedKey: protectedKey}
+			for j := uint32(0); j < count; j++ {
+				cert, err := readJKSCertificate(r, header.Version)
+				if err != nil {
+					return nil, err
+				}
+				entry.chain = append(entry.chain, cert)
+			}
+			entries = append(entries, entry)
+		case jksTrustedCertTag:
+			if _, err := readJKSCertificate(r, header.Version); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown JKS entry type %d", ErrInvalidKeystore, tag)
+		}
+	}
+
+	return entries, nil
+}
+
+// recoverJKSKey removes the JKS protection of a private key: a SHA-1 based
+// keystream seeded with a salt, followed by a SHA-1 check of the key
+func recoverJKSKey(protectedKey []byte, keyPassword string) (interface{}, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(protectedKey, &info); err != nil {
+		return nil, fmt.Errorf("%w: malformed JKS private key", ErrInvalidKeystore)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		return nil, fmt.Errorf("%w: unsupported key protection %s", ErrInvalidKeystore, info.Algorithm.Algorithm)
+	}
+
+	encrypted := info.EncryptedData
+	if len(encrypted) < 2*sha1.Size {
+		return nil, fmt.Errorf("%w: malformed JKS private key", ErrInvalidKeystore)
+	}
+	salt := encrypted[:sha1.Size]
+	check := encrypted[len(encrypted)-sha1.Size:]
+	encrypted = encrypted[sha1.Size : len(encrypted)-sha1.Size]
+
+	password := utf16BE(keyPassword)
+	plain := jksKeystream(encrypted, password, salt)
+
+	h := sha1.New()
+	h.Write(password)
+	h.Write(plain)
+	if subtle.ConstantTimeCompare(h.Sum(nil), check) != 1 {
+		return nil, ErrIncorrectKeyPassword
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+	}
+	return key, nil
+}
+
+// jksKeystream XORs data with the keystream derived from password and salt,
+// which both encrypts and decrypts
+func jksKeystream(data, password, salt []byte) []byte {
+	out := make([]byte, len(data))
+	digest := salt
+	for i := 0; i < len(data); i += sha1.Size {
+		h := sha1.New()
+		h.Write(password)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(data); j++ {
+			out[i+j] = data[i+j] ^ digest[j]
+		}
+	}
+	return out
+}
+
+// jksDigest computes the integrity digest of a keystore body
+func jksDigest(body []byte, storePassword string) []byte {
+	h := sha1.New()
+	h.Write(utf16BE(storePassword))
+	h.Write([]byte(jksWhitener))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// utf16BE encodes s as big-endian UTF-16, the form of the passwords Java
+// hashes and of PKCS#12 BMPStrings
+func utf16BE(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2*len(chars))
+	for _, c := range chars {
+		out = append(out, byte(c>>8), byte(c))
+	}
+	return out
+}
+
+func readJKSCertificate(r *bytes.Reader, version uint32) (*x509.Certificate, error) {
+	if version == 2 {
+		certType, err := readJKSString(r)
+		if err != nil {
+			return nil, err
+		}
+		if certType != "X.509" {
+			return nil, fmt.Errorf("%w: unsupported certificate type %q", ErrInvalidKeystore, certType)
+		}
+	}
+
+	der, err := readJKSBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+	}
+	return cert, nil
+}
+
+// readJKSString reads a Java modified UTF-8 string; aliases are ASCII in practice
+func readJKSString(r *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+	}
+	return string(buf), nil
+}
+
+func readJKSBytes(r *bytes.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+	}
+	if int64(length) > int64(r.Len()) {
+		return nil, fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: truncated JKS keystore", ErrInvalidKeystore)
+	}
+	return buf, nil
+}
+
+// isJKS reports whether data starts with the JKS magic number
+func isJKS(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == jksMagic
+}
+
+// jksAliases lists the aliases of the private key entries
+func jksAliases(entries []jksEntry) string {
+	aliases := make([]string, len(entries))
+	for i, entry := range entries {
+		aliases[i] = entry.alias
+	}
+	return strings.Join(aliases, ", ")
+}
+
+// encodeJKS writes a JKS keystore holding key and chain under alias
+func encodeJKS(alias string, key interface{}, chain []*x509.Certificate, storePassword, keyPassword string, created time.Time) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	password := utf16BE(keyPassword)
+	h := sha1.New()
+	h.Write(password)
+	h.Write(pkcs8)
+
+	protected := append(append(salt, jksKeystream(pkcs8, password, salt)...), h.Sum(nil)...)
+	protectedKey, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: protected,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	write := func(v interface{}) { binary.Write(&buf, binary.BigEndian, v) }
+	writeString := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(2))
+	write(uint32(1))
+
+	// keytool stores aliases in lower case
+	write(uint32(jksPrivateKeyTag))
+	writeString(strings.ToLower(alias))
+	write(created.UnixMilli())
+	write(uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+	write(uint32(len(chain)))
+	for _, cert := range chain {
+		writeString("X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	buf.Write(jksDigest(buf.Bytes(), storePassword))
+	return buf.Bytes(), nil
+}
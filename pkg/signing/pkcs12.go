@@ -0,0 +1,303 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+)
+
+// PKCS#12 encoding of a single key and its certificate chain, with the
+// friendly name Java reads as the alias (the go-pkcs12 encoder does not
+// write one). The key is protected with PBES2 (PBKDF2-HMAC-SHA256,
+// AES-256-CBC), the file with a HMAC-SHA256 MAC, as keytool does since
+// Java 12.
+
+const (
+	pkcs12Iterations = 10000
+
+	// pkcs12MACKeyID selects the MAC key in the PKCS#12 key derivation
+	pkcs12MACKeyID = 3
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	asn1NULL           = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     // [0] EXPLICIT
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue // SET of values
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"explicit,tag:0"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	PRF        pkix.AlgorithmIdentifier
+}
+
+// encodePKCS12 writes a PKCS#12 keystore holding key and chain under alias
+func encodePKCS12(alias string, key interface{}, chain []*x509.Certificate, password string) ([]byte, error) {
+	localKeyID := sha1.Sum(chain[0].Raw)
+	keyAttributes, err := bagAttributes(alias, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Key bag, encrypted
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	shrouded, err := pbes2Encrypt(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+	keyBag := safeBag{ID: oidShroudedKeyBag, Value: explicit(shrouded), Attributes: keyAttributes}
+
+	// Certificate bags, in clear like keytool does for Java 12+ keystores
+	certBags := make([]safeBag, 0, len(chain))
+	for i, cert := range chain {
+		value, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: cert.Raw})
+		if err != nil {
+			return nil, err
+		}
+		bag := safeBag{ID: oidCertBag, Value: explicit(value)}
+		if i == 0 {
+			bag.Attributes = keyAttributes
+		}
+		certBags = append(certBags, bag)
+	}
+
+	var authSafe []contentInfo
+	for _, bags := range [][]safeBag{{keyBag}, certBags} {
+		info, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, info)
+	}
+	authSafeDER, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	// MAC over the authenticated safe
+	macSalt := make([]byte, 16)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(bmpPassword(password), macSalt, pkcs12MACKeyID, pkcs12Iterations, sha256.Size)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(authSafeDER)
+
+	content, err := asn1.Marshal(authSafeDER)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfxPDU{
+		Version: 3,
+		AuthSafe: contentInfo{
+			ContentType: oidData,
+			Content:     explicit(content),
+		},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1NULL},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// bagAttributes returns the friendly name and local key ID attributes
+// linking a key to its certificate
+func bagAttributes(alias string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	name, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: utf16BE(alias)})
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: name}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: keyID}},
+	}, nil
+}
+
+// explicit tags DER with [0] EXPLICIT, which encoding/asn1 does not apply to
+// raw values
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// dataContentInfo wraps safe bags in an unencrypted content info
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	contents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(contents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidData, Content: explicit(octets)}, nil
+}
+
+// pbes2Encrypt returns an EncryptedPrivateKeyInfo protecting a PKCS#8 key
+func pbes2Encrypt(pkcs8 []byte, password string) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, pkcs12Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(pkcs8)%aes.BlockSize
+	encrypted := append(append([]byte{}, pkcs8...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: pkcs12Iterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1NULL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+}
+
+// pkcs12KDF derives a key from a password as specified by RFC 7292
+// appendix B.2, with SHA-256
+func pkcs12KDF(password, salt []byte, id byte, iterations, size int) []byte {
+	const v = sha256.BlockSize
+
+	fill := func(in []byte) []byte {
+		if len(in) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(in)+v-1)/v))
+		for i := range out {
+			out[i] = in[i%len(in)]
+		}
+		return out
+	}
+	I := append(fill(salt), fill(password)...)
+	D := bytes.Repeat([]byte{id}, v)
+
+	var out []byte
+	for len(out) < size {
+		h := sha256.New()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			sum := sha256.Sum256(A)
+			A = sum[:]
+		}
+		out = append(out, A...)
+
+		// I_j = (I_j + B + 1) mod 2^(8v), B being A repeated over v bytes
+		B := fill(A)
+		for j := 0; j < len(I); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(I[j+k]) + int(B[k]) + carry
+				I[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// bmpPassword encodes a password as a zero-terminated BMPString
+func bmpPassword(password string) []byte {
+	return append(utf16BE(password), 0, 0)
+}
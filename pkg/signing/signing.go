@@ -0,0 +1,188 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Keystore types
+const (
+	TypeJKS    = "jks"
+	TypePKCS12 = "pkcs12"
+)
+
+var (
+	// ErrInvalidKeystore is returned for files that are not a JKS or
+	// PKCS#12 keystore holding a private key and its certificate
+	ErrInvalidKeystore = errors.New("invalid keystore")
+
+	// ErrIncorrectPassword is returned when the store password does not
+	// open the keystore
+	ErrIncorrectPassword = errors.New("incorrect store password")
+
+	// ErrIncorrectKeyPassword is returned when the key password does not
+	// open the private key
+	ErrIncorrectKeyPassword = errors.New("incorrect key password")
+
+	// ErrAliasNotFound is returned when the keystore has no private key
+	// under the alias
+	ErrAliasNotFound = errors.New("key alias not found")
+)
+
+// Info describes the signing key of a keystore
+type Info struct {
+	Type              string    `json:"type"`
+	Alias             string    `json:"alias"`
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	SHA1Fingerprint   string    `json:"sha1_fingerprint"`
+	SHA256Fingerprint string    `json:"sha256_fingerprint"`
+}
+
+// Inspect opens the key under alias with the given passwords, the way Gradle
+// signs with it, and describes its certificate. An empty alias selects the
+// only private key of the keystore, an empty key password the store
+// password.
+func Inspect(data []byte, storePassword, alias, keyPassword string) (*Info, error) {
+	if keyPassword == "" {
+		keyPassword = storePassword
+	}
+
+	switch {
+	case isJKS(data):
+		return inspectJKS(data, storePassword, alias, keyPassword)
+	case len(data) > 0 && data[0] == 0x30: // DER sequence
+		return inspectPKCS12(data, storePassword, alias, keyPassword)
+	}
+	return nil, fmt.Errorf("%w: not a JKS or PKCS#12 file", ErrInvalidKeystore)
+}
+
+func inspectJKS(data []byte, storePassword, alias, keyPassword string) (*Info, error) {
+	entries, err := decodeJKS(data, storePassword)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no private key entry", ErrInvalidKeystore)
+	}
+
+	var entry *jksEntry
+	if alias == "" {
+		if len(entries) > 1 {
+			return nil, fmt.Errorf("%w: the keystore holds several keys (%s), set the alias", ErrAliasNotFound, jksAliases(entries))
+		}
+		entry = &entries[0]
+	} else {
+		// keytool stores aliases in lower case and Java matches them case-insensitively
+		for i := range entries {
+			if strings.EqualFold(entries[i].alias, alias) {
+				entry = &entries[i]
+				break
+			}
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("%w: %q (keystore holds %s)", ErrAliasNotFound, alias, jksAliases(entries))
+		}
+	}
+	if len(entry.chain) == 0 {
+		return nil, fmt.Errorf("%w: key %q has no certificate", ErrInvalidKeystore, entry.alias)
+	}
+
+	key, err := recoverJKSKey(entry.protectedKey, keyPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	return describe(TypeJKS, entry.alias, key, entry.chain)
+}
+
+func inspectPKCS12(data []byte, storePassword, alias, keyPassword string) (*Info, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, storePassword)
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, ErrIncorrectPassword
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+	}
+
+	// keytool and Gradle protect the key of a PKCS#12 keystore with the store password
+	if keyPassword != storePassword {
+		return nil, fmt.Errorf("%w: PKCS#12 keys use the store password", ErrIncorrectKeyPassword)
+	}
+
+	name := pkcs12Alias(data, storePassword)
+	if alias == "" {
+		alias = name
+	} else if name != "" && !strings.EqualFold(name, alias) {
+		return nil, fmt.Errorf("%w: %q (keystore holds %s)", ErrAliasNotFound, alias, name)
+	}
+
+	return describe(TypePKCS12, alias, key, append([]*x509.Certificate{cert}, caCerts...))
+}
+
+// pkcs12Alias returns the friendly name of the key, the alias Java uses.
+// ToPEM is the only decoder exposing bag attributes; it only reads the usual
+// layout of a key and its certificates, other files have no known alias.
+func pkcs12Alias(data []byte, password string) string {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return ""
+	}
+	for _, block := range blocks {
+		if block.Type == "PRIVATE KEY" {
+			return block.Headers["friendlyName"]
+		}
+	}
+	return ""
+}
+
+// describe finds the certificate of key in chain and describes it
+func describe(keystoreType, alias string, key interface{}, chain []*x509.Certificate) (*Info, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported private key type %T", ErrInvalidKeystore, key)
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported public key type %T", ErrInvalidKeystore, signer.Public())
+	}
+
+	for _, cert := range chain {
+		if public.Equal(cert.PublicKey) {
+			sha1Sum := sha1.Sum(cert.Raw)
+			sha256Sum := sha256.Sum256(cert.Raw)
+			return &Info{
+				Type:              keystoreType,
+				Alias:             alias,
+				Subject:           cert.Subject.String(),
+				Issuer:            cert.Issuer.String(),
+				NotBefore:         cert.NotBefore,
+				NotAfter:          cert.NotAfter,
+				SHA1Fingerprint:   fingerprint(sha1Sum[:]),
+				SHA256Fingerprint: fingerprint(sha256Sum[:]),
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no certificate matches the private key", ErrInvalidKeystore)
+}
+
+// fingerprint formats a digest the way keytool and the Firebase console do,
+// e.g. "AB:CD:..."
+func fingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,277 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testKey returns an RSA key and its self-signed certificate
+func testKey(t *testing.T, commonName string) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Flotio"}},
+		NotBefore:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2049, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func TestUTF16BE(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []byte
+	}{
+		{"", []byte{}},
+		{"ab", []byte{0x00, 'a', 0x00, 'b'}},
+		{"é", []byte{0x00, 0xE9}},
+		{"€", []byte{0x20, 0xAC}},
+		{"😀", []byte{0xD8, 0x3D, 0xDE, 0x00}}, // surrogate pair
+	}
+	for _, tt := range tests {
+		if got := utf16BE(tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("utf16BE(%q) = % X, want % X", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBMPPassword(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []byte
+	}{
+		{"", []byte{0x00, 0x00}},
+		{"pw", []byte{0x00, 'p', 0x00, 'w', 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		if got := bmpPassword(tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("bmpPassword(%q) = % X, want % X", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	password := bmpPassword("secret")
+	salt := []byte("0123456789abcdef")
+	base := pkcs12KDF(password, salt, pkcs12MACKeyID, 10, 32)
+
+	tests := []struct {
+		name string
+		got  []byte
+		same bool
+	}{
+		{"deterministic", pkcs12KDF(password, salt, pkcs12MACKeyID, 10, 32), true},
+		{"other password", pkcs12KDF(bmpPassword("Secret"), salt, pkcs12MACKeyID, 10, 32), false},
+		{"other salt", pkcs12KDF(password, []byte("fedcba9876543210"), pkcs12MACKeyID, 10, 32), false},
+		{"other id", pkcs12KDF(password, salt, 1, 10, 32), false},
+		{"other iterations", pkcs12KDF(password, salt, pkcs12MACKeyID, 11, 32), false},
+		{"longer output extends", pkcs12KDF(password, salt, pkcs12MACKeyID, 10, 80)[:32], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bytes.Equal(tt.got, base) != tt.same {
+				t.Errorf("got % X, base % X, want same=%v", tt.got, base, tt.same)
+			}
+		})
+	}
+
+	if got := pkcs12KDF(password, salt, pkcs12MACKeyID, 10, 80); len(got) != 80 {
+		t.Errorf("len = %d, want 80", len(got))
+	}
+}
+
+func TestIsJKS(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"magic", []byte{0xFE, 0xED, 0xFE, 0xED, 0x00}, true},
+		{"short", []byte{0xFE, 0xED, 0xFE}, false},
+		{"der", []byte{0x30, 0x82, 0x01, 0x00}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isJKS(tt.data); got != tt.want {
+			t.Errorf("isJKS(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{nil, ""},
+		{[]byte{0x0A}, "0A"},
+		{[]byte{0xAB, 0xCD, 0x01}, "AB:CD:01"},
+	}
+	for _, tt := range tests {
+		if got := fingerprint(tt.in); got != tt.want {
+			t.Errorf("fingerprint(% X) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodePKCS12Decodes(t *testing.T) {
+	key, cert := testKey(t, "pkcs12")
+	data, err := encodePKCS12("upload", key, []*x509.Certificate{cert}, "store-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reference decoder checks the MAC and decrypts the key
+	decoded, decodedCert, _, err := pkcs12.DecodeChain(data, "store-pass")
+	if err != nil {
+		t.Fatalf("DecodeChain: %v", err)
+	}
+	if !key.Equal(decoded) {
+		t.Error("decoded key differs")
+	}
+	if !decodedCert.Equal(cert) {
+		t.Error("decoded certificate differs")
+	}
+	if got := pkcs12Alias(data, "store-pass"); got != "upload" {
+		t.Errorf("alias = %q, want %q", got, "upload")
+	}
+
+	if _, _, _, err := pkcs12.DecodeChain(data, "wrong"); err != pkcs12.ErrIncorrectPassword {
+		t.Errorf("wrong password: err = %v, want %v", err, pkcs12.ErrIncorrectPassword)
+	}
+}
+
+func TestEncodeJKSDecodes(t *testing.T) {
+	key, cert := testKey(t, "jks")
+	created := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	data, err := encodeJKS("Upload", key, []*x509.Certificate{cert}, "store-pass", "key-pass", created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := decodeJKS(data, "store-pass")
+	if err != nil {
+		t.Fatalf("decodeJKS: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if entries[0].alias != "upload" {
+		t.Errorf("alias = %q, want it lower-cased to %q", entries[0].alias, "upload")
+	}
+	if len(entries[0].chain) != 1 || !entries[0].chain[0].Equal(cert) {
+		t.Error("decoded chain differs")
+	}
+
+	recovered, err := recoverJKSKey(entries[0].protectedKey, "key-pass")
+	if err != nil {
+		t.Fatalf("recoverJKSKey: %v", err)
+	}
+	if !key.Equal(recovered) {
+		t.Error("recovered key differs")
+	}
+	if _, err := recoverJKSKey(entries[0].protectedKey, "store-pass"); !errors.Is(err, ErrIncorrectKeyPassword) {
+		t.Errorf("wrong key password: err = %v, want %v", err, ErrIncorrectKeyPassword)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	key, cert := testKey(t, "inspect")
+	chain := []*x509.Certificate{cert}
+
+	jks, err := encodeJKS("upload", key, chain, "store-pass", "key-pass", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := encodePKCS12("upload", key, chain, "store-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), jks...)
+	tampered[20] ^= 0xFF
+
+	sha1Sum := sha1.Sum(cert.Raw)
+	wantSHA1 := fingerprint(sha1Sum[:])
+
+	tests := []struct {
+		name          string
+		data          []byte
+		storePassword string
+		alias         string
+		keyPassword   string
+		wantType      string
+		wantErr       error
+	}{
+		{"jks", jks, "store-pass", "upload", "key-pass", TypeJKS, nil},
+		{"jks alias case-insensitive", jks, "store-pass", "UPLOAD", "key-pass", TypeJKS, nil},
+		{"jks only key without alias", jks, "store-pass", "", "key-pass", TypeJKS, nil},
+		{"jks wrong store password", jks, "wrong", "upload", "key-pass", "", ErrIncorrectPassword},
+		{"jks wrong key password", jks, "store-pass", "upload", "wrong", "", ErrIncorrectKeyPassword},
+		{"jks key password defaults to store password", jks, "store-pass", "upload", "", "", ErrIncorrectKeyPassword},
+		{"jks unknown alias", jks, "store-pass", "release", "key-pass", "", ErrAliasNotFound},
+		{"jks tampered", tampered, "store-pass", "upload", "key-pass", "", ErrIncorrectPassword},
+		{"pkcs12", p12, "store-pass", "upload", "", TypePKCS12, nil},
+		{"pkcs12 without alias", p12, "store-pass", "", "store-pass", TypePKCS12, nil},
+		{"pkcs12 wrong store password", p12, "wrong", "upload", "", "", ErrIncorrectPassword},
+		{"pkcs12 separate key password", p12, "store-pass", "upload", "key-pass", "", ErrIncorrectKeyPassword},
+		{"pkcs12 unknown alias", p12, "store-pass", "release", "", "", ErrAliasNotFound},
+		{"not a keystore", []byte("hello"), "store-pass", "", "", "", ErrInvalidKeystore},
+		{"empty", nil, "store-pass", "", "", "", ErrInvalidKeystore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Inspect(tt.data, tt.storePassword, tt.alias, tt.keyPassword)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Inspect: %v", err)
+			}
+			if info.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", info.Type, tt.wantType)
+			}
+			if !strings.EqualFold(info.Alias, "upload") {
+				t.Errorf("Alias = %q, want %q", info.Alias, "upload")
+			}
+			if info.Subject != cert.Subject.String() {
+				t.Errorf("Subject = %q, want %q", info.Subject, cert.Subject.String())
+			}
+			if info.SHA1Fingerprint != wantSHA1 {
+				t.Errorf("SHA1Fingerprint = %q, want %q", info.SHA1Fingerprint, wantSHA1)
+			}
+			if len(info.SHA256Fingerprint) != 32*3-1 {
+				t.Errorf("SHA256Fingerprint = %q, want 32 bytes", info.SHA256Fingerprint)
+			}
+			if !info.NotAfter.Equal(cert.NotAfter) {
+				t.Errorf("NotAfter = %v, want %v", info.NotAfter, cert.NotAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrNotConfigured is returned when no object storage endpoint is set
+var ErrNotConfigured = errors.New("object storage is not configured")
+
+// Storage stores build artifacts in an S3-compatible bucket (AWS S3, MinIO, ...)
+type Storage struct {
+	client        *minio.Client
+	presignClient *minio.Client // signs URLs for the endpoint clients can reach
+	bucket        string
+	presignExpiry time.Duration
+}
+
+var store *Storage
+
+// Init creates the process-wide storage from the environment.
+// It returns ErrNotConfigured when S3_ENDPOINT is empty.
+func Init(ctx context.Context) (*Storage, error) {
+	s, err := NewFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.EnsureBucket(ctx); err != nil {
+		return nil, err
+	}
+
+	store = s
+	return s, nil
+}
+
+// Default returns the process-wide storage, or nil when not configured
+func Default() *Storage {
+	return store
+}
+
+// NewFromEnv creates a storage client from S3_* environment variables
+func NewFromEnv() (*Storage, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, ErrNotConfigured
+	}
+
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		bucket = "flotio-artifacts"
+	}
+
+	useSSL, _ := strconv.ParseBool(os.Getenv("S3_USE_SSL"))
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	expiry := 15 * time.Minute
+	if value, err := time.ParseDuration(os.Getenv("S3_PRESIGN_EXPIRY")); err == nil && value > 0 {
+		expiry = value
+	}
+
+	creds := credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), "")
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+
+	// Presigned URLs must target the endpoint the browser can reach, which
+	// differs from the in-cluster one behind a proxy or ingress
+	presignClient := client
+	if publicEndpoint := os.Getenv("S3_PUBLIC_ENDPOINT"); publicEndpoint != "" {
+		publicURL, err := url.Parse(publicEndpoint)
+		if err != nil || publicURL.Host == "" {
+			return nil, fmt.Errorf("invalid S3_PUBLIC_ENDPOINT %q", publicEndpoint)
+		}
+		presignClient, err = minio.New(publicURL.Host, &minio.Options{
+			Creds:  creds,
+			Secure: publicURL.Scheme == "https",
+			Region: region,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 presign client: %v", err)
+		}
+	}
+
+	return &Storage{
+		client:        client,
+		presignClient: presignClient,
+		bucket:        bucket,
+		presignExpiry: expiry,
+	}, nil
+}
+
+// EnsureBucket creates the artifact bucket if it does not exist yet
+func (s *Storage) EnsureBucket(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket %s: %v", s.bucket, err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{}); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %v", s.bucket, err)
+	}
+	return nil
+}
+
+// Upload stores the content of r under key. size may be -1 when unknown.
+func (s *Storage) Upload(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	return nil
+}
+
+// Object is an open stored object
+type Object struct {
+	io.ReadCloser
+	Size        int64
+	ContentType string
+}
+
+// Open returns a reader for the object stored under key
+func (s *Storage) Open(ctx context.Context, key string) (*Object, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", key, err)
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("failed to stat %s: %v", key, err)
+	}
+
+	return &Object{
+		ReadCloser:  obj,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+	}, nil
+}
+
+// PresignedURL returns a short-lived URL downloading key as fileName
+func (s *Storage) PresignedURL(ctx context.Context, key, fileName string) (*url.URL, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+	u, err := s.presignClient.PresignedGetObject(ctx, s.bucket, key, s.presignExpiry, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign %s: %v", key, err)
+	}
+	return u, nil
+}
+
+// Delete removes the object stored under key
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return nil
+}
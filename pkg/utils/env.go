@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// EnvInt returns the integer set in the environment variable key, or
+// fallback when it is unset. Values that are not integers, or are below min,
+// are logged and replaced by fallback.
+func EnvInt(key string, fallback, min int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min {
+		log.Printf("Invalid %s %q, must be an integer of at least %d, using %d", key, raw, min, fallback)
+		return fallback
+	}
+	return value
+}
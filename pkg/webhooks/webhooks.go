@@ -0,0 +1,145 @@
+// Package webhooks records GitHub webhook deliveries, so each one is
+// processed once and failed ones can be replayed
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// retention is how long processed deliveries are kept
+	retention = 30 * 24 * time.Hour
+
+	// pruneInterval is how often expired deliveries are deleted
+	pruneInterval = time.Hour
+
+	// staleProcessing is how long a delivery may stay in processing before it
+	// is assumed abandoned, e.g. by an API replica that stopped
+	staleProcessing = 10 * time.Minute
+)
+
+// ErrNotReplayable is returned when replaying a delivery that did not fail
+var ErrNotReplayable = errors.New("delivery is not failed")
+
+// Record stores a delivery and claims it for processing. It returns false
+// when the delivery is already processed or being processed, which makes
+// redeliveries of successful deliveries no-ops while failed ones are
+// processed again.
+func Record(deliveryID, event string, payload []byte) (db.WebhookDelivery, bool, error) {
+	var meta struct {
+		Action       string `json:"action"`
+		Installation struct {
+			ID int64 `json:"id"`
+		} `json:"installation"`
+	}
+	// Informative only, left empty for payloads without them
+	_ = json.Unmarshal(payload, &meta)
+
+	delivery := db.WebhookDelivery{
+		DeliveryID:     deliveryID,
+		Event:          event,
+		Action:         meta.Action,
+		InstallationID: meta.Installation.ID,
+		Payload:        string(payload),
+		Status:         db.WebhookDeliveryProcessing,
+		Attempts:       1,
+	}
+	result := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery)
+	if result.Error != nil {
+		return delivery, false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return delivery, true, nil
+	}
+
+	if err := db.DB.Where("delivery_id = ?", deliveryID).First(&delivery).Error; err != nil {
+		return delivery, false, err
+	}
+	claimed, err := claim(&delivery)
+	return delivery, claimed, err
+}
+
+// Replay claims a failed delivery for processing again
+func Replay(delivery *db.WebhookDelivery) error {
+	claimed, err := claim(delivery)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrNotReplayable
+	}
+	return nil
+}
+
+// claim marks a failed or abandoned delivery as processing, unless another
+// request claimed it first
+func claim(delivery *db.WebhookDelivery) (bool, error) {
+	result := db.DB.Model(&db.WebhookDelivery{}).
+		Where("id = ?", delivery.ID).
+		Where(db.DB.Where("status = ?", db.WebhookDeliveryFailed).
+			Or("status = ? AND updated_at < ?", db.WebhookDeliveryProcessing, time.Now().Add(-staleProcessing))).
+		Updates(map[string]interface{}{
+			"status":   db.WebhookDeliveryProcessing,
+			"attempts": gorm.Expr("attempts + 1"),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	return true, db.DB.First(delivery, delivery.ID).Error
+}
+
+// Finish records the outcome of processing a claimed delivery
+func Finish(delivery *db.WebhookDelivery, outcome string, processErr error) {
+	now := time.Now()
+	delivery.Status = db.WebhookDeliveryProcessed
+	delivery.Result = outcome
+	delivery.Error = ""
+	delivery.ProcessedAt = &now
+	if processErr != nil {
+		delivery.Status = db.WebhookDeliveryFailed
+		delivery.Error = processErr.Error()
+	}
+
+	err := db.DB.Model(&db.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status":       delivery.Status,
+		"result":       delivery.Result,
+		"error":        delivery.Error,
+		"processed_at": now,
+	}).Error
+	if err != nil {
+		log.Printf("Webhooks: failed to record the outcome of delivery %s: %v", delivery.DeliveryID, err)
+	}
+}
+
+// Run deletes expired deliveries until ctx is cancelled. Failed ones are
+// kept until they are replayed.
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		err := db.DB.Unscoped().
+			Where("status = ? AND created_at < ?", db.WebhookDeliveryProcessed, time.Now().Add(-retention)).
+			Delete(&db.WebhookDelivery{}).Error
+		if err != nil {
+			log.Printf("Webhooks: failed to delete expired deliveries: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package webhooks
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flotio-dev/api/pkg/db"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// useTestDB points db.DB at a transaction of the Postgres database named by
+// TEST_DATABASE_URL, rolled back at the end of the test. Tests are skipped
+// without it.
+func useTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+
+	tx := conn.Begin()
+	if err := tx.AutoMigrate(&db.WebhookDelivery{}); err != nil {
+		tx.Rollback()
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	saved := db.DB
+	db.DB = tx
+	t.Cleanup(func() {
+		db.DB = saved
+		tx.Rollback()
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// storeDelivery stores a delivery in status, last updated age ago
+func storeDelivery(t *testing.T, deliveryID, status string, age time.Duration) db.WebhookDelivery {
+	t.Helper()
+
+	delivery := db.WebhookDelivery{DeliveryID: deliveryID, Event: "push", Payload: "{}", Status: status, Attempts: 1}
+	if err := db.DB.Create(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Model(&delivery).UpdateColumn("updated_at", time.Now().Add(-age)).Error; err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestRecord(t *testing.T) {
+	useTestDB(t)
+
+	tests := []struct {
+		name         string
+		status       string // stored before the delivery arrives, empty for none
+		age          time.Duration
+		wantClaimed  bool
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"new delivery", "", 0, true, db.WebhookDeliveryProcessing, 1},
+		{"redelivery of a processed delivery", db.WebhookDeliveryProcessed, 0, false, db.WebhookDeliveryProcessed, 1},
+		{"redelivery of a failed delivery", db.WebhookDeliveryFailed, 0, true, db.WebhookDeliveryProcessing, 2},
+		{"redelivery while processing", db.WebhookDeliveryProcessing, time.Minute, false, db.WebhookDeliveryProcessing, 1},
+		{"redelivery of an abandoned delivery", db.WebhookDeliveryProcessing, staleProcessing + time.Minute, true, db.WebhookDeliveryProcessing, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deliveryID := "record-" + tt.name
+			if tt.status != "" {
+				storeDelivery(t, deliveryID, tt.status, tt.age)
+			}
+
+			payload := []byte(`{"action":"opened","installation":{"id":42}}`)
+			delivery, claimed, err := Record(deliveryID, "pull_request", payload)
+			if err != nil {
+				t.Fatalf("Record: %v", err)
+			}
+			if claimed != tt.wantClaimed {
+				t.Errorf("claimed = %v, want %v", claimed, tt.wantClaimed)
+			}
+			if delivery.Status != tt.wantStatus {
+				t.Errorf("Status = %q, want %q", delivery.Status, tt.wantStatus)
+			}
+			if delivery.Attempts != tt.wantAttempts {
+				t.Errorf("Attempts = %d, want %d", delivery.Attempts, tt.wantAttempts)
+			}
+			if tt.status == "" && (delivery.Action != "opened" || delivery.InstallationID != 42 || delivery.Event != "pull_request") {
+				t.Errorf("got event %q, action %q, installation %d, want pull_request, opened, 42", delivery.Event, delivery.Action, delivery.InstallationID)
+			}
+
+			var count int64
+			db.DB.Model(&db.WebhookDelivery{}).Where("delivery_id = ?", deliveryID).Count(&count)
+			if count != 1 {
+				t.Errorf("%d rows for the delivery, want 1", count)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	useTestDB(t)
+
+	tests := []struct {
+		name    string
+		status  string
+		age     time.Duration
+		wantErr error
+	}{
+		{"failed", db.WebhookDeliveryFailed, 0, nil},
+		{"processed", db.WebhookDeliveryProcessed, 0, ErrNotReplayable},
+		{"processing", db.WebhookDeliveryProcessing, time.Minute, ErrNotReplayable},
+		{"abandoned", db.WebhookDeliveryProcessing, staleProcessing + time.Minute, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := storeDelivery(t, "replay-"+tt.name, tt.status, tt.age)
+
+			err := Replay(&delivery)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if delivery.Status != db.WebhookDeliveryProcessing || delivery.Attempts != 2 {
+				t.Errorf("got status %q after %d attempts, want processing after 2", delivery.Status, delivery.Attempts)
+			}
+
+			// A second replay finds it claimed
+			if err := Replay(&delivery); !errors.Is(err, ErrNotReplayable) {
+				t.Errorf("second replay: err = %v, want %v", err, ErrNotReplayable)
+			}
+		})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	useTestDB(t)
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus string
+		wantError  string
+	}{
+		{"processed", nil, db.WebhookDeliveryProcessed, ""},
+		{"failed", errors.New("boom"), db.WebhookDeliveryFailed, "boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := storeDelivery(t, "finish-"+tt.name, db.WebhookDeliveryProcessing, 0)
+
+			Finish(&delivery, "queued builds 1", tt.err)
+
+			var stored db.WebhookDelivery
+			if err := db.DB.First(&stored, delivery.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.wantStatus || stored.Error != tt.wantError || stored.Result != "queued builds 1" {
+				t.Errorf("got status %q, error %q, result %q, want %q, %q, %q", stored.Status, stored.Error, stored.Result, tt.wantStatus, tt.wantError, "queued builds 1")
+			}
+			if stored.ProcessedAt == nil {
+				t.Error("ProcessedAt not set")
+			}
+		})
+	}
+}